@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Serves the web API of a pipeline run:
+//
+//	GET /stages                      stages with status and runtime
+//	GET /stages/STAGE                a single stage
+//	GET /stages/STAGE/log            walrus.log of the stage, ?tail=N for
+//	                                 the last N lines (at most 10000),
+//	                                 supports Range requests
+//	GET /stages/STAGE/files/PATH     directory listing or download of a file in
+//	                                 the output directory of the stage
+//	GET /pipeline                    the completed pipeline description
+type runAPI struct {
+	state       *runState
+	hostpath    string
+	description string
+}
+
+// A file or directory in the output directory of a stage.
+type fileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Dir     bool
+}
+
+func (api *runAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.Trim(req.URL.Path, "/"), "/", 4)
+	switch {
+	case len(parts) == 1 && parts[0] == "pipeline":
+		api.serveDescription(w, req)
+	case len(parts) == 1 && parts[0] == "stages":
+		api.serveStages(w, req)
+	case len(parts) >= 2 && parts[0] == "stages":
+		stage := api.stage(parts[1])
+		if stage == nil {
+			http.Error(w, "No stage named "+parts[1], http.StatusNotFound)
+			return
+		}
+		switch {
+		case len(parts) == 2:
+			writeJSON(w, stage)
+		case parts[2] == "log":
+			api.serveLog(w, req, parts[1])
+		case parts[2] == "files":
+			name := ""
+			if len(parts) == 4 {
+				name = parts[3]
+			}
+			api.serveFile(w, req, parts[1], name)
+		default:
+			http.NotFound(w, req)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Returns a copy of the state of a stage, or nil if there is no such stage.
+func (api *runAPI) stage(name string) *stageState {
+	api.state.mu.Lock()
+	defer api.state.mu.Unlock()
+	for _, stage := range api.state.Stages {
+		if stage.Name == name {
+			s := *stage
+			return &s
+		}
+	}
+	return nil
+}
+
+func (api *runAPI) serveStages(w http.ResponseWriter, req *http.Request) {
+	api.state.mu.Lock()
+	stages := make([]stageState, len(api.state.Stages))
+	for i, stage := range api.state.Stages {
+		stages[i] = *stage
+	}
+	api.state.mu.Unlock()
+
+	writeJSON(w, stages)
+}
+
+// Returns the output directory of a stage. Parallel stages share the output
+// directory of the original stage.
+func (api *runAPI) stagePath(stage string) string {
+	return filepath.Join(api.hostpath, strings.Split(stage, "_")[0])
+}
+
+// The most lines of a log that can be asked for with ?tail=N. Larger values
+// get this many lines.
+const maxTailLines = 10000
+
+func (api *runAPI) serveLog(w http.ResponseWriter, req *http.Request, stage string) {
+	filename, err := api.resolve(stage, "walrus.log")
+	if err != nil {
+		http.Error(w, "No logs for stage "+stage, http.StatusNotFound)
+		return
+	}
+
+	tail := req.URL.Query().Get("tail")
+	if tail == "" {
+		serveFile(w, req, filename, "text/plain; charset=utf-8")
+		return
+	}
+
+	n, err := strconv.Atoi(tail)
+	if err != nil || n < 0 {
+		http.Error(w, "Invalid tail "+tail, http.StatusBadRequest)
+		return
+	}
+	if n > maxTailLines {
+		n = maxTailLines
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		http.Error(w, "No logs for stage "+stage, http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if n == 0 {
+			continue
+		}
+		if len(lines) == n {
+			lines = lines[1:]
+		}
+		lines = append(lines, scanner.Text())
+	}
+	if scanner.Err() != nil {
+		http.Error(w, "Could not read logs for stage "+stage, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		io.WriteString(w, line+"\n")
+	}
+}
+
+// Returns the path of a file in the output directory of a stage with all
+// symbolic links resolved. Stages can create links to anywhere, so files that
+// resolve to somewhere outside the output directory are not served.
+func (api *runAPI) resolve(stage, name string) (string, error) {
+	dir, err := filepath.EvalSymlinks(api.stagePath(stage))
+	if err != nil {
+		return "", err
+	}
+
+	filename, err := filepath.EvalSymlinks(filepath.Join(dir,
+		filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(dir, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(name + " is outside the output directory of stage " + stage)
+	}
+	return filename, nil
+}
+
+// Lists a directory, or downloads a file, in the output directory of a stage.
+// Paths are resolved within the output directory, so they can't refer to
+// files outside it.
+func (api *runAPI) serveFile(w http.ResponseWriter, req *http.Request, stage, name string) {
+	filename, err := api.resolve(stage, name)
+	if err != nil {
+		http.Error(w, "No such file "+name, http.StatusNotFound)
+		return
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		http.Error(w, "No such file "+name, http.StatusNotFound)
+		return
+	}
+
+	if !info.IsDir() {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+
+			strings.Replace(info.Name(), "\"", "", -1)+"\"")
+		serveFile(w, req, filename, "")
+		return
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		http.Error(w, "Could not open directory "+name, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(w, "Could not list directory "+name, http.StatusInternalServerError)
+		return
+	}
+
+	files := []fileInfo{}
+	for _, entry := range entries {
+		files = append(files, fileInfo{
+			Name:    entry.Name(),
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+			Dir:     entry.IsDir(),
+		})
+	}
+	writeJSON(w, files)
+}
+
+// Serves the description of the pipeline that walrus writes to the output
+// directory once the pipeline has completed.
+func (api *runAPI) serveDescription(w http.ResponseWriter, req *http.Request) {
+	if _, err := os.Stat(api.description); err != nil {
+		http.Error(w, "The pipeline has not completed", http.StatusNotFound)
+		return
+	}
+	serveFile(w, req, api.description, "")
+}
+
+// Serves a file with support for Range requests.
+func serveFile(w http.ResponseWriter, req *http.Request, filename, contentType string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		http.Error(w, "No such file "+filepath.Base(filename), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Could not read "+filepath.Base(filename), http.StatusInternalServerError)
+		return
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, req, info.Name(), info.ModTime(), f)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
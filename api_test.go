@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+func testAPI(t *testing.T) (*runAPI, string) {
+	t.Helper()
+
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(hostpath) })
+
+	err = os.Mkdir(filepath.Join(hostpath, "a"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{{Name: "a"}}}
+	state, err := newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &runAPI{state: state, hostpath: hostpath}, hostpath
+}
+
+func get(t *testing.T, api *runAPI, url string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	return w
+}
+
+func TestAPIFilesDoNotFollowLinksOutside(t *testing.T) {
+	api, hostpath := testAPI(t)
+
+	secret := filepath.Join(hostpath, "secret")
+	err := ioutil.WriteFile(secret, []byte("secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(hostpath, "a", "out"), []byte("out"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stage := filepath.Join(hostpath, "a")
+	links := map[string]string{
+		"secret":   secret,
+		"root":     "/",
+		"relative": "../secret",
+		"inside":   "out",
+	}
+	for name, target := range links {
+		err = os.Symlink(target, filepath.Join(stage, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"secret", "root/etc/passwd", "relative", "../secret"} {
+		w := get(t, api, "/stages/a/files/"+name)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d %q", name, w.Code, w.Body.String())
+		}
+	}
+
+	w := get(t, api, "/stages/a/files/inside")
+	if w.Code != http.StatusOK || w.Body.String() != "out" {
+		t.Errorf("Link within the output directory: %d %q", w.Code, w.Body.String())
+	}
+
+	// The log is not served if it links to somewhere else either.
+	err = os.Symlink(secret, filepath.Join(stage, "walrus.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"/stages/a/log", "/stages/a/log?tail=1"} {
+		w := get(t, api, url)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d %q", url, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAPILogTail(t *testing.T) {
+	api, hostpath := testAPI(t)
+
+	var log strings.Builder
+	for i := 0; i < maxTailLines+10; i++ {
+		log.WriteString(strconv.Itoa(i) + "\n")
+	}
+	err := ioutil.WriteFile(filepath.Join(hostpath, "a", "walrus.log"),
+		[]byte(log.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := get(t, api, "/stages/a/log?tail=2")
+	if got := w.Body.String(); got != "10008\n10009\n" {
+		t.Errorf("The last 2 lines are %q", got)
+	}
+
+	w = get(t, api, "/stages/a/log?tail=9223372036854775807")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET with a large tail: %d", w.Code)
+	}
+	if n := strings.Count(w.Body.String(), "\n"); n != maxTailLines {
+		t.Errorf("Got %d lines with a large tail", n)
+	}
+}
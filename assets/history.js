@@ -0,0 +1,166 @@
+// Lists the pipeline runs with the runtime and version of every stage, and
+// compares the parameters and output files of two selected runs.
+(function() {
+    var selected = [];
+
+    function el(name, text, className) {
+        var e = document.createElement(name);
+        if (text !== undefined && text !== null) {
+            e.textContent = text;
+        }
+        if (className) {
+            e.className = className;
+        }
+        return e;
+    }
+
+    function row(cells, tag) {
+        var tr = el('tr');
+        cells.forEach(function(cell) {
+            if (cell instanceof Node) {
+                var td = el(tag || 'td');
+                td.appendChild(cell);
+                tr.appendChild(td);
+            } else {
+                tr.appendChild(el(tag || 'td', cell));
+            }
+        });
+        return tr;
+    }
+
+    function seconds(ns) {
+        return (ns / 1e9).toFixed(1) + 's';
+    }
+
+    function runtime(run) {
+        if (!run.End || run.End.indexOf('0001-') == 0) {
+            return '';
+        }
+        return seconds((Date.parse(run.End) - Date.parse(run.Start)) * 1e6);
+    }
+
+    function get(url, done) {
+        var req = new XMLHttpRequest();
+        req.open('GET', url);
+        req.onload = function() {
+            if (req.status != 200) {
+                document.getElementById('diff').textContent = req.responseText;
+                return;
+            }
+            done(JSON.parse(req.responseText));
+        };
+        req.send();
+    }
+
+    // Keeps the two most recently selected runs selected.
+    function select(id, checkbox) {
+        selected = selected.filter(function(s) { return s.id != id; });
+        if (checkbox.checked) {
+            selected.push({id: id, checkbox: checkbox});
+            if (selected.length > 2) {
+                selected.shift().checkbox.checked = false;
+            }
+        }
+        document.getElementById('compare').disabled = selected.length != 2;
+    }
+
+    // Shows the runs as columns and the stages as rows.
+    function showHistory(history) {
+        var table = el('table');
+
+        var header = [el('span', 'Stage')];
+        history.Runs.forEach(function(run) {
+            var cell = el('div');
+            var checkbox = el('input');
+            checkbox.type = 'checkbox';
+            checkbox.disabled = !run.Recorded;
+            checkbox.title = run.Recorded ? 'Compare' : 'Not recorded, can not be compared';
+            checkbox.addEventListener('change', function() { select(run.ID, checkbox); });
+            cell.appendChild(checkbox);
+
+            var id = el(run.Link ? 'a' : 'span', run.ID);
+            if (run.Link) {
+                id.href = run.Link;
+            }
+            cell.appendChild(id);
+            cell.appendChild(el('div', run.Pipeline));
+            cell.appendChild(el('div', run.Status + ' ' + runtime(run), 'status-' + run.Status));
+            if (run.Version) {
+                cell.appendChild(el('div', run.Version.substring(0, 8), 'version'));
+            }
+            header.push(cell);
+        });
+        table.appendChild(row(header, 'th'));
+
+        history.Stages.forEach(function(stage) {
+            var cells = [stage.Name];
+            history.Runs.forEach(function(run) {
+                var s = stage.Runs[run.ID];
+                if (!s) {
+                    cells.push('');
+                    return;
+                }
+                var cell = el('div');
+                var text = s.Cached ? 'cached' : s.Status;
+                if (s.Runtime > 0) {
+                    text += ' ' + seconds(s.Runtime);
+                }
+                cell.appendChild(el('div', text, 'status-' + s.Status));
+                if (s.Version) {
+                    cell.appendChild(el('div', s.Version.substring(0, 8), 'version'));
+                }
+                if (s.Image) {
+                    cell.title = s.Image;
+                }
+                cells.push(cell);
+            });
+            table.appendChild(row(cells));
+        });
+
+        var container = document.getElementById('history');
+        container.innerHTML = '';
+        container.appendChild(table);
+    }
+
+    function size(n) {
+        return n === null || n === undefined ? '' : n + ' bytes';
+    }
+
+    // Shows the differences between two runs side by side.
+    function showDiff(diff) {
+        var container = document.getElementById('diff');
+        container.innerHTML = '';
+
+        container.appendChild(el('h3', 'Parameters'));
+        if (diff.Parameters.length == 0) {
+            container.appendChild(el('p', 'The runs have the same parameters.'));
+        } else {
+            var params = el('table');
+            params.appendChild(row(['Stage', 'Parameter', diff.A, diff.B], 'th'));
+            diff.Parameters.forEach(function(p) {
+                params.appendChild(row([p.Stage, p.Parameter, p.A, p.B]));
+            });
+            container.appendChild(params);
+        }
+
+        container.appendChild(el('h3', 'Output files'));
+        var outputs = el('table');
+        outputs.appendChild(row(['Stage', 'File', diff.A, diff.B], 'th'));
+        diff.Outputs.forEach(function(o) {
+            var tr = row([o.Stage, o.Path, size(o.A), size(o.B)]);
+            if (o.Changed) {
+                tr.childNodes[2].className = 'changed';
+                tr.childNodes[3].className = 'changed';
+            }
+            outputs.appendChild(tr);
+        });
+        container.appendChild(outputs);
+    }
+
+    document.getElementById('compare').addEventListener('click', function() {
+        get('api/history/diff?a=' + encodeURIComponent(selected[0].id) +
+            '&b=' + encodeURIComponent(selected[1].id), showDiff);
+    });
+
+    get('api/history', showHistory);
+})();
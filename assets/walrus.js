@@ -0,0 +1,342 @@
+// Draws the pipeline as a graph and colours the stages by the live state of
+// the pipeline run. The graph is drawn as SVG without any libraries, with
+// stages in layers from left to right, where every stage is placed to the
+// right of its inputs.
+(function() {
+    var svgNS = 'http://www.w3.org/2000/svg';
+
+    var nodeWidth = 180;
+    var nodeHeight = 44;
+    var layerSpacing = 80;
+    var nodeSpacing = 30;
+    var margin = 20;
+    var top = 60;
+
+    var colors = {
+        queued: '#9e9e9e',
+        pulling: '#7e57c2',
+        running: '#1e88e5',
+        cached: '#26a69a',
+        succeeded: '#43a047',
+        failed: '#e53935'
+    };
+
+    // Stages by name: {id, data, inputs, state}, and the layer, position and
+    // SVG elements of the stage.
+    var nodes = {};
+    var run = null;
+
+    // The graph, with a function that shows the state of a stage.
+    var graph = null;
+
+    function el(name, attrs) {
+        var e = document.createElementNS(svgNS, name);
+        for (var key in attrs) {
+            e.setAttribute(key, attrs[key]);
+        }
+        return e;
+    }
+
+    // Assigns every stage to the layer after its deepest input.
+    function layer(node, visiting) {
+        if (node.layer !== undefined) {
+            return node.layer;
+        }
+        if (visiting[node.id]) {
+            return 0;
+        }
+        visiting[node.id] = true;
+        var l = 0;
+        node.inputs.forEach(function(input) {
+            if (nodes[input]) {
+                l = Math.max(l, layer(nodes[input], visiting) + 1);
+            }
+        });
+        node.layer = l;
+        return l;
+    }
+
+    // Orders the stages in every layer by the average position of their
+    // inputs to reduce the number of crossing edges, and positions them.
+    function position() {
+        var layers = [];
+        Object.keys(nodes).forEach(function(id) {
+            var l = layer(nodes[id], {});
+            layers[l] = layers[l] || [];
+            layers[l].push(nodes[id]);
+        });
+
+        layers.forEach(function(stages, l) {
+            if (l > 0) {
+                stages.forEach(function(node) {
+                    var sum = 0;
+                    node.inputs.forEach(function(input) {
+                        sum += nodes[input] ? nodes[input].index : 0;
+                    });
+                    node.weight = node.inputs.length ? sum / node.inputs.length : 0;
+                });
+                stages.sort(function(a, b) { return a.weight - b.weight; });
+            }
+            stages.forEach(function(node, i) {
+                node.index = i;
+                node.x = margin + l * (nodeWidth + layerSpacing);
+                node.y = top + i * (nodeHeight + nodeSpacing);
+            });
+        });
+
+        var height = 0;
+        layers.forEach(function(stages) {
+            height = Math.max(height, stages.length);
+        });
+        return {
+            width: 2 * margin + layers.length * (nodeWidth + layerSpacing),
+            height: top + margin + height * (nodeHeight + nodeSpacing)
+        };
+    }
+
+    // Draws the graph as SVG.
+    function drawSVG() {
+        var size = position();
+        var svg = el('svg', {width: size.width, height: size.height});
+
+        var defs = el('defs', {});
+        var marker = el('marker', {id: 'arrow', viewBox: '0 0 10 10',
+            refX: 10, refY: 5, markerWidth: 6, markerHeight: 6,
+            orient: 'auto'});
+        marker.appendChild(el('path', {d: 'M 0 0 L 10 5 L 0 10 z'}));
+        defs.appendChild(marker);
+        svg.appendChild(defs);
+
+        Object.keys(nodes).forEach(function(id) {
+            var node = nodes[id];
+            node.inputs.forEach(function(input) {
+                var source = nodes[input];
+                if (!source) {
+                    return;
+                }
+                var x1 = source.x + nodeWidth, y1 = source.y + nodeHeight / 2;
+                var x2 = node.x, y2 = node.y + nodeHeight / 2;
+                var mid = (x1 + x2) / 2;
+                svg.appendChild(el('path', {'class': 'edge',
+                    d: 'M ' + x1 + ' ' + y1 + ' C ' + mid + ' ' + y1 + ' ' +
+                        mid + ' ' + y2 + ' ' + x2 + ' ' + y2,
+                    'marker-end': 'url(#arrow)'}));
+            });
+        });
+
+        Object.keys(nodes).forEach(function(id) {
+            var node = nodes[id];
+            var g = el('g', {'class': 'node',
+                transform: 'translate(' + node.x + ',' + node.y + ')'});
+            node.rect = el('rect', {width: nodeWidth, height: nodeHeight,
+                rx: 6, ry: 6});
+            node.name = el('text', {x: 10, y: 18});
+            node.name.textContent = node.id;
+            node.label = el('text', {x: 10, y: 35});
+            g.appendChild(node.rect);
+            g.appendChild(node.name);
+            g.appendChild(node.label);
+            g.addEventListener('mousemove', function(e) { showTooltip(node, e); });
+            g.addEventListener('mouseleave', hideTooltip);
+            g.addEventListener('click', function() { showDetails(node.id); });
+            svg.appendChild(g);
+        });
+
+        document.getElementById('graph').appendChild(svg);
+
+        return {
+            show: function(stage, color, label) {
+                var node = nodes[stage.Name];
+                node.rect.style.fill = color;
+                node.label.textContent = label;
+            }
+        };
+    }
+
+    // Returns the tooltip content of a stage: its configuration, status and
+    // any error.
+    function tooltipData(node) {
+        var data = {};
+        for (var key in node.data) {
+            data[key] = node.data[key];
+        }
+        if (node.state) {
+            data.Status = node.state.Status;
+            data.Error = node.state.Error;
+        }
+        return data;
+    }
+
+    function present(v) {
+        return v !== null && v !== undefined && v !== '';
+    }
+
+    function showTooltip(node, e) {
+        var tooltip = document.getElementById('tooltip');
+        tooltip.innerHTML = '';
+
+        var data = tooltipData(node);
+        for (var key in data) {
+            var values = [].concat(data[key]).filter(present);
+            if (values.length == 0) {
+                continue;
+            }
+            var title = document.createElement('b');
+            title.textContent = key + ':';
+            tooltip.appendChild(title);
+            values.forEach(function(v) {
+                tooltip.appendChild(document.createElement('br'));
+                tooltip.appendChild(document.createTextNode(v));
+            });
+            tooltip.appendChild(document.createElement('br'));
+        }
+
+        tooltip.style.left = (e.pageX + 12) + 'px';
+        tooltip.style.top = (e.pageY + 12) + 'px';
+        tooltip.style.display = 'block';
+    }
+
+    function hideTooltip() {
+        document.getElementById('tooltip').style.display = 'none';
+    }
+
+    function encodePath(path) {
+        return path.split('/').map(encodeURIComponent).join('/');
+    }
+
+    function stageURL(stage) {
+        return 'api/stages/' + encodeURIComponent(stage);
+    }
+
+    // Shows links to the log of a stage and lists the files in its output
+    // directory.
+    function showDetails(stage) {
+        document.getElementById('details-stage').textContent = stage;
+        document.getElementById('details-log').href = stageURL(stage) + '/log';
+        document.getElementById('details-tail').href = stageURL(stage) + '/log?tail=100';
+        document.getElementById('details').style.display = 'block';
+        listFiles(stage, '');
+    }
+
+    // Lists a directory in the output directory of a stage. Directories
+    // are opened in the panel and files are downloaded.
+    function listFiles(stage, dir) {
+        var list = document.getElementById('details-files');
+        document.getElementById('details-path').textContent = '/' + dir;
+
+        var req = new XMLHttpRequest();
+        req.open('GET', stageURL(stage) + '/files/' + encodePath(dir));
+        req.onload = function() {
+            list.innerHTML = '';
+            if (req.status != 200) {
+                list.textContent = req.responseText;
+                return;
+            }
+
+            var files = JSON.parse(req.responseText);
+            if (dir != '') {
+                files.unshift({Name: '..', Dir: true});
+            }
+            files.forEach(function(file) {
+                var item = document.createElement('li');
+                var link = document.createElement('a');
+                link.textContent = file.Name + (file.Dir ? '/' : '');
+
+                var path = dir + file.Name;
+                if (file.Name == '..') {
+                    path = dir.split('/').slice(0, -2).join('/');
+                    path = path ? path + '/' : '';
+                }
+
+                if (file.Dir) {
+                    link.href = '#';
+                    link.addEventListener('click', function(e) {
+                        e.preventDefault();
+                        listFiles(stage, file.Name == '..' ? path : path + '/');
+                    });
+                } else {
+                    link.href = stageURL(stage) + '/files/' + encodePath(path);
+                }
+                item.appendChild(link);
+                if (!file.Dir) {
+                    item.appendChild(document.createTextNode(' (' + file.Size + ' bytes)'));
+                }
+                list.appendChild(item);
+            });
+        };
+        req.send();
+    }
+
+    document.getElementById('details-close').addEventListener('click', function(e) {
+        e.preventDefault();
+        document.getElementById('details').style.display = 'none';
+    });
+
+    // Returns the runtime of a stage, counting up while it is running.
+    function runtime(stage) {
+        if (stage.Status == 'running') {
+            return Math.round((Date.now() - Date.parse(stage.Start)) / 1000) + 's';
+        }
+        if (stage.Runtime > 0) {
+            return Math.round(stage.Runtime / 1e9) + 's';
+        }
+        return '';
+    }
+
+    // Updates stage colours, labels and failure messages from the run state.
+    function update() {
+        if (run == null) {
+            return;
+        }
+        document.getElementById('pipeline').textContent =
+            run.Pipeline + ' (' + run.ID + '): ' + run.Status;
+
+        var errors = '';
+        run.Stages.forEach(function(stage) {
+            var node = nodes[stage.Name];
+            if (!node || !graph) {
+                return;
+            }
+            node.state = stage;
+            graph.show(stage, colors[stage.Status],
+                stage.Status + ' ' + runtime(stage));
+            if (stage.Error) {
+                errors += stage.Name + ': ' + stage.Error + '\n';
+            }
+        });
+        document.getElementById('errors').textContent = errors;
+    }
+
+    // The run state is pushed by the server every time it changes.
+    function follow() {
+        var source = new EventSource('status');
+        source.onmessage = function(e) {
+            run = JSON.parse(e.data);
+            update();
+            if (run.Status != 'running') {
+                source.close();
+            }
+        };
+    }
+
+    var req = new XMLHttpRequest();
+    req.open('GET', 'graph');
+    req.onload = function() {
+        var elements = JSON.parse(req.responseText).elements || [];
+        elements.forEach(function(e) {
+            if (e.group == 'nodes') {
+                nodes[e.data.id] = {id: e.data.id, data: e.data.data || {},
+                    inputs: []};
+            }
+        });
+        elements.forEach(function(e) {
+            if (e.group == 'edges' && nodes[e.data.target]) {
+                nodes[e.data.target].inputs.push(e.data.source);
+            }
+        });
+        graph = drawSVG();
+        follow();
+        setInterval(update, 1000);
+    };
+    req.send();
+})();
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles of users of the web servers. Viewers can look at pipeline runs, and
+// operators can also start, cancel and re-run them.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+)
+
+// Users and API tokens allowed to use the web servers. Users log in with HTTP
+// basic authentication, and their passwords are bcrypt hashes, e.g. from
+// `htpasswd -nB NAME`. API tokens are sent in an `Authorization: Bearer TOKEN`
+// header.
+type authConfig struct {
+	Users  []authUser
+	Tokens []authToken
+}
+
+type authUser struct {
+	Name     string
+	Password string
+	Role     string
+}
+
+type authToken struct {
+	Name  string
+	Token string
+	Role  string
+}
+
+// Authenticates requests to a web server and checks that the user's role
+// allows the request. Only operators may make requests that change anything,
+// i.e. requests other than GET and HEAD.
+type authenticator struct {
+	users  map[string]authUser
+	tokens []authToken
+
+	// Checking a bcrypt hash is slow by design, so passwords that have been
+	// checked are remembered by their SHA-256 hash.
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// Reads an authentication configuration file.
+func newAuthenticator(filename string) (*authenticator, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read authentication configuration")
+	}
+
+	config := authConfig{}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse authentication configuration")
+	}
+
+	if len(config.Users) == 0 && len(config.Tokens) == 0 {
+		return nil, errors.New("No users or tokens in authentication configuration " + filename)
+	}
+
+	a := &authenticator{
+		users:    make(map[string]authUser),
+		verified: make(map[string][sha256.Size]byte),
+	}
+
+	for _, user := range config.Users {
+		err := checkRole(user.Role)
+		if err != nil {
+			return nil, errors.Wrap(err, "User "+user.Name)
+		}
+		_, err = bcrypt.Cost([]byte(user.Password))
+		if err != nil {
+			return nil, errors.New("The password of user " + user.Name +
+				" must be a bcrypt hash")
+		}
+		a.users[user.Name] = user
+	}
+
+	for _, token := range config.Tokens {
+		err := checkRole(token.Role)
+		if err != nil {
+			return nil, errors.Wrap(err, "Token "+token.Name)
+		}
+		if token.Token == "" {
+			return nil, errors.New("Token " + token.Name + " is empty")
+		}
+		a.tokens = append(a.tokens, token)
+	}
+
+	return a, nil
+}
+
+func checkRole(role string) error {
+	if role != roleViewer && role != roleOperator {
+		return errors.New("Unknown role " + role + ", must be " + roleViewer +
+			" or " + roleOperator)
+	}
+	return nil
+}
+
+// Returns the role of the user or token the request is authenticated as, or
+// the empty string if it is not authenticated.
+func (a *authenticator) role(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := []byte(strings.TrimPrefix(header, "Bearer "))
+		role := ""
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+				role = t.Role
+			}
+		}
+		return role
+	}
+
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return ""
+	}
+	user, ok := a.users[name]
+	if !ok {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	a.mu.Lock()
+	verified, ok := a.verified[name]
+	a.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(sum[:], verified[:]) == 1 {
+		return user.Role
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return ""
+	}
+
+	a.mu.Lock()
+	a.verified[name] = sum
+	a.mu.Unlock()
+	return user.Role
+}
+
+// Wraps a handler so that it only serves authenticated requests that the role
+// of the user allows.
+func (a *authenticator) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		role := a.role(req)
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="walrus"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if role != roleOperator && req.Method != http.MethodGet &&
+			req.Method != http.MethodHead {
+			http.Error(w, "Only operators can do this", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Settings of the walrus web servers, set from the command line.
+type webConfig struct {
+	CertFile string
+	KeyFile  string
+	AuthFile string
+}
+
+// Adds the flags for TLS and authentication of web servers to a command.
+func webFlags(cmd *command) *webConfig {
+	config := &webConfig{}
+	cmd.flags.StringVar(&config.CertFile, "tls-cert", "",
+		"serve the web server over HTTPS with this certificate file")
+	cmd.flags.StringVar(&config.KeyFile, "tls-key", "",
+		"private key file of the certificate given with -tls-cert")
+	cmd.flags.StringVar(&config.AuthFile, "auth", "",
+		"configuration file with the users and API tokens allowed to use the\n"+
+			"web server and their roles (default is no authentication)")
+	return config
+}
+
+// A web server with optional TLS and authentication.
+type webServer struct {
+	certFile string
+	keyFile  string
+	auth     *authenticator
+}
+
+// Checks the web server settings and reads the authentication configuration,
+// so that mistakes are reported before any pipeline runs.
+func newWebServer(config webConfig) (*webServer, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("Serving over HTTPS requires both -tls-cert and -tls-key")
+	}
+
+	s := &webServer{certFile: config.CertFile, keyFile: config.KeyFile}
+	if config.AuthFile != "" {
+		auth, err := newAuthenticator(config.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth
+	}
+	return s, nil
+}
+
+// Returns the URL of the web server listening on addr.
+func (s *webServer) url(addr string) string {
+	scheme := "http://"
+	if s.certFile != "" {
+		scheme = "https://"
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return scheme + addr
+}
+
+// Serves the handler on addr.
+func (s *webServer) listenAndServe(addr string, h http.Handler) error {
+	if s.auth != nil {
+		h = s.auth.wrap(h)
+	}
+	if s.certFile != "" {
+		return http.ListenAndServeTLS(addr, s.certFile, s.keyFile, h)
+	}
+	return http.ListenAndServe(addr, h)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Writes an authentication configuration with a viewer and an operator user,
+// and a token for each role, and returns an authenticator for it.
+func testAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+
+	hash := func(password string) string {
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	config := authConfig{
+		Users: []authUser{
+			{Name: "viewer", Password: hash("viewer-password"), Role: roleViewer},
+			{Name: "operator", Password: hash("operator-password"), Role: roleOperator},
+		},
+		Tokens: []authToken{
+			{Name: "dashboard", Token: "viewer-token", Role: roleViewer},
+			{Name: "ci", Token: "operator-token", Role: roleOperator},
+		},
+	}
+
+	a, err := newAuthenticator(writeAuthConfig(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func writeAuthConfig(t *testing.T, config authConfig) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "walrus-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "auth.json")
+	err = ioutil.WriteFile(filename, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// Credentials of a request. Users log in with basic authentication and
+// tokens are sent as bearer tokens.
+type credentials struct {
+	user, password, token string
+}
+
+func (c credentials) set(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+}
+
+func TestAuthRoles(t *testing.T) {
+	a := testAuthenticator(t)
+
+	served := 0
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served++
+	}))
+
+	viewers := []credentials{
+		{user: "viewer", password: "viewer-password"},
+		{token: "viewer-token"},
+	}
+	operators := []credentials{
+		{user: "operator", password: "operator-password"},
+		{token: "operator-token"},
+	}
+	unauthenticated := []credentials{
+		{},
+		{user: "viewer", password: "operator-password"},
+		{user: "viewer", password: ""},
+		{user: "nobody", password: "viewer-password"},
+		{token: "viewer-token "},
+		{token: "operator"},
+		{token: ""},
+	}
+
+	requests := []struct {
+		method, url string
+	}{
+		{http.MethodGet, "/api/runs"},
+		{http.MethodHead, "/api/runs"},
+		{http.MethodPost, "/api/runs"},
+		{http.MethodPost, "/api/runs/1/rerun"},
+		{http.MethodPost, "/api/runs/1/cancel"},
+	}
+
+	check := func(c credentials, method, url string, code int) {
+		t.Helper()
+		req := httptest.NewRequest(method, url, nil)
+		c.set(req)
+		w := httptest.NewRecorder()
+		before := served
+		h.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("%s %s as %+v: %d, not %d", method, url, c, w.Code, code)
+		}
+		if (code == http.StatusOK) != (served > before) {
+			t.Errorf("%s %s as %+v: handler called %d times", method, url, c,
+				served-before)
+		}
+		if code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s as %+v: no WWW-Authenticate header", method, url, c)
+		}
+	}
+
+	// Checking the same password twice uses the remembered hash the second
+	// time, which must give the same result.
+	for i := 0; i < 2; i++ {
+		for _, r := range requests {
+			readOnly := r.method == http.MethodGet || r.method == http.MethodHead
+			for _, c := range viewers {
+				if readOnly {
+					check(c, r.method, r.url, http.StatusOK)
+				} else {
+					check(c, r.method, r.url, http.StatusForbidden)
+				}
+			}
+			for _, c := range operators {
+				check(c, r.method, r.url, http.StatusOK)
+			}
+			for _, c := range unauthenticated {
+				check(c, r.method, r.url, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+func TestAuthServer(t *testing.T) {
+	a := testAuthenticator(t)
+	s := testServer(t, pipeline.Policy{}, nil, nil)
+	h := a.wrap(s.handler())
+
+	submit := func(c credentials) int {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/api/runs",
+			strings.NewReader(testDescription))
+		req.Header.Set("Content-Type", "application/json")
+		c.set(req)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := submit(credentials{}); code != http.StatusUnauthorized {
+		t.Errorf("Submit without credentials: %d", code)
+	}
+	if code := submit(credentials{user: "viewer", password: "viewer-password"}); code != http.StatusForbidden {
+		t.Errorf("Submit as viewer: %d", code)
+	}
+	if len(s.runs) != 0 {
+		t.Fatal("A run was started without an operator")
+	}
+	if code := submit(credentials{user: "operator", password: "operator-password"}); code != http.StatusCreated {
+		t.Errorf("Submit as operator: %d", code)
+	}
+}
+
+func TestAuthConfig(t *testing.T) {
+	configs := map[string]authConfig{
+		"no users": {},
+		"plain text password": {Users: []authUser{
+			{Name: "a", Password: "secret", Role: roleViewer}}},
+		"unknown role": {Tokens: []authToken{
+			{Name: "a", Token: "secret", Role: "admin"}}},
+		"empty token": {Tokens: []authToken{
+			{Name: "a", Role: roleOperator}}},
+	}
+
+	for name, config := range configs {
+		_, err := newAuthenticator(writeAuthConfig(t, config))
+		if err == nil {
+			t.Errorf("Configuration with %s was accepted", name)
+		}
+	}
+}
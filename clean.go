@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func cleanCommand() *command {
+	cmd := newCommand("clean", "[STAGE...]",
+		"Remove containers, output and cache entries left behind by pipeline runs.")
+	cmd.description = "Removes the containers and Kubernetes jobs walrus created for the output\n" +
+		"directory. With -outputs and -cache the stage output directories and the\n" +
+		"cache entries kept by the local and slurm executors are removed too. Only\n" +
+		"the given stages are cleaned, or with -keep everything not referenced by\n" +
+		"the last N runs. Running containers and jobs are left alone unless -force\n" +
+		"is given."
+
+	outputDir := outputFlag(cmd)
+	outputs := cmd.flags.Bool("outputs", false, "remove stage output directories")
+	cache := cmd.flags.Bool("cache", false, "remove cache entries")
+	keep := cmd.flags.Int("keep", 0,
+		"keep everything referenced by the last N runs and remove the rest,\n"+
+			"including the state and history records of older runs")
+	dryRun := cmd.flags.Bool("dry-run", false, "list what would be removed without removing it")
+	force := cmd.flags.Bool("force", false, "also remove running containers and active jobs")
+	runtime := cmd.flags.String("runtime", runtimeDocker,
+		"container runtime the stages run with (docker or podman)")
+	host := cmd.flags.String("host", "", "address of the container runtime API")
+	kubeconfig := cmd.flags.String("kubeconfig", "",
+		"kubeconfig file of the cluster runs with the kubernetes executor used\n"+
+			"(default $KUBECONFIG, ~/.kube/config or in-cluster)")
+	namespace := cmd.flags.String("namespace", "default",
+		"namespace of the Kubernetes jobs")
+	claimMount := cmd.flags.String("claim-mount", "",
+		"where the persistent volume claim of the Kubernetes jobs is mounted on\n"+
+			"this host, if it is, to remove their output with -outputs")
+
+	cmd.run = func(args []string) error {
+		if len(args) > 0 && *keep > 0 {
+			return errors.New("clean takes either a list of stages or -keep, not both")
+		}
+
+		hostpath, err := filepath.Abs(*outputDir)
+		if err != nil {
+			return errors.Wrap(err, "Check hostpath")
+		}
+
+		// Don't remove anything from under a pipeline that is running.
+		if !*dryRun {
+			lock, err := lockOutput(hostpath)
+			if err != nil {
+				return err
+			}
+			defer lock.unlock()
+		}
+
+		c := &cleaner{hostpath: hostpath, dryRun: *dryRun, force: *force}
+
+		executors, err := runExecutors(hostpath)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(args) > 0:
+			c.selected = func(stage string) bool {
+				for _, arg := range args {
+					if stage == arg || strings.HasPrefix(stage, arg+pipeline.ParallelIdentifier) {
+						return true
+					}
+				}
+				return false
+			}
+		case *keep > 0:
+			kept, oldRuns, err := keptRuns(hostpath, *keep)
+			if err != nil {
+				return err
+			}
+			c.kept = kept
+			// Parallel stages share the output directory of the stage
+			// they were split from.
+			c.selected = func(stage string) bool {
+				return !kept.outputs[strings.Split(stage, "_")[0]]
+			}
+			c.oldRuns = oldRuns
+		default:
+			c.selected = func(string) bool { return true }
+		}
+
+		if executors[executorDocker] {
+			docker, err := newClient(*runtime, *host)
+			if err != nil {
+				return err
+			}
+			err = c.removeContainers(docker)
+			if err != nil {
+				return errors.Wrap(err, "Could not remove containers")
+			}
+		}
+
+		if executors[executorKubernetes] {
+			cluster, err := newKubernetesClient(*kubeconfig)
+			if err != nil {
+				return err
+			}
+			volume := ""
+			if *outputs {
+				volume = *claimMount
+			}
+			err = c.removeJobs(cluster, *namespace, volume)
+			if err != nil {
+				return errors.Wrap(err, "Could not remove Kubernetes jobs")
+			}
+		}
+
+		if *outputs {
+			err = c.removeOutputs()
+			if err != nil {
+				return err
+			}
+		}
+
+		if *cache {
+			for _, executor := range []string{executorLocal, executorSlurm} {
+				err = c.removeCacheEntries(executor)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// The runs are forgotten once everything they left behind has
+		// been removed.
+		for _, id := range c.oldRuns {
+			err = c.remove("run state", filepath.Join(runsPath(hostpath), id+".json"))
+			if err != nil {
+				return err
+			}
+			err = c.removeRecord(id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return cmd
+}
+
+// Removes walrus containers, jobs, files and directories for selected stages.
+// With -keep containers and jobs are selected by the run they belong to
+// instead, see removable.
+type cleaner struct {
+	hostpath string
+	dryRun   bool
+	force    bool
+	selected func(stage string) bool
+	kept     *runs
+	oldRuns  []string
+}
+
+// The runs that -keep keeps, the stages they ran by pipeline and the output
+// directories of those stages.
+type runs struct {
+	ids     map[string]bool
+	stages  map[string]bool
+	outputs map[string]bool
+}
+
+// Returns the key of a stage of a pipeline in runs.stages.
+func pipelineStage(pipeline, stage string) string {
+	return pipeline + "/" + stage
+}
+
+// Returns true if a container or job of a stage should be removed. With -keep
+// the containers and jobs of the kept runs are kept, along with the most
+// recent one of every stage the kept runs ran, since that is the one a cached
+// stage uses.
+func (c *cleaner) removable(kept *runs, pipeline, stage, run string, latest bool) bool {
+	if kept == nil {
+		return c.selected(stage)
+	}
+	if kept.ids[run] {
+		return false
+	}
+	return !latest || !kept.stages[pipelineStage(pipeline, stage)]
+}
+
+// Removes a file or directory, or only prints what would be removed in a dry
+// run.
+func (c *cleaner) remove(what, path string) error {
+	if c.dryRun {
+		fmt.Println("Would remove", what, path)
+		return nil
+	}
+	fmt.Println("Removing", what, path)
+	return os.RemoveAll(path)
+}
+
+// Removes the history record of a run, if it has one.
+func (c *cleaner) removeRecord(id string) error {
+	filename := filepath.Join(historyPath(c.hostpath), id+".json")
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	return c.remove("run record", filename)
+}
+
+// Removes the containers of selected stages that walrus created for the
+// output directory.
+func (c *cleaner) removeContainers(docker *client.Client) error {
+	args := filters.NewArgs()
+	args.Add("label", labelOutput+"="+c.hostpath)
+
+	containers, err := docker.ContainerList(context.Background(),
+		types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return err
+	}
+
+	latest := make(map[string]int64)
+	for _, container := range containers {
+		key := pipelineStage(container.Labels[labelPipeline], container.Labels[labelStage])
+		if created, ok := latest[key]; !ok || container.Created > created {
+			latest[key] = container.Created
+		}
+	}
+
+	for _, container := range containers {
+		pipeline := container.Labels[labelPipeline]
+		stage := container.Labels[labelStage]
+		if !c.removable(c.kept, pipeline, stage, container.Labels[labelRun],
+			latest[pipelineStage(pipeline, stage)] == container.Created) {
+			continue
+		}
+
+		name := strings.TrimPrefix(strings.Join(container.Names, ","), "/")
+		if container.State == "running" && !c.force {
+			fmt.Println("Skipping running container", name)
+			continue
+		}
+
+		if c.dryRun {
+			fmt.Println("Would remove container", name)
+			continue
+		}
+
+		fmt.Println("Removing container", name)
+		err = docker.ContainerRemove(context.Background(), container.ID,
+			types.ContainerRemoveOptions{RemoveVolumes: true, Force: true})
+		if err != nil && !isNotFound(err) {
+			return errors.Wrap(err, "Could not remove container "+name)
+		}
+	}
+	return nil
+}
+
+// Removes the output directories of selected stages.
+func (c *cleaner) removeOutputs() error {
+	files, err := ioutil.ReadDir(c.hostpath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Could not list output directory")
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if !c.selected(file.Name()) {
+			continue
+		}
+		err = c.remove("output directory", filepath.Join(c.hostpath, file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the cache entries of selected stages kept by an executor. Each
+// stage has a set of files named after the stage.
+func (c *cleaner) removeCacheEntries(executor string) error {
+	path := filepath.Join(createConfigPath(c.hostpath), executor)
+	files, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Could not list cache entries")
+	}
+
+	for _, file := range files {
+		stage := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if !c.selected(stage) {
+			continue
+		}
+		err = c.remove(executor+" cache entry", filepath.Join(path, file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the Kubernetes jobs of selected stages that walrus created for the
+// output directory, along with their pods. If outputs is the mount point of
+// the volume the jobs write to, the output of the removed jobs is removed too,
+// unless a kept job uses it.
+func (c *cleaner) removeJobs(client kubernetes.Interface, namespace, outputs string) error {
+	ctx := context.Background()
+	k := newKubernetesExecutor(client, namespace, "", "", c.hostpath, "")
+
+	jobs, err := client.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelOutputHash + "=" + k.outputHash(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Label values are shortened, so the kept runs and stages are
+	// compared with shortened values too.
+	var kept *runs
+	if c.kept != nil {
+		kept = &runs{ids: make(map[string]bool), stages: make(map[string]bool)}
+		for id := range c.kept.ids {
+			kept.ids[labelValue(id)] = true
+		}
+		for key := range c.kept.stages {
+			parts := strings.SplitN(key, "/", 2)
+			kept.stages[pipelineStage(labelValue(parts[0]), labelValue(parts[1]))] = true
+		}
+	}
+
+	latest := make(map[string]metav1.Time)
+	for _, job := range jobs.Items {
+		key := pipelineStage(job.Labels[labelPipeline], job.Labels[labelStage])
+		if created, ok := latest[key]; !ok || created.Before(&job.CreationTimestamp) {
+			latest[key] = job.CreationTimestamp
+		}
+	}
+
+	used := make(map[string]bool)
+	var removed []batchv1.Job
+	for _, job := range jobs.Items {
+		pipeline, stage := job.Labels[labelPipeline], job.Labels[labelStage]
+		created := latest[pipelineStage(pipeline, stage)]
+		remove := c.removable(kept, pipeline, stage, job.Labels[labelRun],
+			created.Equal(&job.CreationTimestamp))
+		if remove && job.Status.Active > 0 && !c.force {
+			fmt.Println("Skipping active job", job.Name)
+			remove = false
+		}
+
+		if remove {
+			removed = append(removed, job)
+		} else {
+			used[job.Annotations[annotationOutputPath]] = true
+		}
+	}
+
+	for _, job := range removed {
+		if c.dryRun {
+			fmt.Println("Would remove job", job.Name)
+		} else {
+			fmt.Println("Removing job", job.Name)
+			err = k.deleteJob(ctx, job.Name)
+			if err != nil {
+				return err
+			}
+
+			// Pods are deleted with the job by the garbage collector,
+			// which may not run in all clusters.
+			pods := client.CoreV1().Pods(namespace)
+			list, err := pods.List(ctx, metav1.ListOptions{
+				LabelSelector: "job-name=" + job.Name})
+			if err != nil {
+				return errors.Wrap(err, "Could not list pods of job "+job.Name)
+			}
+			for _, pod := range list.Items {
+				err = pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					return errors.Wrap(err, "Could not remove pod "+pod.Name)
+				}
+			}
+		}
+
+		path := job.Annotations[annotationOutputPath]
+		if outputs == "" || path == "" || used[path] {
+			continue
+		}
+		used[path] = true
+		err = c.remove("output directory", filepath.Join(outputs, path))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the executors the recorded runs in the output directory ran with.
+// Output directories without recorded runs are from walrus versions that only
+// ran stages with Docker.
+func runExecutors(hostpath string) (map[string]bool, error) {
+	ids, err := runIDs(hostpath)
+	if err != nil {
+		return nil, err
+	}
+
+	executors := make(map[string]bool)
+	for _, id := range ids {
+		state, err := readRunState(hostpath, id)
+		if err != nil {
+			return nil, err
+		}
+		executor := state.Executor
+		if executor == "" {
+			executor = executorDocker
+		}
+		executors[executor] = true
+	}
+	if len(executors) == 0 {
+		executors[executorDocker] = true
+	}
+	return executors, nil
+}
+
+// Returns the last n runs, and the IDs of the runs before them.
+func keptRuns(hostpath string, n int) (*runs, []string, error) {
+	ids, err := runIDs(hostpath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var oldRuns []string
+	if len(ids) > n {
+		oldRuns = ids[:len(ids)-n]
+		ids = ids[len(ids)-n:]
+	}
+
+	kept := &runs{
+		ids:     make(map[string]bool),
+		stages:  make(map[string]bool),
+		outputs: make(map[string]bool),
+	}
+	for _, id := range ids {
+		state, err := readRunState(hostpath, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		kept.ids[id] = true
+		for _, stage := range state.Stages {
+			kept.stages[pipelineStage(state.Pipeline, stage.Name)] = true
+			kept.outputs[strings.Split(stage.Name, "_")[0]] = true
+		}
+	}
+	return kept, oldRuns, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Runs the clean command with the given arguments.
+func runClean(args ...string) error {
+	cmd := cleanCommand()
+	err := cmd.flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	return cmd.run(cmd.flags.Args())
+}
+
+// Records runs of a pipeline in an output directory.
+func testRuns(t *testing.T, hostpath, executor string, p *pipeline.Pipeline, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		_, err := newRunState(hostpath, id, executor, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCleanRemovable(t *testing.T) {
+	c := &cleaner{
+		selected: func(stage string) bool { return stage == "a" },
+		kept: &runs{
+			ids:    map[string]bool{"run3": true},
+			stages: map[string]bool{"p/a": true, "p/b": true},
+		},
+	}
+
+	removable := map[string]struct {
+		pipeline, stage, run string
+		latest               bool
+		removed              bool
+	}{
+		"container of a kept run":            {"p", "a", "run3", true, false},
+		"cached container used by kept run":  {"p", "a", "run2", true, false},
+		"older container of a kept stage":    {"p", "a", "run1", false, true},
+		"latest container of another stage":  {"p", "c", "run2", true, true},
+		"latest container of other pipeline": {"q", "a", "run2", true, true},
+		"container without a run":            {"p", "b", "", false, true},
+	}
+	for name, container := range removable {
+		got := c.removable(c.kept, container.pipeline, container.stage,
+			container.run, container.latest)
+		if got != container.removed {
+			t.Errorf("%s: removable is %v", name, got)
+		}
+	}
+
+	// Without -keep containers are selected by stage.
+	if !c.removable(nil, "p", "a", "run3", true) || c.removable(nil, "p", "b", "run1", false) {
+		t.Error("Containers are not selected by stage without -keep")
+	}
+}
+
+func TestCleanKeepKubernetesJobs(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	volume, err := ioutil.TempDir("", "walrus-volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(volume)
+
+	client := fake.NewSimpleClientset()
+	p := testPipeline("p")
+	testRuns(t, hostpath, executorKubernetes, p, "run1", "run2", "run3")
+
+	// Stage a ran in run1 and run2, and run3 used the output of run2 since
+	// a is cached. Stage b ran in every run, and is still running in run1.
+	ran := map[string][]string{
+		"run1": {"a", "b"},
+		"run2": {"a", "b"},
+		"run3": {"b"},
+	}
+	created := time.Now()
+	for _, id := range []string{"run1", "run2", "run3"} {
+		k := startTestExecutor(t, client, p, hostpath, id)
+		for _, stage := range p.Stages {
+			found := false
+			for _, name := range ran[id] {
+				found = found || name == stage.Name
+			}
+			if !found {
+				continue
+			}
+
+			job, err := k.job(stage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			created = created.Add(time.Second)
+			job.CreationTimestamp = metav1.NewTime(created)
+			_, err = client.BatchV1().Jobs("default").Create(context.Background(), job,
+				metav1.CreateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:   job.Name + "-abcde",
+				Labels: map[string]string{"job-name": job.Name},
+			}}
+			_, err = client.CoreV1().Pods("default").Create(context.Background(), pod,
+				metav1.CreateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = os.MkdirAll(filepath.Join(volume, k.runOutputPath(stage.Name)), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The running job of an old run is only removed with -force.
+	jobs := client.BatchV1().Jobs("default")
+	running, err := jobs.Get(context.Background(), "walrus-p-run1-b", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.Status.Active = 1
+	_, err = jobs.UpdateStatus(context.Background(), running, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, _, err := keptRuns(hostpath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cleaner{hostpath: hostpath, kept: kept}
+	err = c.removeJobs(client, "default", volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remaining := []string{"walrus-p-run1-b", "walrus-p-run2-a", "walrus-p-run3-b"}
+	if got := jobNames(t, client); !equalStrings(got, remaining) {
+		t.Errorf("Jobs left are %v, not %v", got, remaining)
+	}
+	if got := podJobNames(t, client); !equalStrings(got, remaining) {
+		t.Errorf("Pods of jobs %v are left, not of %v", got, remaining)
+	}
+	for path, exists := range map[string]bool{
+		"p/run1/a": false,
+		"p/run1/b": true,
+		"p/run2/a": true,
+		"p/run2/b": false,
+		"p/run3/b": true,
+	} {
+		_, err := os.Stat(filepath.Join(volume, path))
+		if (err == nil) != exists {
+			t.Errorf("Output %s exists: %v", path, err == nil)
+		}
+	}
+
+	c.force = true
+	err = c.removeJobs(client, "default", volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining = []string{"walrus-p-run2-a", "walrus-p-run3-b"}
+	if got := jobNames(t, client); !equalStrings(got, remaining) {
+		t.Errorf("Jobs left with -force are %v, not %v", got, remaining)
+	}
+}
+
+func TestCleanFailsIfContainersAreNotRemoved(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	host := "unix://" + filepath.Join(hostpath, "missing.sock")
+	p := testPipeline("p")
+	testRuns(t, hostpath, executorDocker, p, "run1", "run2")
+
+	err = runClean("-o", hostpath, "-host", host, "-keep", "1")
+	if err == nil {
+		t.Fatal("Clean succeeded without a container runtime")
+	}
+
+	// The old run is not forgotten, so that it can be cleaned later.
+	ids, err := runIDs(hostpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("Runs left after a failed clean are %v", ids)
+	}
+
+	// Runs that did not use containers do not need a container runtime.
+	local, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	testRuns(t, local, executorLocal, p, "run1", "run2")
+
+	err = runClean("-o", local, "-host", host, "-keep", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err = runIDs(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "run2" {
+		t.Errorf("Runs left are %v", ids)
+	}
+}
+
+func jobNames(t *testing.T, client *fake.Clientset) []string {
+	t.Helper()
+	list, err := client.BatchV1().Jobs("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, job := range list.Items {
+		names = append(names, job.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func podJobNames(t *testing.T, client *fake.Clientset) []string {
+	t.Helper()
+	list, err := client.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pod := range list.Items {
+		names = append(names, pod.Labels["job-name"])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A walrus subcommand, e.g. `walrus run`. The summary is a single line shown
+// in the list of commands, and the optional description is added to the help
+// of the command. Every command has its own set of flags. The remaining
+// command line arguments are passed to run.
+type command struct {
+	name        string
+	args        string
+	summary     string
+	description string
+	flags       *flag.FlagSet
+	run         func(args []string) error
+}
+
+// Returns the list of walrus commands. Commands are created on every call
+// since their flags are bound to local variables.
+func commands() []*command {
+	return []*command{
+		runCommand(),
+		planCommand(),
+		statusCommand(),
+		logsCommand(),
+		graphCommand(),
+		diffCommand(),
+		resetCommand(),
+		cleanCommand(),
+		serveCommand(),
+		profileCommand(),
+		lfsServerCommand(),
+		completionCommand(),
+	}
+}
+
+// Creates a command with an empty flag set that prints the command usage on
+// -h or flag errors.
+func newCommand(name, args, summary string) *command {
+	cmd := &command{name: name, args: args, summary: summary}
+	cmd.flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	cmd.flags.Usage = func() {
+		cmd.usage(cmd.flags.Output())
+	}
+	return cmd
+}
+
+func (cmd *command) usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s\n\n%s\n", strings.TrimSpace("walrus "+cmd.name+
+		" [flags] "+cmd.args), cmd.summary)
+	if cmd.description != "" {
+		fmt.Fprintf(w, "%s\n", cmd.description)
+	}
+
+	hasFlags := false
+	cmd.flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintf(w, "\nFlags:\n")
+		cmd.flags.PrintDefaults()
+	}
+}
+
+// Runs the command given by the command line arguments.
+func execute(args []string) error {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return errors.New("No command given")
+	}
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		return help(args[1:])
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		usage(os.Stderr)
+		return errors.New("Unknown command " + name)
+	}
+
+	err := cmd.flags.Parse(args[1:])
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return cmd.run(cmd.flags.Args())
+}
+
+// Prints help for walrus or a single command.
+func help(args []string) error {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return nil
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return errors.New("Unknown command " + args[0])
+	}
+	cmd.flags.SetOutput(os.Stdout)
+	cmd.usage(os.Stdout)
+	return nil
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "walrus runs data analysis pipelines in containers.\n\n")
+	fmt.Fprintf(w, "Usage: walrus <command> [flags] [arguments]\n\nCommands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nUse \"walrus help <command>\" for more information about a command.\n")
+}
+
+// Generates a shell completion script that completes command names and the
+// flags of each command.
+func completionCommand() *command {
+	cmd := newCommand("completion", "bash|zsh",
+		"Print a shell completion script.")
+	cmd.description = "Load it in the current shell with\n\n" +
+		"\tsource <(walrus completion bash)"
+
+	cmd.run = func(args []string) error {
+		if len(args) != 1 {
+			cmd.usage(os.Stderr)
+			return errors.New("completion requires the name of a shell")
+		}
+
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(os.Stdout)
+		case "zsh":
+			fmt.Fprintln(os.Stdout, "autoload -U +X bashcompinit && bashcompinit")
+			writeBashCompletion(os.Stdout)
+		default:
+			return errors.New("Unsupported shell " + args[0] + ", must be bash or zsh")
+		}
+		return nil
+	}
+	return cmd
+}
+
+func writeBashCompletion(w io.Writer) {
+	var names []string
+	for _, cmd := range commands() {
+		names = append(names, cmd.name)
+	}
+
+	fmt.Fprintf(w, "_walrus() {\n")
+	fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(w, "    if [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"help %s\" -- \"$cur\"))\n",
+		strings.Join(names, " "))
+	fmt.Fprintf(w, "        return\n")
+	fmt.Fprintf(w, "    fi\n")
+	fmt.Fprintf(w, "    case \"${COMP_WORDS[1]}\" in\n")
+	fmt.Fprintf(w, "    help)\n")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n",
+		strings.Join(names, " "))
+	for _, cmd := range commands() {
+		var flags []string
+		cmd.flags.VisitAll(func(f *flag.Flag) {
+			flags = append(flags, "-"+f.Name)
+		})
+		sort.Strings(flags)
+		fmt.Fprintf(w, "    %s)\n", cmd.name)
+		fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n",
+			strings.Join(flags, " "))
+	}
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -o default -F _walrus walrus\n")
+}
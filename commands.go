@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/fjukstad/walrus/lfs"
+	"github.com/fjukstad/walrus/pipeline"
+
+	"github.com/pkg/errors"
+)
+
+var defaultConfigFilename = "pipeline.json"
+
+// Adds the flag for the pipeline description file to a command.
+func configFlag(cmd *command) *string {
+	return cmd.flags.String("i", defaultConfigFilename,
+		"pipeline description file")
+}
+
+// Adds the flag for the output directory to a command.
+func outputFlag(cmd *command) *string {
+	return cmd.flags.String("o", "walrus",
+		"where walrus should store output data on the host")
+}
+
+// Adds the flags selecting and configuring the executor to a command.
+func executorFlags(cmd *command) (*string, *executorConfig) {
+	executorName := cmd.flags.String("executor", executorDocker,
+		"how to run the stages: as containers (docker), as host processes (local),\n"+
+			"as Kubernetes jobs (kubernetes) or as Slurm jobs (slurm)")
+	executorConf := &executorConfig{}
+	cmd.flags.StringVar(&executorConf.Runtime, "runtime", runtimeDocker,
+		"container runtime to run the stages with (docker or podman)")
+	cmd.flags.StringVar(&executorConf.Host, "host", "",
+		"address of the container runtime API, e.g. unix:///run/podman/podman.sock")
+	cmd.flags.StringVar(&executorConf.Hosts, "hosts", "",
+		"configuration file listing a pool of Docker hosts to run the stages on")
+	cmd.flags.StringVar(&executorConf.Kubeconfig, "kubeconfig", "",
+		"kubeconfig file for the kubernetes executor (default $KUBECONFIG, ~/.kube/config or in-cluster)")
+	cmd.flags.StringVar(&executorConf.Namespace, "namespace", "default",
+		"namespace to run the Kubernetes jobs in")
+	cmd.flags.StringVar(&executorConf.Claim, "claim", "walrus",
+		"persistent volume claim mounted at /walrus in the Kubernetes jobs")
+	cmd.flags.StringVar(&executorConf.ClaimMount, "claim-mount", "",
+		"where the persistent volume claim is mounted on this host, if it is,\n"+
+			"to write the stage logs to the volume and check cached output on it")
+	cmd.flags.StringVar(&executorConf.SlurmRuntime, "slurm-runtime", "singularity",
+		"container runtime on the compute nodes for the slurm executor\n"+
+			"(singularity, apptainer, podman or docker)")
+	cmd.flags.StringVar(&executorConf.SlurmPartition, "slurm-partition", "",
+		"Slurm partition to submit the jobs to (default is the cluster default)")
+	return executorName, executorConf
+}
+
+// Sets the user the stages run as to the user running walrus.
+func lookupCurrentUser() error {
+	c, err := user.Current()
+	if err != nil {
+		return errors.Wrap(err, "Could not get current user")
+	}
+	currentUser = c.Uid + ":" + c.Gid
+	return nil
+}
+
+func runCommand() *command {
+	cmd := newCommand("run", "", "Run a pipeline.")
+	cmd.description = "Stages run in parallel as soon as their inputs are available, and\n" +
+		"their output is written to the output directory."
+
+	configFilename := configFlag(cmd)
+	outputDir := outputFlag(cmd)
+	web := cmd.flags.Bool("web", false,
+		"host interactive visualization of the pipeline")
+	port := cmd.flags.String("p", "localhost:9090",
+		"address to serve the pipeline visualization on, e.g. :9090 to serve it\n"+
+			"on all interfaces")
+	commit := cmd.flags.Bool("commit", false, "add and commit output data")
+	collectProfile := cmd.flags.Bool("profile", false,
+		"collect runtime metrics for the pipeline stages")
+	interval := cmd.flags.Duration("profile-interval", time.Second,
+		"how often to sample the resource usage of stages when profiling")
+	eventsFilename := cmd.flags.String("events", "",
+		"write pipeline events as JSON lines to the given file, or - for stdout")
+	metricsAddr := cmd.flags.String("metrics", "",
+		"serve Prometheus metrics on the given address, e.g. localhost:9091\n"+
+			"(the metrics are also served by the visualization on -web)")
+	executorName, executorConf := executorFlags(cmd)
+	webConf := webFlags(cmd)
+	traceConf := traceFlags(cmd)
+
+	cmd.run = func(args []string) error {
+		profile = collectProfile
+		profileInterval = *interval
+
+		srv, err := newWebServer(*webConf)
+		if err != nil {
+			return err
+		}
+
+		hostpath, err := filepath.Abs(*outputDir)
+		if err != nil {
+			return errors.Wrap(err, "Check hostpath")
+		}
+
+		err = lookupCurrentUser()
+		if err != nil {
+			return err
+		}
+
+		lock, err := lockOutput(hostpath)
+		if err != nil {
+			return err
+		}
+		defer lock.unlock()
+
+		runID := newRunID()
+		executorConf.RunID = runID
+
+		p, err := pipeline.ParseConfig(*configFilename)
+		if err != nil {
+			return err
+		}
+
+		p.Commit = *commit
+
+		err = fixMountPaths(p.Stages)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		stopTracing, err := traceConf.start()
+		if err != nil {
+			return err
+		}
+		defer stopTracing()
+
+		state, err := newRunState(hostpath, runID, *executorName, p)
+		if err != nil {
+			return err
+		}
+
+		r, err := newRunner(*executorName, *executorConf, hostpath, p, state)
+		if err != nil {
+			state.finish(err)
+			return err
+		}
+
+		var m *metrics
+		if *web || *metricsAddr != "" {
+			m = newMetrics()
+			ctx = withMetrics(ctx, m)
+		}
+
+		completedPipelineDescription := *outputDir + "/" + filepath.Base(*configFilename)
+
+		if *web {
+			api := &runAPI{
+				state:       state,
+				hostpath:    hostpath,
+				description: filepath.Join(hostpath, filepath.Base(*configFilename)),
+			}
+			go func() {
+				err := startPipelineVisualization(p, srv, *port, api, m)
+				if err != nil {
+					log.Println("Could not start pipeline visualization:", err)
+				}
+			}()
+		}
+
+		if *metricsAddr != "" {
+			go func() {
+				mux := http.NewServeMux()
+				mux.Handle("/metrics", m.handler())
+				err := srv.listenAndServe(*metricsAddr, mux)
+				if err != nil {
+					log.Println("Could not serve metrics:", err)
+				}
+			}()
+		}
+
+		switch *eventsFilename {
+		case "":
+		case "-":
+			state.events.writeTo(os.Stdout)
+		default:
+			f, err := os.Create(*eventsFilename)
+			if err != nil {
+				return errors.Wrap(err, "Could not create event file")
+			}
+			defer f.Close()
+			state.events.writeTo(f)
+		}
+
+		if m != nil {
+			m.watch(state)
+		}
+
+		log.Println("Starting pipeline run", state.ID)
+
+		err = r.run(ctx)
+		state.finish(err)
+		if err != nil {
+			return err
+		}
+
+		log.Println("All stages completed successfully. Output written to ",
+			hostpath)
+
+		log.Println("Pipeline completed in:", p.Runtime)
+
+		err = p.WritePipelineDescription(completedPipelineDescription)
+		if err != nil {
+			return errors.Wrap(err, "Could not write pipeline description")
+		}
+
+		if p.Commit {
+			err = lfs.Add(*configFilename)
+			if err != nil {
+				return err
+			}
+			commitId, err := lfs.AddAndCommit(completedPipelineDescription, "Add pipeline configurations")
+			if err != nil {
+				return err
+			}
+			log.Println("Pipeline completed. Use id", commitId, "to reference it later")
+		}
+		return nil
+	}
+	return cmd
+}
+
+func planCommand() *command {
+	cmd := newCommand("plan", "", "Print a pipeline as walrus will run it.")
+	cmd.description = "Variables are replaced and parallel stages expanded."
+
+	configFilename := configFlag(cmd)
+	outputDir := outputFlag(cmd)
+	results := cmd.flags.Bool("results", false,
+		"print the description of the completed pipeline in the output directory")
+
+	cmd.run = func(args []string) error {
+		filename := *configFilename
+		if *results {
+			filename = *outputDir + "/" + filepath.Base(filename)
+		}
+
+		p, err := pipeline.ParseConfig(filename)
+		switch err.(type) {
+		case nil:
+			fmt.Println(p)
+		case *pipeline.NameError:
+			fmt.Println(p)
+			return err
+		default:
+			return err
+		}
+		return nil
+	}
+	return cmd
+}
+
+func logsCommand() *command {
+	cmd := newCommand("logs", "STAGE", "Print the logs of a pipeline stage.")
+
+	outputDir := outputFlag(cmd)
+
+	cmd.run = func(args []string) error {
+		if len(args) != 1 {
+			cmd.usage(os.Stderr)
+			return errors.New("logs requires the name of a stage")
+		}
+
+		stageName := args[0]
+		filename := *outputDir + "/" + stageName + "/walrus.log"
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return errors.Wrap(err, "Could not read logs for stage "+stageName)
+		}
+		fmt.Print(string(b))
+		return nil
+	}
+	return cmd
+}
+
+func graphCommand() *command {
+	cmd := newCommand("graph", "FILE",
+		"Write a DOT graph of the pipeline to the given file.")
+
+	configFilename := configFlag(cmd)
+
+	cmd.run = func(args []string) error {
+		if len(args) != 1 {
+			cmd.usage(os.Stderr)
+			return errors.New("graph requires the name of the file to write")
+		}
+
+		p, err := pipeline.ParseConfig(*configFilename)
+		if err != nil {
+			return err
+		}
+
+		err = p.WriteDOT(args[0])
+		if err != nil {
+			return err
+		}
+		log.Println("DOT graph of the pipeline was written to:", args[0])
+		return nil
+	}
+	return cmd
+}
+
+func diffCommand() *command {
+	cmd := newCommand("diff", "ID",
+		"Print the difference from the pipeline run with the given ID.")
+
+	outputDir := outputFlag(cmd)
+
+	cmd.run = func(args []string) error {
+		if len(args) != 1 {
+			cmd.usage(os.Stderr)
+			return errors.New("diff requires the ID of a pipeline run")
+		}
+
+		str, err := lfs.PrintDiff(*outputDir, args[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Difference from pipeline run " + args[0] + ":\n" + str)
+		return nil
+	}
+	return cmd
+}
+
+func resetCommand() *command {
+	cmd := newCommand("reset", "ID",
+		"Reset walrus output back to a known configuration.")
+	cmd.description = "Warning: this rolls back the repository and deletes newer changes."
+
+	outputDir := outputFlag(cmd)
+	yes := cmd.flags.Bool("y", false, "reset without asking for confirmation")
+
+	cmd.run = func(args []string) error {
+		if len(args) != 1 {
+			cmd.usage(os.Stderr)
+			return errors.New("reset requires the ID of a pipeline run")
+		}
+		id := args[0]
+
+		if !*yes {
+			fmt.Println("Are you sure you want to reset the walrus results?")
+			fmt.Println("This will remove all provenance information on files created later (Y/n).")
+
+			var input string
+			_, err := fmt.Fscanln(os.Stdin, &input)
+			if err != nil {
+				return errors.Wrap(err, "Could not read input")
+			}
+
+			if input != "Y" {
+				return nil
+			}
+		}
+
+		log.Println("Resetting data to pipeline run", id)
+		err := lfs.Reset(*outputDir, id)
+		if err != nil {
+			return errors.Wrap(err, "Could not reset walrus results to id "+id)
+		}
+		log.Println("Successfully reset to", id)
+		log.Println("Any data that was created later than this ID is still available")
+		return nil
+	}
+	return cmd
+}
+
+func lfsServerCommand() *command {
+	cmd := newCommand("lfs-server", "",
+		"Start a git-lfs server for storing pipeline output data.")
+
+	dir := cmd.flags.String("dir", "lfs", "host directory to store lfs objects")
+
+	cmd.run = func(args []string) error {
+		err := lfs.StartServer(*dir)
+		if err != nil {
+			return errors.Wrap(err, "Could not start git-lfs server")
+		}
+		log.Println("git-lfs server started successfully")
+		return nil
+	}
+	return cmd
+}
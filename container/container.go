@@ -3,46 +3,182 @@ package container
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"io"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
 )
 
-func Profile(c *client.Client, containerID, filename string) {
-	var measurements []ContainerStats
-	for {
-		stats, err := c.ContainerStats(context.Background(), containerID,
-			false)
+// Settings for profiling a container. Samples are taken at most once every
+// Interval, and Docker reports statistics about once a second. Every sample is
+// appended as a line of JSON to Filename, unless Filename is empty, and passed
+// to Sample, unless Sample is nil.
+type ProfileOptions struct {
+	Interval time.Duration
+	Filename string
+	Sample   func(ContainerStats)
+}
+
+// The resource usage of a container over the time it was profiled. CPU
+// percentages are of a single CPU, so a container using two CPUs fully is at
+// 200%. Block IO and network bytes are totals over the lifetime of the
+// container.
+type Summary struct {
+	Samples        int
+	PeakMemory     int64
+	MeanCPUPercent float64
+	MaxCPUPercent  float64
+	BlockRead      int64
+	BlockWrite     int64
+	NetworkRx      int64
+	NetworkTx      int64
+}
+
+// Collects resource usage statistics of a container from when it is started
+// until Stop is called.
+type Profiler struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	summary  Summary
+	cpuTotal float64
+	cpuCount int
+	err      error
+}
+
+// Starts profiling a container. The container may be created but not yet
+// started.
+func StartProfile(c *client.Client, containerID string, opts ProfileOptions) *Profiler {
+	return startProfile(func(ctx context.Context) (io.ReadCloser, error) {
+		stats, err := c.ContainerStats(ctx, containerID, true)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return nil, err
+		}
+		return stats.Body, nil
+	}, opts)
+}
+
+// Starts profiling the stream of statistics that open returns, which is a
+// stream of JSON objects as the Docker API reports them.
+func startProfile(open func(ctx context.Context) (io.ReadCloser, error), opts ProfileOptions) *Profiler {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Profiler{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(p.done)
+		err := p.run(ctx, open, opts)
+		if err != nil && ctx.Err() == nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
 		}
-		b, err := ioutil.ReadAll(stats.Body)
+	}()
+
+	return p
+}
+
+// Stops profiling and returns the resource usage of the container, or nil if
+// no statistics were collected while the container was running.
+func (p *Profiler) Stop() (*Summary, error) {
+	p.cancel()
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.summary.Samples == 0 {
+		return nil, p.err
+	}
+	summary := p.summary
+	if p.cpuCount > 0 {
+		summary.MeanCPUPercent = p.cpuTotal / float64(p.cpuCount)
+	}
+	return &summary, p.err
+}
+
+func (p *Profiler) run(ctx context.Context, open func(ctx context.Context) (io.ReadCloser, error), opts ProfileOptions) error {
+	var encoder *json.Encoder
+	if opts.Filename != "" {
+		f, err := os.OpenFile(opts.Filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return errors.Wrap(err, "Could not create profile file")
 		}
-		stats.Body.Close()
-		containerStats := ContainerStats{}
+		defer f.Close()
+		encoder = json.NewEncoder(f)
+	}
 
-		err = json.Unmarshal(b, &containerStats)
+	stats, err := open(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Could not read container statistics")
+	}
+	defer stats.Close()
+
+	var last time.Time
+	decoder := json.NewDecoder(stats)
+	for {
+		containerStats := ContainerStats{}
+		err := decoder.Decode(&containerStats)
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
-			fmt.Println(err)
-			return
+			return errors.Wrap(err, "Could not parse container statistics")
 		}
-		if containerStats.CPUStats.CPUUsage.TotalUsage != 0 {
-			measurements = append(measurements, containerStats)
-			b, err = json.Marshal(measurements)
-			if err != nil {
-				fmt.Println("Could not marshal json", err)
-				return
-			}
-			err = ioutil.WriteFile(filename, b, 0666)
+
+		// Stopped containers, and containers that have not started yet,
+		// report no usage.
+		if containerStats.CPUStats.CPUUsage.TotalUsage == 0 {
+			continue
+		}
+
+		p.add(containerStats)
+
+		if !last.IsZero() && time.Since(last) < opts.Interval {
+			continue
+		}
+		last = time.Now()
+
+		if opts.Sample != nil {
+			opts.Sample(containerStats)
+		}
+		if encoder != nil {
+			err = encoder.Encode(containerStats)
 			if err != nil {
-				fmt.Println("Could not write profile file", err)
-				return
+				return errors.Wrap(err, "Could not write profile file")
 			}
 		}
 	}
 }
+
+// Adds a sample to the summary. Every sample Docker reports is added, also
+// those that are not written to the profile file, so that no peaks are missed.
+func (p *Profiler) add(stats ContainerStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.summary.Samples++
+
+	memory := stats.MemoryUsage()
+	if memory > p.summary.PeakMemory {
+		p.summary.PeakMemory = memory
+	}
+
+	// The first sample of a container has no previous sample to compute the
+	// CPU usage from.
+	if stats.PrecpuStats.SystemCPUUsage > 0 {
+		percent := stats.CPUPercent()
+		p.cpuTotal += percent
+		p.cpuCount++
+		if percent > p.summary.MaxCPUPercent {
+			p.summary.MaxCPUPercent = percent
+		}
+	}
+
+	// Block IO and network counters are totals since the container started.
+	p.summary.BlockRead, p.summary.BlockWrite = stats.BlockIO()
+	p.summary.NetworkRx, p.summary.NetworkTx = stats.NetworkIO()
+}
@@ -0,0 +1,149 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stats stream of a container that has not started yet, then starts and
+// uses 40% and then 120% of a CPU.
+const statsStream = `{"cpu_stats": {"cpu_usage": {"total_usage": 0}}}
+{"cpu_stats": {"cpu_usage": {"total_usage": 200}, "online_cpus": 2, "system_cpu_usage": 1000},
+ "memory_stats": {"usage": 100}}
+{"cpu_stats": {"cpu_usage": {"total_usage": 400}, "online_cpus": 2, "system_cpu_usage": 2000},
+ "precpu_stats": {"cpu_usage": {"total_usage": 200}, "online_cpus": 2, "system_cpu_usage": 1000},
+ "memory_stats": {"usage": 500, "stats": {"inactive_file": 100}}}
+{"cpu_stats": {"cpu_usage": {"total_usage": 1000}, "online_cpus": 2, "system_cpu_usage": 3000},
+ "precpu_stats": {"cpu_usage": {"total_usage": 400}, "online_cpus": 2, "system_cpu_usage": 2000},
+ "memory_stats": {"usage": 300},
+ "blkio_stats": {"io_service_bytes_recursive": [{"op": "Read", "value": 10}, {"op": "Write", "value": 20}]},
+ "networks": {"eth0": {"rx_bytes": 30, "tx_bytes": 40}}}
+`
+
+// Profiles a canned stats stream until it ends and returns the summary.
+func profileStream(t *testing.T, stream string, opts ProfileOptions) *Summary {
+	t.Helper()
+
+	p := startProfile(func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(stream)), nil
+	}, opts)
+
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Profiling did not stop at the end of the stream")
+	}
+
+	summary, err := p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+// Returns the total CPU usage of every sample in a profile file.
+func profileLines(t *testing.T, filename string) []int {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var usage []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		stats := ContainerStats{}
+		err := json.Unmarshal(scanner.Bytes(), &stats)
+		if err != nil {
+			t.Fatalf("Line %q of the profile: %v", scanner.Text(), err)
+		}
+		usage = append(usage, stats.CPUStats.CPUUsage.TotalUsage)
+	}
+	return usage
+}
+
+func TestProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walrus-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		lines    []int
+	}{
+		{name: "every sample", lines: []int{200, 400, 1000}},
+		// Samples between the ones written to the file still count
+		// towards the summary.
+		{name: "first sample", interval: time.Hour, lines: []int{200}},
+	}
+
+	for _, test := range tests {
+		filename := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1)+".jsonl")
+		sampled := 0
+		summary := profileStream(t, statsStream, ProfileOptions{
+			Interval: test.interval,
+			Filename: filename,
+			Sample:   func(ContainerStats) { sampled++ },
+		})
+
+		want := Summary{Samples: 3, PeakMemory: 400, MeanCPUPercent: 80,
+			MaxCPUPercent: 120, BlockRead: 10, BlockWrite: 20, NetworkRx: 30,
+			NetworkTx: 40}
+		if summary == nil || *summary != want {
+			t.Errorf("%s: Summary is %+v, not %+v", test.name, summary, want)
+		}
+
+		lines := profileLines(t, filename)
+		if len(lines) != len(test.lines) || sampled != len(test.lines) {
+			t.Errorf("%s: %d samples written and %d passed on, not %d",
+				test.name, len(lines), sampled, len(test.lines))
+			continue
+		}
+		for i := range lines {
+			if lines[i] != test.lines[i] {
+				t.Errorf("%s: Sample %d has CPU usage %d, not %d", test.name, i,
+					lines[i], test.lines[i])
+			}
+		}
+	}
+}
+
+func TestProfileNotStarted(t *testing.T) {
+	summary := profileStream(t, `{"cpu_stats": {"cpu_usage": {"total_usage": 0}}}`,
+		ProfileOptions{})
+	if summary != nil {
+		t.Errorf("Container that never started has summary %+v", summary)
+	}
+
+	p := startProfile(func(ctx context.Context) (io.ReadCloser, error) {
+		return nil, errors.New("no such container")
+	}, ProfileOptions{})
+	<-p.done
+	summary, err := p.Stop()
+	if summary != nil || err == nil {
+		t.Errorf("Profiling a missing container gave %+v, %v", summary, err)
+	}
+
+	p = startProfile(func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("{")), nil
+	}, ProfileOptions{})
+	<-p.done
+	_, err = p.Stop()
+	if err == nil {
+		t.Error("A truncated stats stream gave no error")
+	}
+}
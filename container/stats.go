@@ -0,0 +1,106 @@
+package container
+
+import "strings"
+
+// Returns the CPU usage of the container since the previous sample Docker
+// took, as a percentage of a single CPU, the way `docker stats` reports it.
+// Returns 0 for the first sample of a container, which has no previous sample.
+func (s ContainerStats) CPUPercent() float64 {
+	if s.PrecpuStats.SystemCPUUsage == 0 {
+		return 0
+	}
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage - s.PrecpuStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemCPUUsage - s.PrecpuStats.SystemCPUUsage)
+	if systemDelta <= 0 || cpuDelta < 0 {
+		return 0
+	}
+	return cpuDelta / systemDelta * float64(s.cpus()) * 100
+}
+
+// Returns the number of CPUs available to the container.
+func (s ContainerStats) cpus() int {
+	if s.CPUStats.OnlineCpus > 0 {
+		return s.CPUStats.OnlineCpus
+	}
+	return len(s.CPUStats.CPUUsage.PercpuUsage)
+}
+
+// Returns the memory used by the container in bytes, without the page cache
+// that the kernel can reclaim, the way `docker stats` reports it.
+func (s ContainerStats) MemoryUsage() int64 {
+	usage := int64(s.MemoryStats.Usage)
+	// cgroup v1 reports total_inactive_file, cgroup v2 inactive_file.
+	inactive := int64(s.MemoryStats.Stats.TotalInactiveFile)
+	if inactive == 0 {
+		inactive = int64(s.MemoryStats.Stats.InactiveFile)
+	}
+	if inactive < usage {
+		usage -= inactive
+	}
+	return usage
+}
+
+// Returns the memory used by the container as a percentage of its memory
+// limit, or 0 if the limit is not known.
+func (s ContainerStats) MemoryPercent() float64 {
+	if s.MemoryStats.Limit == 0 {
+		return 0
+	}
+	return float64(s.MemoryUsage()) / float64(s.MemoryStats.Limit) * 100
+}
+
+// Returns the bytes the container has read from and written to block devices
+// since it started.
+func (s ContainerStats) BlockIO() (read, write int64) {
+	for _, entry := range s.BlkIoStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += int64(entry.Value)
+		case "write":
+			write += int64(entry.Value)
+		}
+	}
+	return read, write
+}
+
+// Returns the bytes the container has received and sent on all its networks
+// since it started.
+func (s ContainerStats) NetworkIO() (rx, tx int64) {
+	for _, network := range s.Networks {
+		rx += int64(network.RxBytes)
+		tx += int64(network.TxBytes)
+	}
+	return rx, tx
+}
+
+// Returns the bytes per second the container has read from and written to
+// block devices since the previous sample.
+func (s ContainerStats) BlockIORate(previous ContainerStats) (read, write float64) {
+	seconds := s.since(previous)
+	if seconds <= 0 {
+		return 0, 0
+	}
+	r, w := s.BlockIO()
+	pr, pw := previous.BlockIO()
+	return float64(r-pr) / seconds, float64(w-pw) / seconds
+}
+
+// Returns the bytes per second the container has received and sent on all its
+// networks since the previous sample.
+func (s ContainerStats) NetworkRate(previous ContainerStats) (rx, tx float64) {
+	seconds := s.since(previous)
+	if seconds <= 0 {
+		return 0, 0
+	}
+	r, t := s.NetworkIO()
+	pr, pt := previous.NetworkIO()
+	return float64(r-pr) / seconds, float64(t-pt) / seconds
+}
+
+// Returns the seconds between the previous sample and this one.
+func (s ContainerStats) since(previous ContainerStats) float64 {
+	if s.Read.IsZero() || previous.Read.IsZero() {
+		return 0
+	}
+	return s.Read.Sub(previous.Read).Seconds()
+}
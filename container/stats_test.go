@@ -0,0 +1,199 @@
+package container
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Samples from a host with cgroup v1 and one with cgroup v2, in the format
+// of the Docker stats API.
+const (
+	statsV1 = `{
+		"read": "2020-01-01T00:00:02Z",
+		"cpu_stats": {
+			"cpu_usage": {"total_usage": 400, "percpu_usage": [100, 100, 100, 100]},
+			"system_cpu_usage": 2000
+		},
+		"precpu_stats": {
+			"cpu_usage": {"total_usage": 200, "percpu_usage": [50, 50, 50, 50]},
+			"system_cpu_usage": 1000
+		},
+		"memory_stats": {
+			"usage": 1000,
+			"limit": 4000,
+			"stats": {"total_inactive_file": 200, "cache": 300}
+		},
+		"blkio_stats": {
+			"io_service_bytes_recursive": [
+				{"major": 8, "minor": 0, "op": "Read", "value": 100},
+				{"major": 8, "minor": 0, "op": "Write", "value": 50},
+				{"major": 8, "minor": 0, "op": "Total", "value": 150},
+				{"major": 8, "minor": 16, "op": "Read", "value": 20}
+			]
+		},
+		"networks": {
+			"eth0": {"rx_bytes": 10, "tx_bytes": 20},
+			"eth1": {"rx_bytes": 5, "tx_bytes": 5}
+		}
+	}`
+
+	statsV2 = `{
+		"read": "2020-01-01T00:00:02Z",
+		"cpu_stats": {
+			"cpu_usage": {"total_usage": 1500},
+			"online_cpus": 2,
+			"system_cpu_usage": 3000
+		},
+		"precpu_stats": {
+			"cpu_usage": {"total_usage": 1000},
+			"online_cpus": 2,
+			"system_cpu_usage": 2000
+		},
+		"memory_stats": {
+			"usage": 1000,
+			"stats": {"inactive_file": 300, "file": 400, "anon": 600}
+		},
+		"blkio_stats": {
+			"io_service_bytes_recursive": [
+				{"major": 259, "minor": 0, "op": "read", "value": 4096},
+				{"major": 259, "minor": 0, "op": "write", "value": 8192}
+			]
+		},
+		"networks": {
+			"eth0": {"rx_bytes": 1000, "tx_bytes": 2000}
+		}
+	}`
+
+	// The first sample of a container has no previous CPU sample.
+	statsFirst = `{
+		"read": "2020-01-01T00:00:00Z",
+		"cpu_stats": {
+			"cpu_usage": {"total_usage": 200},
+			"online_cpus": 2,
+			"system_cpu_usage": 1000
+		},
+		"memory_stats": {"usage": 100, "limit": 1000}
+	}`
+
+	// No CPU time has passed since the previous sample.
+	statsIdle = `{
+		"read": "2020-01-01T00:00:02Z",
+		"cpu_stats": {
+			"cpu_usage": {"total_usage": 200},
+			"online_cpus": 2,
+			"system_cpu_usage": 1000
+		},
+		"precpu_stats": {
+			"cpu_usage": {"total_usage": 200},
+			"online_cpus": 2,
+			"system_cpu_usage": 1000
+		},
+		"memory_stats": {
+			"usage": 100,
+			"limit": 1000,
+			"stats": {"inactive_file": 500}
+		}
+	}`
+
+	// The previous sample, two seconds before the others.
+	statsPrevious = `{
+		"read": "2020-01-01T00:00:00Z",
+		"blkio_stats": {
+			"io_service_bytes_recursive": [
+				{"major": 8, "minor": 0, "op": "Read", "value": 20},
+				{"major": 8, "minor": 0, "op": "Write", "value": 10}
+			]
+		},
+		"networks": {
+			"eth0": {"rx_bytes": 5, "tx_bytes": 5}
+		}
+	}`
+)
+
+func parseStats(t *testing.T, s string) ContainerStats {
+	t.Helper()
+	stats := ContainerStats{}
+	err := json.Unmarshal([]byte(s), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name          string
+		stats         string
+		cpuPercent    float64
+		memoryUsage   int64
+		memoryPercent float64
+		read, write   int64
+		rx, tx        int64
+	}{
+		{name: "cgroup v1", stats: statsV1, cpuPercent: 80,
+			memoryUsage: 800, memoryPercent: 20,
+			read: 120, write: 50, rx: 15, tx: 25},
+		{name: "cgroup v2", stats: statsV2, cpuPercent: 100,
+			memoryUsage: 700, memoryPercent: 0,
+			read: 4096, write: 8192, rx: 1000, tx: 2000},
+		{name: "first sample", stats: statsFirst, cpuPercent: 0,
+			memoryUsage: 100, memoryPercent: 10},
+		{name: "zero deltas", stats: statsIdle, cpuPercent: 0,
+			memoryUsage: 100, memoryPercent: 10},
+	}
+
+	for _, test := range tests {
+		s := parseStats(t, test.stats)
+		if got := s.CPUPercent(); got != test.cpuPercent {
+			t.Errorf("%s: CPU usage is %v%%, not %v%%", test.name, got, test.cpuPercent)
+		}
+		if got := s.MemoryUsage(); got != test.memoryUsage {
+			t.Errorf("%s: Memory usage is %v, not %v", test.name, got, test.memoryUsage)
+		}
+		if got := s.MemoryPercent(); got != test.memoryPercent {
+			t.Errorf("%s: Memory usage is %v%%, not %v%%", test.name, got, test.memoryPercent)
+		}
+		if read, write := s.BlockIO(); read != test.read || write != test.write {
+			t.Errorf("%s: Block IO is %v/%v, not %v/%v", test.name, read, write,
+				test.read, test.write)
+		}
+		if rx, tx := s.NetworkIO(); rx != test.rx || tx != test.tx {
+			t.Errorf("%s: Network IO is %v/%v, not %v/%v", test.name, rx, tx,
+				test.rx, test.tx)
+		}
+	}
+}
+
+func TestStatsRates(t *testing.T) {
+	previous := parseStats(t, statsPrevious)
+
+	tests := []struct {
+		name        string
+		stats       string
+		previous    ContainerStats
+		read, write float64
+		rx, tx      float64
+	}{
+		{name: "cgroup v1", stats: statsV1, previous: previous,
+			read: 50, write: 20, rx: 5, tx: 10},
+		// Without a previous sample there is no time to compute a rate
+		// over.
+		{name: "no previous sample", stats: statsV1},
+		// No time has passed since the previous sample.
+		{name: "same time", stats: statsFirst, previous: previous},
+	}
+
+	for _, test := range tests {
+		s := parseStats(t, test.stats)
+		read, write := s.BlockIORate(test.previous)
+		if read != test.read || write != test.write {
+			t.Errorf("%s: Block IO rate is %v/%v, not %v/%v", test.name, read,
+				write, test.read, test.write)
+		}
+		rx, tx := s.NetworkRate(test.previous)
+		if rx != test.rx || tx != test.tx {
+			t.Errorf("%s: Network rate is %v/%v, not %v/%v", test.name, rx, tx,
+				test.rx, test.tx)
+		}
+	}
+}
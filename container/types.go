@@ -1,31 +1,33 @@
 package container
 
+import "time"
+
+// Resource usage statistics of a container as reported by the Docker API.
+// PrecpuStats are the CPU statistics of the previous sample, which the CPU
+// percentage is computed from.
 type ContainerStats struct {
 	PidsStats  `json:"pids_stats"`
 	BlkIoStats `json:"blkio_stats"`
 	NumProcs   int `json:"num_procs"`
 
 	CPUStats    `json:"cpu_stats"`
-	PrecpuStats struct{} `json:"precpu_stats"`
+	PrecpuStats CPUStats `json:"precpu_stats"`
 	MemoryStats `json:"memory_stats"`
-	Name        string `json:"name"`
-	ID          string `json:"id"`
-	Networks    `json:"networks"`
+	Name        string                  `json:"name"`
+	ID          string                  `json:"id"`
+	Networks    map[string]NetworkStats `json:"networks"`
 
-	Preread      string   `json:"preread"`
-	Read         string   `json:"read"`
-	StorageStats struct{} `json:"storage_stats"`
+	Preread      time.Time `json:"preread"`
+	Read         time.Time `json:"read"`
+	StorageStats struct{}  `json:"storage_stats"`
 }
 
 type PidsStats struct {
 	Current int `json:"current"`
 }
 
-type Networks struct {
-	Eth0 `json:"eth0"`
-}
-
-type Eth0 struct {
+// Traffic on a network interface of the container.
+type NetworkStats struct {
 	RxBytes   int `json:"rx_bytes"`
 	RxDropped int `json:"rx_dropped"`
 	RxErrors  int `json:"rx_errors"`
@@ -37,29 +39,29 @@ type Eth0 struct {
 }
 
 type BlkIoStats struct {
-	IoServiceBytesRecursive interface{} `json:"io_service_bytes_recursive"`
-	IoServicedRecursive     interface{} `json:"io_serviced_recursive"`
-	IoQueueRecursive        interface{} `json:"io_queue_recursive"`
-	IoServiceTimeRecursive  interface{} `json:"io_service_time_recursive"`
-	IoWaitTimeRecursive     interface{} `json:"io_wait_time_recursive"`
-	IoMergedRecursive       interface{} `json:"io_merged_recursive"`
-	IoTimeRecursive         interface{} `json:"io_time_recursive"`
-	SectorsRecursive        interface{} `json:"sectors_recursive"`
+	IoServiceBytesRecursive []BlkioStatEntry `json:"io_service_bytes_recursive"`
+	IoServicedRecursive     []BlkioStatEntry `json:"io_serviced_recursive"`
+	IoQueueRecursive        []BlkioStatEntry `json:"io_queue_recursive"`
+	IoServiceTimeRecursive  []BlkioStatEntry `json:"io_service_time_recursive"`
+	IoWaitTimeRecursive     []BlkioStatEntry `json:"io_wait_time_recursive"`
+	IoMergedRecursive       []BlkioStatEntry `json:"io_merged_recursive"`
+	IoTimeRecursive         []BlkioStatEntry `json:"io_time_recursive"`
+	SectorsRecursive        []BlkioStatEntry `json:"sectors_recursive"`
 }
 
-type CPUStats struct {
-	CPUUsage       `json:"cpu_usage"`
-	OnlineCpus     int `json:"online_cpus"`
-	SystemCPUUsage int `json:"system_cpu_usage"`
-	ThrottlingData `json:"throttling_data"`
+// Bytes or operations of a type, e.g. Read or Write, on a block device.
+type BlkioStatEntry struct {
+	Major int    `json:"major"`
+	Minor int    `json:"minor"`
+	Op    string `json:"op"`
+	Value uint64 `json:"value"`
 }
 
-type PrecpuStats struct {
+type CPUStats struct {
 	CPUUsage       `json:"cpu_usage"`
-	ThrottlingData `json:"throttling_data"`
-
 	OnlineCpus     int `json:"online_cpus"`
 	SystemCPUUsage int `json:"system_cpu_usage"`
+	ThrottlingData `json:"throttling_data"`
 }
 
 type CPUUsage struct {
@@ -82,6 +84,10 @@ type MemoryStats struct {
 	Usage    int `json:"usage"`
 }
 
+// Memory statistics of the cgroup of the container. Which fields are set
+// depends on the cgroup version of the host: cgroup v1 reports cache, rss and
+// the total_ fields, while cgroup v2 reports anon, file and the kernel memory
+// fields.
 type Stats struct {
 	ActiveAnon              int `json:"active_anon"`
 	ActiveFile              int `json:"active_file"`
@@ -117,4 +123,30 @@ type Stats struct {
 	TotalWriteback          int `json:"total_writeback"`
 	Unevictable             int `json:"unevictable"`
 	Writeback               int `json:"writeback"`
+
+	// cgroup v2
+	Anon                  int `json:"anon"`
+	AnonThp               int `json:"anon_thp"`
+	File                  int `json:"file"`
+	FileDirty             int `json:"file_dirty"`
+	FileMapped            int `json:"file_mapped"`
+	FileWriteback         int `json:"file_writeback"`
+	KernelStack           int `json:"kernel_stack"`
+	Pgactivate            int `json:"pgactivate"`
+	Pgdeactivate          int `json:"pgdeactivate"`
+	Pglazyfree            int `json:"pglazyfree"`
+	Pglazyfreed           int `json:"pglazyfreed"`
+	Pgrefill              int `json:"pgrefill"`
+	Pgscan                int `json:"pgscan"`
+	Pgsteal               int `json:"pgsteal"`
+	Shmem                 int `json:"shmem"`
+	Slab                  int `json:"slab"`
+	SlabReclaimable       int `json:"slab_reclaimable"`
+	SlabUnreclaimable     int `json:"slab_unreclaimable"`
+	Sock                  int `json:"sock"`
+	ThpCollapseAlloc      int `json:"thp_collapse_alloc"`
+	ThpFaultAlloc         int `json:"thp_fault_alloc"`
+	WorkingsetActivate    int `json:"workingset_activate"`
+	WorkingsetNodereclaim int `json:"workingset_nodereclaim"`
+	WorkingsetRefault     int `json:"workingset_refault"`
 }
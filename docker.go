@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	wcontainer "github.com/fjukstad/walrus/container"
+	"github.com/fjukstad/walrus/pipeline"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// Runs pipeline stages as Docker (or Podman) containers. Containers are named
+// after the pipeline, run and stage, and labeled so that walrus can find the
+// containers it created, e.g. to reuse a cached stage from a previous run.
+// The runtime is the container runtime the client talks to.
+type dockerExecutor struct {
+	client   *client.Client
+	runtime  string
+	rootpath string
+	runID    string
+	pipeline string
+
+	// The container of each stage that has run, or was found in the cache,
+	// in this run, and the stages whose image was pulled by Prepare.
+	mu         sync.Mutex
+	containers map[string]string
+	pulled     map[string]bool
+}
+
+func newDockerExecutor(c *client.Client, runtime, rootpath, runID string) *dockerExecutor {
+	return &dockerExecutor{
+		client:     c,
+		runtime:    runtime,
+		rootpath:   rootpath,
+		runID:      runID,
+		containers: make(map[string]string),
+		pulled:     make(map[string]bool),
+	}
+}
+
+func (d *dockerExecutor) Start(ctx context.Context, p *pipeline.Pipeline) error {
+	d.pipeline = p.Name
+
+	err := stopPreviousRun(d.client, p, d.rootpath)
+	if err != nil {
+		return err
+	}
+	return d.createPipelineNetwork(p)
+}
+
+func (d *dockerExecutor) Stop(ctx context.Context, p *pipeline.Pipeline) error {
+	return d.removePipelineNetwork(p)
+}
+
+// Pulls the stage image if it is not present on the host.
+func (d *dockerExecutor) Prepare(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage) error {
+	image := stageImage(stage)
+
+	images, err := d.client.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "Could not list images")
+	}
+
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if image == tag {
+				return nil
+			}
+		}
+	}
+
+	rc, err := d.client.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return errors.Wrap(err, "Could not pull image")
+	}
+	defer rc.Close()
+
+	_, err = ioutil.ReadAll(rc)
+	if err != nil {
+		return errors.Wrap(err, "error reading image pull")
+	}
+
+	d.mu.Lock()
+	d.pulled[stage.Name] = true
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *dockerExecutor) pulledImage(stage *pipeline.Stage) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pulled[stage.Name]
+}
+
+func (d *dockerExecutor) Run(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage, hostpath string) error {
+	c := d.client
+
+	d.removePreviousContainers(ctx, stage)
+
+	err := chownOutputDirectory(hostpath, stageUser(stage))
+	if err != nil {
+		return err
+	}
+
+	err = checkOwnership(hostpath, stageUser(stage))
+	if err != nil {
+		return err
+	}
+
+	// Only the stage's own output directory is writable. Output from upstream
+	// stages is mounted read-only.
+	binds := []string{hostpath + ":" + stageMountPath(stage)}
+	binds = append(binds, getInputVolumes(stage.Inputs, d.rootpath)...)
+	binds = append(binds, stage.Volumes...)
+
+	memory, err := stage.Resources.MemoryBytes()
+	if err != nil {
+		return errors.Wrap(err, "Invalid memory limit for stage "+stage.Name)
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds:       binds,
+		NetworkMode: container.NetworkMode(d.networkMode(stage)),
+		Resources: container.Resources{
+			NanoCPUs: int64(stage.Resources.CPUs * 1e9),
+			Memory:   memory,
+		},
+	}
+
+	err = applySecurity(stage, hostConfig)
+	if err != nil {
+		return err
+	}
+
+	applyRuntime(d.runtime, hostConfig)
+
+	resp, err := c.ContainerCreate(context.Background(),
+		&container.Config{Image: stageImage(stage),
+			Env:        stage.Env,
+			Cmd:        stage.Cmd,
+			Entrypoint: stage.Entrypoint,
+			User:       stageUser(stage),
+			Labels:     d.containerLabels(stage),
+		},
+		hostConfig,
+		&network.NetworkingConfig{},
+		nil,
+		d.containerName(stage))
+
+	if err != nil || resp.ID == " " {
+		return errors.Wrap(err, "Could not create container "+d.containerName(stage))
+	}
+	containerId := resp.ID
+
+	d.mu.Lock()
+	d.containers[stage.Name] = containerId
+	d.mu.Unlock()
+
+	numTries := 0
+
+	// Container statistics are collected for the profile and for the
+	// Prometheus metrics until the stage has completed. No samples are
+	// recorded once the profiler has stopped, so the resource usage of the
+	// stage can then be removed from the metrics.
+	m := metricsFrom(ctx)
+	sample := m.sampler(d.pipeline, d.runID, stage.Name)
+	if *profile || sample != nil {
+		opts := wcontainer.ProfileOptions{Interval: profileInterval, Sample: sample}
+		if *profile {
+			opts.Filename = hostpath + "/profile-" + stage.Name + ".jsonl"
+		}
+		profiler := wcontainer.StartProfile(c, containerId, opts)
+		defer func() {
+			summary, err := profiler.Stop()
+			m.forget(d.pipeline, d.runID, stage.Name)
+			if err != nil {
+				log.Println("Warning: Could not profile stage", stage.Name+":", err)
+			}
+			if *profile && summary != nil {
+				stage.Profile = &pipeline.ResourceUsage{
+					PeakMemory:     summary.PeakMemory,
+					MeanCPUPercent: summary.MeanCPUPercent,
+					MaxCPUPercent:  summary.MaxCPUPercent,
+					BlockRead:      summary.BlockRead,
+					BlockWrite:     summary.BlockWrite,
+					NetworkRx:      summary.NetworkRx,
+					NetworkTx:      summary.NetworkTx,
+				}
+			}
+		}()
+	}
+
+	for {
+		err = c.ContainerStart(context.Background(), containerId,
+			types.ContainerStartOptions{})
+		if err != nil {
+			log.Println("Warning: Could not start container", stage.Name, "retrying. Error:", err)
+			if numTries > 10 {
+				return errors.Wrap(err, "Could not start container "+stage.Name)
+			}
+			numTries += 1
+			stage.Retries = numTries
+			eventsFrom(ctx).emit(event{Type: eventStageRetry, Stage: stage.Name,
+				Image: stage.Image, Retries: numTries, Error: err.Error()})
+			time.Sleep(10 * time.Second)
+		} else {
+			break
+		}
+	}
+
+	okC, errC := c.ContainerWait(ctx, containerId,
+		container.WaitConditionNotRunning)
+	select {
+	case err := <-errC:
+		if err != nil {
+			// The stage timed out or the run was cancelled, the container
+			// is still running.
+			if ctx.Err() != nil {
+				c.ContainerKill(context.Background(), containerId, "9")
+				return errors.Wrap(ctx.Err(), "Stage "+stage.Name+" did not complete")
+			}
+			return errors.Wrap(err, "Failed to wait for container to finish")
+		}
+	case <-okC: // simply drain wait ok channel
+	}
+
+	return nil
+}
+
+// Returns the exit code of the stage container from this run or, for stages
+// that have not run yet, of the most recent container from a previous run
+// with the same configuration.
+func (d *dockerExecutor) ExitCode(ctx context.Context, stage *pipeline.Stage) (int, string, error) {
+	id, err := d.findContainer(ctx, stage)
+	if err != nil {
+		return 0, "", err
+	}
+	return exitCode(d.client, id)
+}
+
+func (d *dockerExecutor) Logs(ctx context.Context, stage *pipeline.Stage) (string, error) {
+	id, err := d.findContainer(ctx, stage)
+	if err != nil {
+		return "", err
+	}
+	return getLogs(d.client, id)
+}
+
+// Removes the containers of previous runs of the stage. These could have been
+// runs that the user does not wish to cache, or cached runs which output
+// directory has been deleted. We ignore any error message thrown.
+func (d *dockerExecutor) removePreviousContainers(ctx context.Context, stage *pipeline.Stage) {
+	previous, _ := d.listContainers(ctx, stage, false)
+	for _, prev := range previous {
+		d.client.ContainerRemove(context.Background(), prev.ID,
+			types.ContainerRemoveOptions{RemoveVolumes: true,
+				Force: true})
+	}
+}
+
+// Returns the ID of the container of a stage in this run. If the stage has
+// not run yet the container of a previous run with the same cache key is
+// used.
+func (d *dockerExecutor) findContainer(ctx context.Context, stage *pipeline.Stage) (string, error) {
+	d.mu.Lock()
+	id, ok := d.containers[stage.Name]
+	d.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	latest, err := d.latestContainer(ctx, stage)
+	if err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	d.containers[stage.Name] = latest.ID
+	d.mu.Unlock()
+	return latest.ID, nil
+}
+
+// Returns the most recent container of a previous run of the stage with the
+// same cache key.
+func (d *dockerExecutor) latestContainer(ctx context.Context, stage *pipeline.Stage) (types.Container, error) {
+	containers, err := d.listContainers(ctx, stage, true)
+	if err != nil {
+		return types.Container{}, errors.Wrap(err, "Could not list containers")
+	}
+	if len(containers) == 0 {
+		return types.Container{}, errors.New("Could not find a container for stage " + stage.Name)
+	}
+
+	latest := containers[0]
+	for _, container := range containers[1:] {
+		if container.Created > latest.Created {
+			latest = container
+		}
+	}
+	return latest, nil
+}
+
+// Returns the containers walrus created for a stage of the pipeline in this
+// output directory. If sameConfig is set only containers with the same cache
+// key as the stage are returned.
+func (d *dockerExecutor) listContainers(ctx context.Context, stage *pipeline.Stage, sameConfig bool) ([]types.Container, error) {
+	args := filters.NewArgs()
+	args.Add("label", labelPipeline+"="+d.pipeline)
+	args.Add("label", labelStage+"="+stage.Name)
+	args.Add("label", labelOutput+"="+d.rootpath)
+	if sameConfig {
+		args.Add("label", labelCacheKey+"="+stage.CacheKey())
+	}
+
+	return d.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: args,
+	})
+}
+
+// Labels on walrus containers. They identify the containers walrus created,
+// which pipeline, run, stage and output directory they belong to, the
+// configuration of the stage and the walrus version that created them.
+const (
+	labelPipeline = "walrus.pipeline"
+	labelStage    = "walrus.stage"
+	labelOutput   = "walrus.output"
+	labelRun      = "walrus.run"
+	labelCacheKey = "walrus.cache-key"
+	labelVersion  = "walrus.version"
+)
+
+func (d *dockerExecutor) containerLabels(stage *pipeline.Stage) map[string]string {
+	return map[string]string{
+		labelPipeline: d.pipeline,
+		labelStage:    stage.Name,
+		labelOutput:   d.rootpath,
+		labelRun:      d.runID,
+		labelCacheKey: stage.CacheKey(),
+		labelVersion:  version,
+	}
+}
+
+// Returns the name of the container running a stage in this run, e.g.
+// walrus-mypipeline-20180102-150405-stage. Characters that are not allowed in
+// container names are replaced.
+func (d *dockerExecutor) containerName(stage *pipeline.Stage) string {
+	name := "walrus-" + d.pipeline + "-" + d.runID + "-" + stage.Name
+	return invalidContainerNameChars.ReplaceAllString(name, "-")
+}
+
+var invalidContainerNameChars = regexp.MustCompile("[^a-zA-Z0-9_.-]")
+
+// Returns where the output directory of a stage is mounted in its container.
+// Parallel stages share the output directory of the original stage.
+func stageMountPath(stage *pipeline.Stage) string {
+	return "/walrus/" + strings.Split(stage.Name, "_")[0]
+}
+
+// Returns the image of a stage on the form repo:tag.
+func stageImage(stage *pipeline.Stage) string {
+	repo, tag := getRepoAndTag(stage.Image)
+	return repo + ":" + tag
+}
+
+func exitCode(c *client.Client, container string) (int, string, error) {
+	info, err := c.ContainerInspect(context.Background(), container)
+	if err != nil {
+		return 0, "", err
+	}
+	state := info.State
+	return state.ExitCode, state.Error, nil
+}
+
+func getLogs(c *client.Client, container string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reader, err := c.ContainerLogs(ctx, container, types.ContainerLogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	// Both Docker and Podman multiplex stdout and stderr into a single stream
+	// with a header in front of every frame. Strip the headers and interleave
+	// the two streams.
+	var b bytes.Buffer
+	_, err = stdcopy.StdCopy(&b, &b, reader)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Stops any previous run of the pipeline that wrote to the output directory
+// and deletes its containers. Containers of stages with caching enabled are
+// kept, since their exit codes etc. may be used in later pipeline runs. Runs
+// of other pipelines, or of the same pipeline with another output directory,
+// are left alone.
+func stopPreviousRun(c *client.Client, p *pipeline.Pipeline, rootpath string) error {
+	cached := make(map[string]bool)
+	for _, stage := range p.Stages {
+		cached[stage.Name] = stage.Cache
+	}
+
+	args := filters.NewArgs()
+	args.Add("label", labelPipeline+"="+p.Name)
+	args.Add("label", labelOutput+"="+rootpath)
+
+	containers, err := c.ContainerList(context.Background(),
+		types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return errors.Wrap(err, "Could not list containers")
+	}
+
+	for _, container := range containers {
+		if container.State == "running" {
+			err := c.ContainerKill(context.Background(), container.ID, "9")
+			if err != nil && !isNotFound(err) && !isNotRunning(err) {
+				return errors.Wrap(err, "Could not kill container "+container.ID)
+			}
+		}
+
+		if cached[container.Labels[labelStage]] {
+			continue
+		}
+
+		err = c.ContainerRemove(context.Background(), container.ID,
+			types.ContainerRemoveOptions{RemoveVolumes: true,
+				Force: true})
+		if err != nil && !isNotFound(err) {
+			return errors.Wrap(err, "Could not remove container "+container.ID)
+		}
+	}
+
+	return removePreviousNetworks(c, p, rootpath)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Types of events emitted during a pipeline run.
+const (
+	eventPipelineStarted  = "pipeline_started"
+	eventStageQueued      = "stage_queued"
+	eventImagePulled      = "image_pulled"
+	eventStageStarted     = "stage_started"
+	eventStageCached      = "stage_cached"
+	eventStageRetry       = "stage_retry"
+	eventStageFinished    = "stage_finished"
+	eventPipelineFinished = "pipeline_finished"
+)
+
+// An event in a pipeline run. Duration is the time spent pulling the image for
+// image_pulled, and the runtime of the stage or pipeline for stage_finished and
+// pipeline_finished. Status is succeeded or failed for the finished events.
+type event struct {
+	Time     time.Time
+	Type     string
+	Run      string
+	Pipeline string
+	Stage    string        `json:",omitempty"`
+	Image    string        `json:",omitempty"`
+	Inputs   []string      `json:",omitempty"`
+	Status   string        `json:",omitempty"`
+	ExitCode *int          `json:",omitempty"`
+	Duration time.Duration `json:",omitempty"`
+	Retries  int           `json:",omitempty"`
+	Cached   bool          `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+}
+
+// The stream of events of a pipeline run. Listeners are called in the order
+// the events are emitted, one event at a time.
+type eventStream struct {
+	run      string
+	pipeline string
+
+	mu        sync.Mutex
+	listeners []func(event)
+}
+
+func newEventStream(run, pipeline string) *eventStream {
+	return &eventStream{run: run, pipeline: pipeline}
+}
+
+// Adds a listener that is called with every event emitted after it was added.
+func (s *eventStream) listen(listener func(event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// Writes every event as a line of JSON to w.
+func (s *eventStream) writeTo(w io.Writer) {
+	encoder := json.NewEncoder(w)
+	s.listen(func(ev event) {
+		err := encoder.Encode(ev)
+		if err != nil {
+			log.Println("Warning: Could not write event:", err)
+		}
+	})
+}
+
+// Timestamps an event and passes it on to the listeners. Emitting events on a
+// nil stream does nothing, so code that runs both within and outside of a
+// pipeline run does not need to check for one.
+func (s *eventStream) emit(ev event) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ev.Time = time.Now()
+	ev.Run = s.run
+	ev.Pipeline = s.pipeline
+	for _, listener := range s.listeners {
+		listener(ev)
+	}
+}
+
+type eventsKey struct{}
+
+// Returns a context that carries the event stream, so that executors can emit
+// events while they run a stage.
+func withEvents(ctx context.Context, s *eventStream) context.Context {
+	return context.WithValue(ctx, eventsKey{}, s)
+}
+
+// Returns the event stream carried by the context, or nil.
+func eventsFrom(ctx context.Context) *eventStream {
+	s, _ := ctx.Value(eventsKey{}).(*eventStream)
+	return s
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+// Returns the events written as JSON lines.
+func readEvents(t *testing.T, b *bytes.Buffer) []event {
+	t.Helper()
+
+	var events []event
+	scanner := bufio.NewScanner(b)
+	for scanner.Scan() {
+		ev := event{}
+		err := json.Unmarshal(scanner.Bytes(), &ev)
+		if err != nil {
+			t.Fatalf("Event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestEventStream(t *testing.T) {
+	s := newEventStream("run1", "p")
+	var b bytes.Buffer
+	s.writeTo(&b)
+
+	var received []string
+	s.listen(func(ev event) { received = append(received, ev.Type) })
+
+	exitCode := 0
+	s.emit(event{Type: eventStageFinished, Stage: "a", Status: statusSucceeded,
+		ExitCode: &exitCode})
+	s.emit(event{Type: eventPipelineFinished, Status: statusSucceeded})
+
+	events := readEvents(t, &b)
+	if len(events) != 2 {
+		t.Fatalf("%d events were written", len(events))
+	}
+	for _, ev := range events {
+		if ev.Run != "run1" || ev.Pipeline != "p" || ev.Time.IsZero() {
+			t.Errorf("Event %s has run %q, pipeline %q and time %v", ev.Type,
+				ev.Run, ev.Pipeline, ev.Time)
+		}
+	}
+	if events[0].ExitCode == nil || *events[0].ExitCode != 0 {
+		t.Error("The exit code 0 of a stage is not written")
+	}
+	if events[1].ExitCode != nil || events[1].Stage != "" {
+		t.Errorf("Pipeline event has exit code %v and stage %q", events[1].ExitCode,
+			events[1].Stage)
+	}
+	if len(received) != 2 || received[0] != eventStageFinished {
+		t.Errorf("Listener received %v", received)
+	}
+
+	// Emitting on a missing stream does nothing.
+	var missing *eventStream
+	missing.emit(event{Type: eventPipelineStarted})
+	if eventsFrom(context.Background()) != nil {
+		t.Error("A context without events has an event stream")
+	}
+	if eventsFrom(withEvents(context.Background(), s)) != s {
+		t.Error("The event stream is not carried by the context")
+	}
+}
+
+func TestRunEvents(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{
+		{Name: "a", Cmd: []string{"true"}},
+		{Name: "b", Cmd: []string{"false"}, Inputs: []string{"a"}},
+	}}
+	state, err := newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	state.events.writeTo(&b)
+
+	r, err := newRunner(executorLocal, executorConfig{RunID: "run1"}, hostpath, p, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.run(context.Background())
+	if err == nil {
+		t.Fatal("Run with a failing stage did not fail")
+	}
+	state.finish(err)
+
+	events := readEvents(t, &b)
+	if len(events) == 0 {
+		t.Fatal("No events were written")
+	}
+	if first := events[0]; first.Type != eventPipelineStarted {
+		t.Errorf("The first event is %s", first.Type)
+	}
+	if last := events[len(events)-1]; last.Type != eventPipelineFinished ||
+		last.Status != statusFailed || last.Error == "" {
+		t.Errorf("The last event is %s %s %q", last.Type, last.Status, last.Error)
+	}
+
+	// Every stage is queued, started and finished in that order.
+	order := map[string][]string{}
+	finished := map[string]event{}
+	for _, ev := range events {
+		if ev.Stage == "" {
+			continue
+		}
+		order[ev.Stage] = append(order[ev.Stage], ev.Type)
+		if ev.Type == eventStageFinished {
+			finished[ev.Stage] = ev
+		}
+	}
+	for _, stage := range []string{"a", "b"} {
+		types := order[stage]
+		if len(types) < 3 || types[0] != eventStageQueued ||
+			types[len(types)-2] != eventStageStarted ||
+			types[len(types)-1] != eventStageFinished {
+			t.Errorf("Events of stage %s are %v", stage, types)
+		}
+	}
+
+	if a := finished["a"]; a.Status != statusSucceeded || a.ExitCode == nil || *a.ExitCode != 0 {
+		t.Errorf("Stage a finished with %s and exit code %v", a.Status, a.ExitCode)
+	}
+	if b := finished["b"]; b.Status != statusFailed || b.ExitCode == nil || *b.ExitCode != 1 {
+		t.Errorf("Stage b finished with %s and exit code %v", b.Status, b.ExitCode)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+)
+
+// An executor runs pipeline stages on some compute resource, e.g. as Docker
+// containers or as processes on the host. The scheduling of stages, caching
+// and writing of logs is the same for all executors.
+type executor interface {
+	// Start prepares the executor for running the pipeline, e.g. by cleaning
+	// up after a previous run. It is called once before any stage runs.
+	Start(ctx context.Context, p *pipeline.Pipeline) error
+
+	// Stop releases any resources the executor set up for the pipeline. It
+	// is called once after all stages have completed.
+	Stop(ctx context.Context, p *pipeline.Pipeline) error
+
+	// Prepare readies a stage for running while it waits for its inputs,
+	// e.g. by pulling its image.
+	Prepare(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage) error
+
+	// Run runs the stage and blocks until it has completed. The stage writes
+	// its output to hostpath. Run returns an error if the stage could not be
+	// run or did not complete before ctx is done. A non-zero exit code is
+	// not an error, use ExitCode to check how the stage completed.
+	Run(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage, hostpath string) error
+
+	// ExitCode returns the exit code and any error message of the last run
+	// of the stage. It returns an error if the stage has never been run.
+	ExitCode(ctx context.Context, stage *pipeline.Stage) (int, string, error)
+
+	// Logs returns the output of the last run of the stage.
+	Logs(ctx context.Context, stage *pipeline.Stage) (string, error)
+}
+
+// Implemented by executors that pull stage images when preparing stages.
+type imagePuller interface {
+	// pulledImage returns true if preparing the stage pulled its image,
+	// and false if the image was already there.
+	pulledImage(stage *pipeline.Stage) bool
+}
+
+// Implemented by executors whose stages write their output somewhere else than
+// to the output directory on the host running walrus, e.g. to a volume in a
+// cluster.
+type remoteOutputExecutor interface {
+	// hasOutput returns true if the output of the last run of the stage is
+	// still there, so that a cached stage can use it.
+	hasOutput(ctx context.Context, stage *pipeline.Stage) bool
+
+	// writeLogs writes the logs of the stage next to its output.
+	writeLogs(ctx context.Context, stage *pipeline.Stage, logs string) error
+}
+
+// Executors walrus can run pipelines with.
+const (
+	executorDocker     = "docker"
+	executorLocal      = "local"
+	executorKubernetes = "kubernetes"
+	executorSlurm      = "slurm"
+)
+
+// Executor specific settings, set from the command line.
+type executorConfig struct {
+	// ID of the pipeline run the executor runs stages for.
+	RunID string
+
+	// Container runtime and API address for the docker executor, or a
+	// configuration file listing a pool of Docker hosts.
+	Runtime string
+	Host    string
+	Hosts   string
+
+	// Cluster, namespace and shared volume claim for the kubernetes
+	// executor.
+	Kubeconfig string
+	Namespace  string
+	Claim      string
+	ClaimMount string
+
+	// Container runtime on the compute nodes and partition to submit jobs
+	// to for the slurm executor.
+	SlurmRuntime   string
+	SlurmPartition string
+}
+
+// Returns the executor with the given name.
+func newExecutor(name, rootpath string, config executorConfig) (executor, error) {
+	switch name {
+	case executorDocker:
+		if config.Hosts != "" {
+			return newPoolExecutor(config.Hosts, config.Runtime, rootpath,
+				config.RunID)
+		}
+		c, err := newClient(config.Runtime, config.Host)
+		if err != nil {
+			return nil, err
+		}
+		return newDockerExecutor(c, config.Runtime, rootpath, config.RunID), nil
+	case executorLocal:
+		return &localExecutor{rootpath: rootpath}, nil
+	case executorKubernetes:
+		client, err := newKubernetesClient(config.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		return newKubernetesExecutor(client, config.Namespace, config.Claim,
+			config.ClaimMount, rootpath, config.RunID), nil
+	case executorSlurm:
+		return newSlurmExecutor(rootpath, config.SlurmRuntime,
+			config.SlurmPartition)
+	default:
+		return nil, errors.New("Unknown executor " + name)
+	}
+}
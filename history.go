@@ -0,0 +1,549 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+)
+
+// What a pipeline run ran and the files it produced. A record is kept for
+// every run in the walrus configuration directory, so that runs can be
+// compared after later runs have overwritten the output directory.
+type runRecord struct {
+	Pipeline *pipeline.Pipeline
+
+	// Files in the output directory of every stage, by stage name. Parallel
+	// stages share the output directory of the original stage.
+	Outputs map[string][]outputFile
+}
+
+// A file in the output directory of a stage, relative to the directory, and
+// the SHA-256 checksum of its contents. Files in the output of stages that did
+// not complete have no checksum.
+type outputFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	SHA256  string `json:",omitempty"`
+}
+
+// Returns the directory where the records of all pipeline runs are kept.
+func historyPath(hostpath string) string {
+	return filepath.Join(createConfigPath(hostpath), "history")
+}
+
+// Records the pipeline a run ran, with the runtime and version of its stages,
+// and lists the files in the output directories of the stages. Only the output
+// of completed stages is checksummed, since the output of stages that failed or
+// were still running when the run ended may be partial. Files that have the
+// same size and modification time as in the previous run keep the checksum
+// they had then, so that the output of cached stages is not read again.
+func saveRunRecord(hostpath, id string, p *pipeline.Pipeline, completed map[string]bool) error {
+	record := runRecord{Pipeline: p, Outputs: make(map[string][]outputFile)}
+	previous := previousOutputs(hostpath, id)
+
+	// Parallel stages share an output directory, which is only complete
+	// once all of them have completed.
+	complete := make(map[string]bool)
+	for _, stage := range p.Stages {
+		name := strings.Split(stage.Name, "_")[0]
+		done, ok := complete[name]
+		complete[name] = (done || !ok) && completed[stage.Name]
+	}
+
+	for _, stage := range p.Stages {
+		name := strings.Split(stage.Name, "_")[0]
+		if _, ok := record.Outputs[name]; ok {
+			continue
+		}
+
+		files := []outputFile{}
+		dir := filepath.Join(hostpath, name)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+
+			file := outputFile{Path: filepath.ToSlash(rel), Size: info.Size(),
+				ModTime: info.ModTime()}
+			if !complete[name] {
+				files = append(files, file)
+				return nil
+			}
+			if old, ok := previous[name+"/"+file.Path]; ok && old.Size == file.Size &&
+				old.ModTime.Equal(file.ModTime) && old.SHA256 != "" {
+				file.SHA256 = old.SHA256
+			} else {
+				file.SHA256, err = checksum(path)
+				if err != nil {
+					return err
+				}
+			}
+			files = append(files, file)
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "Could not list output of stage "+name)
+		}
+		record.Outputs[name] = files
+	}
+
+	err := os.MkdirAll(historyPath(hostpath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Could not create history directory")
+	}
+
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(historyPath(hostpath), id+".json"), b, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Could not write run record")
+	}
+	return nil
+}
+
+// Returns the output files in the most recent record of a run, or of an
+// earlier run if the run has not been recorded yet, by stage and path.
+func previousOutputs(hostpath, id string) map[string]outputFile {
+	files := make(map[string]outputFile)
+
+	ids, err := runIDs(hostpath)
+	if err != nil {
+		return files
+	}
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		if ids[i] > id {
+			continue
+		}
+		record, err := readRunRecord(hostpath, ids[i])
+		if err != nil {
+			continue
+		}
+		for stage, stageFiles := range record.Outputs {
+			for _, file := range stageFiles {
+				files[stage+"/"+file.Path] = file
+			}
+		}
+		break
+	}
+	return files
+}
+
+// Returns the SHA-256 checksum of a file.
+func checksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Reads the record of a pipeline run.
+func readRunRecord(hostpath, id string) (*runRecord, error) {
+	b, err := ioutil.ReadFile(filepath.Join(historyPath(hostpath), id+".json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read record of run "+id)
+	}
+
+	record := &runRecord{}
+	err = json.Unmarshal(b, record)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse record of run "+id)
+	}
+	return record, nil
+}
+
+// A pipeline run in the history, identified by its output directory and ID.
+// Link is the address of the visualization of the run, if it has one.
+type historyEntry struct {
+	hostpath string
+	id       string
+	link     string
+}
+
+// Returns the runs in an output directory, oldest first.
+func outputHistory(hostpath string) func() ([]historyEntry, error) {
+	return func() ([]historyEntry, error) {
+		ids, err := runIDs(hostpath)
+		if err != nil {
+			return nil, err
+		}
+
+		var entries []historyEntry
+		for _, id := range ids {
+			entries = append(entries, historyEntry{hostpath: hostpath, id: id})
+		}
+		return entries, nil
+	}
+}
+
+// The runs in the history and the stages of every run.
+type historySummary struct {
+	Runs   []historyRun
+	Stages []historyStage
+}
+
+type historyRun struct {
+	ID       string
+	Pipeline string
+	Status   string
+	Start    time.Time
+	End      time.Time
+	Version  string
+	Link     string `json:",omitempty"`
+
+	// Set if the pipeline the run ran has been recorded. Only recorded runs
+	// can be compared.
+	Recorded bool
+}
+
+// A stage and how it ran in every run of the history, by run ID.
+type historyStage struct {
+	Name string
+	Runs map[string]historyStageRun
+}
+
+type historyStageRun struct {
+	Status  string
+	Runtime time.Duration
+	Cached  bool
+	Image   string `json:",omitempty"`
+	Version string `json:",omitempty"`
+}
+
+// The differences between two pipeline runs.
+type runDiff struct {
+	A, B       string
+	Parameters []parameterDiff
+	Outputs    []outputDiff
+}
+
+// A stage parameter, or pipeline variable if Stage is empty, that differs
+// between two runs.
+type parameterDiff struct {
+	Stage     string
+	Parameter string
+	A, B      string
+}
+
+// A file in the output of either of two runs. The size is nil if the file is
+// not in the output of the run. The file has changed if it is only in one of
+// the runs, or its size or checksum differs. Runs recorded without checksums
+// are compared by size only.
+type outputDiff struct {
+	Stage   string
+	Path    string
+	A, B    *int64
+	Changed bool
+}
+
+// Serves the history of pipeline runs:
+//
+//	GET /api/history               the runs and how every stage ran in them
+//	GET /api/history/diff?a=ID&b=ID  parameters and output files of two runs
+type historyAPI struct {
+	entries func() ([]historyEntry, error)
+}
+
+func (h *historyAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, err := h.entries()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch strings.Trim(req.URL.Path, "/") {
+	case "":
+		writeJSON(w, summarizeHistory(entries))
+	case "diff":
+		a, b := req.URL.Query().Get("a"), req.URL.Query().Get("b")
+		diff, err := diffRuns(entries, a, b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, diff)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Reads the state and record of every run in the history. Runs without a
+// readable state are left out.
+func summarizeHistory(entries []historyEntry) historySummary {
+	summary := historySummary{Runs: []historyRun{}, Stages: []historyStage{}}
+	stages := make(map[string]*historyStage)
+	var names []string
+
+	for _, entry := range entries {
+		state, err := readRunState(entry.hostpath, entry.id)
+		if err != nil {
+			continue
+		}
+		record, _ := readRunRecord(entry.hostpath, entry.id)
+
+		run := historyRun{
+			ID:       state.ID,
+			Pipeline: state.Pipeline,
+			Status:   state.Status,
+			Start:    state.Start,
+			End:      state.End,
+			Link:     entry.link,
+			Recorded: record != nil,
+		}
+
+		recorded := make(map[string]*pipeline.Stage)
+		if record != nil {
+			run.Version = record.Pipeline.Version
+			for _, stage := range record.Pipeline.Stages {
+				recorded[stage.Name] = stage
+			}
+		}
+		summary.Runs = append(summary.Runs, run)
+
+		for _, s := range state.Stages {
+			stage, ok := stages[s.Name]
+			if !ok {
+				stage = &historyStage{Name: s.Name, Runs: make(map[string]historyStageRun)}
+				stages[s.Name] = stage
+				names = append(names, s.Name)
+			}
+
+			stageRun := historyStageRun{
+				Status:  s.Status,
+				Runtime: s.Runtime,
+				Cached:  s.Cached,
+			}
+			if r, ok := recorded[s.Name]; ok {
+				stageRun.Image = r.Image
+				stageRun.Version = r.Version
+			}
+			stage.Runs[state.ID] = stageRun
+		}
+	}
+
+	for _, name := range names {
+		summary.Stages = append(summary.Stages, *stages[name])
+	}
+	return summary
+}
+
+// Compares the parameters and output files of two recorded runs.
+func diffRuns(entries []historyEntry, a, b string) (*runDiff, error) {
+	var recordA, recordB *runRecord
+	for _, entry := range entries {
+		if entry.id != a && entry.id != b {
+			continue
+		}
+		record, err := readRunRecord(entry.hostpath, entry.id)
+		if err != nil {
+			return nil, errors.New("Run " + entry.id +
+				" has not been recorded, only runs by this version of walrus can be compared")
+		}
+		if entry.id == a {
+			recordA = record
+		}
+		if entry.id == b {
+			recordB = record
+		}
+	}
+	if recordA == nil {
+		return nil, errors.New("No run with ID " + a)
+	}
+	if recordB == nil {
+		return nil, errors.New("No run with ID " + b)
+	}
+
+	return &runDiff{
+		A:          a,
+		B:          b,
+		Parameters: diffParameters(recordA.Pipeline, recordB.Pipeline),
+		Outputs:    diffOutputs(recordA.Outputs, recordB.Outputs),
+	}, nil
+}
+
+// Returns the pipeline variables and the stage images, entrypoints, commands
+// and environment variables that differ between two pipelines.
+func diffParameters(a, b *pipeline.Pipeline) []parameterDiff {
+	diffs := []parameterDiff{}
+	add := func(stage, parameter, valueA, valueB string) {
+		if valueA != valueB {
+			diffs = append(diffs, parameterDiff{stage, parameter, valueA, valueB})
+		}
+	}
+
+	variablesA, variablesB := make(map[string]string), make(map[string]string)
+	for _, v := range a.Variables {
+		variablesA[v.Name] = strings.Join(v.Values, ", ")
+	}
+	for _, v := range b.Variables {
+		variablesB[v.Name] = strings.Join(v.Values, ", ")
+	}
+	for _, name := range unionKeys(variablesA, variablesB) {
+		add("", "Variable "+name, variablesA[name], variablesB[name])
+	}
+
+	stagesA, stagesB := make(map[string]*pipeline.Stage), make(map[string]*pipeline.Stage)
+	var names []string
+	for _, stage := range a.Stages {
+		stagesA[stage.Name] = stage
+		names = append(names, stage.Name)
+	}
+	for _, stage := range b.Stages {
+		stagesB[stage.Name] = stage
+		if stagesA[stage.Name] == nil {
+			names = append(names, stage.Name)
+		}
+	}
+
+	for _, name := range names {
+		stageA, stageB := stagesA[name], stagesB[name]
+		if stageA == nil || stageB == nil {
+			add(name, "Stage", present(stageA != nil), present(stageB != nil))
+			continue
+		}
+
+		add(name, "Image", stageA.Image, stageB.Image)
+		add(name, "Entrypoint", strings.Join(stageA.Entrypoint, " "),
+			strings.Join(stageB.Entrypoint, " "))
+		add(name, "Cmd", strings.Join(stageA.Cmd, " "), strings.Join(stageB.Cmd, " "))
+
+		envA, envB := environment(stageA.Env), environment(stageB.Env)
+		for _, key := range unionKeys(envA, envB) {
+			add(name, "Env "+key, envA[key], envB[key])
+		}
+	}
+	return diffs
+}
+
+// Returns the output files of two runs side by side, by stage and path.
+func diffOutputs(a, b map[string][]outputFile) []outputDiff {
+	type key struct{ stage, path string }
+	files := make(map[key]*outputDiff)
+	checksums := make(map[key][2]string)
+	var keys []key
+
+	for i, outputs := range []map[string][]outputFile{a, b} {
+		for stage, stageFiles := range outputs {
+			for _, file := range stageFiles {
+				k := key{stage, file.Path}
+				diff, ok := files[k]
+				if !ok {
+					diff = &outputDiff{Stage: stage, Path: file.Path}
+					files[k] = diff
+					keys = append(keys, k)
+				}
+				size := file.Size
+				if i == 0 {
+					diff.A = &size
+				} else {
+					diff.B = &size
+				}
+				sums := checksums[k]
+				sums[i] = file.SHA256
+				checksums[k] = sums
+			}
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stage != keys[j].stage {
+			return keys[i].stage < keys[j].stage
+		}
+		return keys[i].path < keys[j].path
+	})
+
+	diffs := []outputDiff{}
+	for _, k := range keys {
+		diff := files[k]
+		sums := checksums[k]
+		diff.Changed = diff.A == nil || diff.B == nil || *diff.A != *diff.B ||
+			(sums[0] != "" && sums[1] != "" && sums[0] != sums[1])
+		diffs = append(diffs, *diff)
+	}
+	return diffs
+}
+
+// Returns environment variables on the form NAME=VALUE by name.
+func environment(env []string) map[string]string {
+	vars := make(map[string]string, len(env))
+	for _, v := range env {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			vars[kv[0]] = kv[1]
+		} else {
+			vars[kv[0]] = ""
+		}
+	}
+	return vars
+}
+
+// Returns the keys of both maps, sorted.
+func unionKeys(a, b map[string]string) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func present(ok bool) string {
+	if ok {
+		return "present"
+	}
+	return "missing"
+}
+
+// Serves the page comparing the runs in the history.
+func serveHistoryPage(w http.ResponseWriter, req *http.Request) {
+	b, err := assets.ReadFile("assets/history.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+func TestOutputDiffComparesContents(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{{Name: "a"}}}
+	dir := filepath.Join(hostpath, "a")
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, contents string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("same", "unchanged")
+	write("edited", "apple")
+	for _, id := range []string{"run1", "run2"} {
+		if id == "run2" {
+			// The same size, but different contents.
+			write("edited", "mango")
+		}
+		_, err = newRunState(hostpath, id, executorLocal, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = saveRunRecord(hostpath, id, p, map[string]bool{"a": true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := readRunRecord(hostpath, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readRunRecord(hostpath, "run2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(map[string]bool)
+	for _, diff := range diffOutputs(a.Outputs, b.Outputs) {
+		changed[diff.Path] = diff.Changed
+	}
+	if !changed["edited"] {
+		t.Error("A file with the same size and new contents is not marked as changed")
+	}
+	if changed["same"] {
+		t.Error("An unchanged file is marked as changed")
+	}
+}
+
+func TestRunRecordChecksumsCompletedStages(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{
+		{Name: "a"}, {Name: "b_parallel_1"}, {Name: "b_parallel_2"}, {Name: "c"}}}
+	for _, name := range []string{"a", "b", "c"} {
+		err := os.Mkdir(filepath.Join(hostpath, name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(hostpath, name, "out"), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One of the parallel stages and stage c were still running when the
+	// run ended.
+	_, err = newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveRunRecord(hostpath, "run1", p, map[string]bool{"a": true, "b_parallel_1": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := readRunRecord(hostpath, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, checksummed := range map[string]bool{"a": true, "b": false, "c": false} {
+		files := record.Outputs[name]
+		if len(files) != 1 {
+			t.Errorf("Output of stage %s is %v", name, files)
+			continue
+		}
+		if (files[0].SHA256 != "") != checksummed {
+			t.Errorf("Output of stage %s has checksum %q", name, files[0].SHA256)
+		}
+	}
+}
+
+func TestRunRecordOfFailedRun(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{
+		{Name: "a", Cmd: []string{"sh", "-c", "echo a > $1", "sh", "/walrus/a/out"}},
+		{Name: "b", Cmd: []string{"false"}, Inputs: []string{"a"}},
+	}}
+	state, err := newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRunner(executorLocal, executorConfig{RunID: "run1"}, hostpath, p, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.run(context.Background())
+	if err == nil {
+		t.Fatal("Run with a failing stage did not fail")
+	}
+
+	record, err := readRunRecord(hostpath, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := record.Outputs["a"]
+	if len(files) == 0 {
+		t.Fatalf("The output of stage a is not recorded: %v", record.Outputs)
+	}
+	for _, file := range files {
+		if file.SHA256 != "" {
+			t.Errorf("Output %s of the failed run has checksum %s", file.Path, file.SHA256)
+		}
+	}
+}
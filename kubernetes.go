@@ -0,0 +1,770 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// How often the kubernetes executor checks if a job has completed.
+var jobPollInterval = 2 * time.Second
+
+// Runs pipeline stages as Kubernetes jobs. All jobs mount the same persistent
+// volume claim at /walrus. As with the docker executor a stage can only write
+// to its own output directory on the volume, and the output directories of
+// its inputs are mounted read-only. The output directories of a run are in
+// PIPELINE/RUN on the volume, so that runs do not overwrite each other.
+//
+// Jobs are named after the pipeline, run and stage, and labeled like the
+// containers of the docker executor so that a cached stage can use the job
+// and output of a previous run. If the claim is mounted on the host running
+// walrus at claimMount, the logs of the stages are also written to their
+// output directories on the volume.
+//
+// Pods always have the network of the cluster, so stages with network
+// settings are rejected. Stages that do not set a user run as the user of the
+// image, so a policy that forbids root makes Kubernetes refuse to run them as
+// root.
+type kubernetesExecutor struct {
+	client     kubernetes.Interface
+	namespace  string
+	claim      string
+	claimMount string
+	rootpath   string
+	runID      string
+	pipeline   string
+	policy     pipeline.Policy
+
+	// The job of each stage that has run, or was found in the cache, in
+	// this run.
+	mu   sync.Mutex
+	jobs map[string]*batchv1.Job
+}
+
+func newKubernetesExecutor(client kubernetes.Interface, namespace, claim, claimMount, rootpath, runID string) *kubernetesExecutor {
+	return &kubernetesExecutor{
+		client:     client,
+		namespace:  namespace,
+		claim:      claim,
+		claimMount: claimMount,
+		rootpath:   rootpath,
+		runID:      runID,
+		jobs:       make(map[string]*batchv1.Job),
+	}
+}
+
+// Creates a client for the cluster in the given kubeconfig. If no kubeconfig
+// is given it uses $KUBECONFIG or ~/.kube/config, and falls back to the
+// in-cluster configuration when walrus itself runs in a pod.
+func newKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	if kubeconfig == "" {
+		kubeconfig = os.Getenv("KUBECONFIG")
+	}
+	if kubeconfig == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			filename := filepath.Join(home, ".kube", "config")
+			if _, err := os.Stat(filename); err == nil {
+				kubeconfig = filename
+			}
+		}
+	}
+
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not load Kubernetes configuration")
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create Kubernetes client")
+	}
+
+	return clientset, nil
+}
+
+// Labels on walrus jobs, in addition to the labels they share with walrus
+// containers. Label values are limited to 63 characters, so the output
+// directory and cache key are shortened.
+const labelOutputHash = "walrus.output-hash"
+
+// Annotation with the directory on the volume a job writes its output to.
+const annotationOutputPath = "walrus.output-path"
+
+// Stops the jobs of a previous run of the pipeline in the same output
+// directory that are still running. Completed jobs are kept since they are
+// used to decide if a stage can be cached.
+func (k *kubernetesExecutor) Start(ctx context.Context, p *pipeline.Pipeline) error {
+	k.pipeline = p.Name
+	k.policy = p.Policy
+
+	for _, stage := range p.Stages {
+		err := checkKubernetesStage(stage)
+		if err != nil {
+			return err
+		}
+	}
+
+	jobs, err := k.client.BatchV1().Jobs(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelPipeline + "=" + labelValue(k.pipeline) + "," +
+			labelOutputHash + "=" + k.outputHash(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not list jobs of previous runs")
+	}
+	for _, job := range jobs.Items {
+		if job.Status.Active > 0 {
+			err := k.deleteJob(ctx, job.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (k *kubernetesExecutor) Stop(ctx context.Context, p *pipeline.Pipeline) error {
+	return nil
+}
+
+// Images are pulled by the cluster nodes when the job starts.
+func (k *kubernetesExecutor) Prepare(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage) error {
+	return nil
+}
+
+func (k *kubernetesExecutor) Run(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage, hostpath string) error {
+	name := k.jobName(stage)
+
+	// A job of the stage is left behind if walrus was stopped while it ran
+	// and the run is resumed.
+	err := k.deleteJob(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	job, err := k.job(stage)
+	if err != nil {
+		return err
+	}
+
+	job, err = k.client.BatchV1().Jobs(k.namespace).Create(ctx, job,
+		metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "Could not create job for stage "+stage.Name)
+	}
+
+	k.mu.Lock()
+	k.jobs[stage.Name] = job
+	k.mu.Unlock()
+
+	// The logs are written to walrus.log while the stage runs. They are
+	// written again once the stage has completed, so the follower is
+	// stopped along with the job.
+	followCtx, stopFollowing := context.WithCancel(ctx)
+	following := make(chan error, 1)
+	go func() {
+		following <- k.followLogs(followCtx, stage, job, hostpath)
+	}()
+	defer func() {
+		stopFollowing()
+		err := <-following
+		if err != nil && followCtx.Err() == nil {
+			log.Println("Warning: Could not follow logs of stage", stage.Name+":", err)
+		}
+	}()
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := k.client.BatchV1().Jobs(k.namespace).Get(ctx, name,
+			metav1.GetOptions{})
+		if err != nil && ctx.Err() == nil {
+			return errors.Wrap(err, "Could not get job for stage "+stage.Name)
+		}
+		if err == nil && (job.Status.Succeeded > 0 || job.Status.Failed > 0) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			// The stage timed out or the run was cancelled. Delete the
+			// job so that its pod is stopped.
+			k.deleteJob(context.Background(), name)
+			return errors.Wrap(ctx.Err(), "Stage "+stage.Name+" did not complete")
+		case <-ticker.C:
+		}
+	}
+}
+
+// Streams the logs of the stage container to walrus.log in the output
+// directory of the stage once the container has started, until it stops or
+// the context is cancelled.
+func (k *kubernetesExecutor) followLogs(ctx context.Context, stage *pipeline.Stage, job *batchv1.Job, hostpath string) error {
+	var pod *corev1.Pod
+	for pod == nil {
+		latest, err := k.pod(ctx, stage, job)
+		if err == nil && containerStarted(latest) {
+			pod = latest
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+	}
+
+	err := os.MkdirAll(hostpath, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(hostpath, "walrus.log"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stream, err := k.client.CoreV1().Pods(k.namespace).GetLogs(pod.Name,
+		&corev1.PodLogOptions{Follow: true}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_, err = io.Copy(f, stream)
+	return err
+}
+
+// Returns true if the containers of a pod have started, so that there are
+// logs to follow.
+func containerStarted(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running != nil || status.State.Terminated != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the exit code of the stage container in the most recent pod of the
+// stage's job. Pods may have been garbage collected after the job completed,
+// in which case the job status is used.
+func (k *kubernetesExecutor) ExitCode(ctx context.Context, stage *pipeline.Stage) (int, string, error) {
+	job, err := k.findJob(ctx, stage)
+	if err != nil {
+		return 0, "", err
+	}
+
+	pod, err := k.pod(ctx, stage, job)
+	if err == nil {
+		for _, status := range pod.Status.ContainerStatuses {
+			if terminated := status.State.Terminated; terminated != nil {
+				return int(terminated.ExitCode), terminated.Message, nil
+			}
+		}
+	}
+
+	if job.Status.Succeeded > 0 {
+		return 0, "", nil
+	}
+	if job.Status.Failed > 0 {
+		return 1, "Job " + job.Name + " failed", nil
+	}
+	return 0, "", errors.New("Job " + job.Name + " has not completed")
+}
+
+func (k *kubernetesExecutor) Logs(ctx context.Context, stage *pipeline.Stage) (string, error) {
+	job, err := k.findJob(ctx, stage)
+	if err != nil {
+		return "", err
+	}
+
+	pod, err := k.pod(ctx, stage, job)
+	if err != nil {
+		return "", err
+	}
+
+	stream, err := k.client.CoreV1().Pods(k.namespace).GetLogs(pod.Name,
+		&corev1.PodLogOptions{}).Stream(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not get logs for stage "+stage.Name)
+	}
+	defer stream.Close()
+
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not read logs for stage "+stage.Name)
+	}
+	return string(b), nil
+}
+
+// Returns the job of a stage in this run. If the stage has not run yet the
+// most recent job of a previous run in the same output directory with the same
+// cache key is used, and dependent stages read its output.
+func (k *kubernetesExecutor) findJob(ctx context.Context, stage *pipeline.Stage) (*batchv1.Job, error) {
+	k.mu.Lock()
+	job, ok := k.jobs[stage.Name]
+	k.mu.Unlock()
+	if ok {
+		// Get the current status of the job.
+		job, err := k.client.BatchV1().Jobs(k.namespace).Get(ctx, job.Name,
+			metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not get job for stage "+stage.Name)
+		}
+		return job, nil
+	}
+
+	jobs, err := k.client.BatchV1().Jobs(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelPipeline + "=" + labelValue(k.pipeline) + "," +
+			labelStage + "=" + labelValue(stage.Name) + "," +
+			labelOutputHash + "=" + k.outputHash() + "," +
+			labelCacheKey + "=" + cacheKeyLabel(stage),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list jobs for stage "+stage.Name)
+	}
+	if len(jobs.Items) == 0 {
+		return nil, errors.New("Could not find a job for stage " + stage.Name)
+	}
+
+	latest := &jobs.Items[0]
+	for i := range jobs.Items {
+		if latest.CreationTimestamp.Before(&jobs.Items[i].CreationTimestamp) {
+			latest = &jobs.Items[i]
+		}
+	}
+
+	k.mu.Lock()
+	k.jobs[stage.Name] = latest
+	k.mu.Unlock()
+	return latest, nil
+}
+
+// Returns the most recently created pod of the stage's job.
+func (k *kubernetesExecutor) pod(ctx context.Context, stage *pipeline.Stage, job *batchv1.Job) (*corev1.Pod, error) {
+	pods, err := k.client.CoreV1().Pods(k.namespace).List(ctx,
+		metav1.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list pods for stage "+stage.Name)
+	}
+	if len(pods.Items) == 0 {
+		return nil, errors.New("No pods found for stage " + stage.Name)
+	}
+
+	latest := &pods.Items[0]
+	for i := range pods.Items {
+		if latest.CreationTimestamp.Before(&pods.Items[i].CreationTimestamp) {
+			latest = &pods.Items[i]
+		}
+	}
+	return latest, nil
+}
+
+// Deletes a job along with its pods and waits for the job to be gone, so
+// that a new job with the same name can be created.
+func (k *kubernetesExecutor) deleteJob(ctx context.Context, name string) error {
+	jobs := k.client.BatchV1().Jobs(k.namespace)
+	propagation := metav1.DeletePropagationForeground
+
+	err := jobs.Delete(ctx, name,
+		metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Could not delete job "+name)
+	}
+
+	for {
+		_, err := jobs.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "Could not get job "+name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// Returns the job specification for a stage.
+func (k *kubernetesExecutor) job(stage *pipeline.Stage) (*batchv1.Job, error) {
+	resources, err := resourceRequirements(stage)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := []corev1.Volume{{
+		Name: "walrus",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: k.claim,
+			},
+		},
+	}}
+
+	stageName := strings.Split(stage.Name, "_")[0]
+	mounts := []corev1.VolumeMount{{
+		Name:      "walrus",
+		MountPath: stageMountPath(stage),
+		SubPath:   k.runOutputPath(stageName),
+	}}
+
+	mounted := map[string]bool{stageName: true}
+	for _, input := range stage.Inputs {
+		inputName := strings.Split(input, "_")[0]
+		if mounted[inputName] {
+			continue
+		}
+		mounted[inputName] = true
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      "walrus",
+			MountPath: "/walrus/" + inputName,
+			SubPath:   k.inputPath(input),
+			ReadOnly:  true,
+		})
+	}
+
+	// Tmpfs mounts are memory backed empty directories.
+	for i, mount := range stage.Security.Tmpfs {
+		path, size, err := tmpfsMount(mount)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid tmpfs mount for stage "+stage.Name)
+		}
+		emptyDir := &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}
+		if size > 0 {
+			emptyDir.SizeLimit = resource.NewQuantity(size, resource.BinarySI)
+		}
+		name := "tmpfs-" + strconv.Itoa(i)
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: emptyDir},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: path})
+	}
+
+	// Volumes are host paths on the cluster nodes.
+	for i, volume := range stage.Volumes {
+		hostClientPath := strings.Split(volume, ":")
+		clientPath := hostClientPath[0]
+		if len(hostClientPath) > 1 {
+			clientPath = hostClientPath[1]
+		}
+		name := "volume-" + strconv.Itoa(i)
+		volumes = append(volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: hostClientPath[0]},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name,
+			MountPath: clientPath})
+	}
+
+	var env []corev1.EnvVar
+	for _, variable := range stage.Env {
+		nameAndValue := strings.SplitN(variable, "=", 2)
+		value := ""
+		if len(nameAndValue) == 2 {
+			value = nameAndValue[1]
+		}
+		env = append(env, corev1.EnvVar{Name: nameAndValue[0], Value: value})
+	}
+
+	labels := map[string]string{
+		labelPipeline:   labelValue(k.pipeline),
+		labelStage:      labelValue(stage.Name),
+		labelRun:        labelValue(k.runID),
+		labelOutputHash: k.outputHash(),
+		labelCacheKey:   cacheKeyLabel(stage),
+		labelVersion:    labelValue(version),
+	}
+	backoffLimit := int32(0)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   k.jobName(stage),
+			Labels: labels,
+			Annotations: map[string]string{
+				annotationOutputPath: k.runOutputPath(stageName),
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Volumes:       volumes,
+					Containers: []corev1.Container{{
+						Name:            "stage",
+						Image:           stageImage(stage),
+						Command:         stage.Entrypoint,
+						Args:            stage.Cmd,
+						Env:             env,
+						VolumeMounts:    mounts,
+						Resources:       resources,
+						SecurityContext: securityContext(stage, k.policy),
+					}},
+				},
+			},
+		},
+	}, nil
+}
+
+// Maps the stage resources to container requests and limits. Stages are
+// guaranteed the resources they ask for, so requests and limits are equal.
+func resourceRequirements(stage *pipeline.Stage) (corev1.ResourceRequirements, error) {
+	list := corev1.ResourceList{}
+
+	if stage.Resources.CPUs > 0 {
+		list[corev1.ResourceCPU] = *resource.NewMilliQuantity(
+			int64(stage.Resources.CPUs*1000), resource.DecimalSI)
+	}
+
+	memory, err := stage.Resources.MemoryBytes()
+	if err != nil {
+		return corev1.ResourceRequirements{}, errors.Wrap(err,
+			"Invalid memory limit for stage "+stage.Name)
+	}
+	if memory > 0 {
+		list[corev1.ResourceMemory] = *resource.NewQuantity(memory,
+			resource.BinarySI)
+	}
+
+	if len(list) == 0 {
+		return corev1.ResourceRequirements{}, nil
+	}
+	return corev1.ResourceRequirements{Requests: list, Limits: list}, nil
+}
+
+// Returns an error if a stage has settings that can not be applied to a
+// Kubernetes job.
+func checkKubernetesStage(stage *pipeline.Stage) error {
+	if stage.Network != "" {
+		return errors.New("Stage " + stage.Name + " sets Network, which can " +
+			"not be applied by the kubernetes executor")
+	}
+
+	for _, mount := range stage.Security.Tmpfs {
+		_, _, err := tmpfsMount(mount)
+		if err != nil {
+			return errors.Wrap(err, "Invalid tmpfs mount for stage "+stage.Name)
+		}
+	}
+
+	if filepath.IsAbs(stage.Security.SeccompProfile) {
+		return errors.New("Stage " + stage.Name + " uses the seccomp profile " +
+			stage.Security.SeccompProfile + ", which must be relative to the " +
+			"seccomp directory of the kubelet with the kubernetes executor")
+	}
+	return nil
+}
+
+// Returns the path and size limit of a tmpfs mount (path[:size=SIZE]). Other
+// tmpfs options can not be set for memory backed volumes.
+func tmpfsMount(mount string) (string, int64, error) {
+	pathAndOptions := strings.SplitN(mount, ":", 2)
+	var size int64
+	if len(pathAndOptions) == 2 {
+		for _, option := range strings.Split(pathAndOptions[1], ",") {
+			if !strings.HasPrefix(option, "size=") {
+				return "", 0, errors.New("The tmpfs option " + option +
+					" is not supported by the kubernetes executor")
+			}
+			var err error
+			size, err = pipeline.Resources{Memory: strings.TrimPrefix(option, "size=")}.MemoryBytes()
+			if err != nil {
+				return "", 0, err
+			}
+		}
+	}
+	return pathAndOptions[0], size, nil
+}
+
+// Maps the stage security settings to a container security context. Only
+// numeric users can be set in Kubernetes, so if the policy forbids root the
+// container is not allowed to run as root. Stages without a seccomp profile
+// get the default profile of the container runtime, as with Docker.
+func securityContext(stage *pipeline.Stage, policy pipeline.Policy) *corev1.SecurityContext {
+	security := stage.Security
+	sc := &corev1.SecurityContext{}
+
+	if policy.ForbidRootUser {
+		nonRoot := true
+		sc.RunAsNonRoot = &nonRoot
+	}
+
+	ids := strings.Split(security.User, ":")
+	if uid, err := strconv.ParseInt(ids[0], 10, 64); err == nil {
+		sc.RunAsUser = &uid
+		if len(ids) > 1 {
+			if gid, err := strconv.ParseInt(ids[1], 10, 64); err == nil {
+				sc.RunAsGroup = &gid
+			}
+		}
+	}
+
+	if len(security.CapAdd) > 0 || len(security.CapDrop) > 0 {
+		sc.Capabilities = &corev1.Capabilities{}
+		for _, capability := range security.CapAdd {
+			sc.Capabilities.Add = append(sc.Capabilities.Add,
+				corev1.Capability(capability))
+		}
+		for _, capability := range security.CapDrop {
+			sc.Capabilities.Drop = append(sc.Capabilities.Drop,
+				corev1.Capability(capability))
+		}
+	}
+
+	if security.ReadOnlyRootfs {
+		readOnly := true
+		sc.ReadOnlyRootFilesystem = &readOnly
+	}
+
+	if security.NoNewPrivileges {
+		escalation := false
+		sc.AllowPrivilegeEscalation = &escalation
+	}
+
+	switch security.SeccompProfile {
+	case "":
+		sc.SeccompProfile = &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault}
+	case "unconfined":
+		sc.SeccompProfile = &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeUnconfined}
+	default:
+		profile := security.SeccompProfile
+		sc.SeccompProfile = &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile}
+	}
+
+	return sc
+}
+
+// Returns the directory on the volume a stage writes its output to in this
+// run, e.g. mypipeline/20180102-150405/stage.
+func (k *kubernetesExecutor) runOutputPath(stageName string) string {
+	return k.pipeline + "/" + k.runID + "/" + stageName
+}
+
+// Returns the directory on the volume with the output of an input stage. A
+// cached input stage has its output in the directory of the run it is cached
+// from.
+func (k *kubernetesExecutor) inputPath(input string) string {
+	k.mu.Lock()
+	job, ok := k.jobs[input]
+	k.mu.Unlock()
+	if ok && job.Annotations[annotationOutputPath] != "" {
+		return job.Annotations[annotationOutputPath]
+	}
+	return k.runOutputPath(strings.Split(input, "_")[0])
+}
+
+// Returns true if the output of the last run of a stage is still there. It can
+// only be checked if the volume is mounted on the host running walrus.
+func (k *kubernetesExecutor) hasOutput(ctx context.Context, stage *pipeline.Stage) bool {
+	job, err := k.findJob(ctx, stage)
+	if err != nil {
+		return false
+	}
+	if k.claimMount == "" {
+		return true
+	}
+	_, err = os.Stat(filepath.Join(k.claimMount, job.Annotations[annotationOutputPath]))
+	return err == nil
+}
+
+// Writes the logs of a stage to its output directory on the volume, if the
+// volume is mounted on the host running walrus.
+func (k *kubernetesExecutor) writeLogs(ctx context.Context, stage *pipeline.Stage, logs string) error {
+	if k.claimMount == "" {
+		return nil
+	}
+	job, err := k.findJob(ctx, stage)
+	if err != nil {
+		return err
+	}
+	return writeLogs(logs, filepath.Join(k.claimMount, job.Annotations[annotationOutputPath]))
+}
+
+// Returns a short hash of the output directory on the host, which identifies
+// the runs that share cached stages.
+func (k *kubernetesExecutor) outputHash() string {
+	h := fnv.New32a()
+	h.Write([]byte(k.rootpath))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+var (
+	invalidJobNameCharacters   = regexp.MustCompile(`[^a-z0-9-]`)
+	invalidLabelValueCharacter = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+)
+
+// Returns the name of the job running a stage in this run, e.g.
+// walrus-mypipeline-20180102-150405-stage. Job names must be valid DNS
+// labels, so names are lower cased and underscores replaced. Names that are
+// too long are shortened and end with a hash of the full name, so that they
+// stay unique.
+func (k *kubernetesExecutor) jobName(stage *pipeline.Stage) string {
+	name := "walrus-" + k.pipeline + "-" + k.runID + "-" + stage.Name
+	name = invalidJobNameCharacters.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 63 {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		name = strings.TrimRight(name[:54], "-") + fmt.Sprintf("-%08x", h.Sum32())
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// Returns a valid label value: at most 63 characters that start and end with
+// a letter or digit.
+func labelValue(value string) string {
+	value = invalidLabelValueCharacter.ReplaceAllString(value, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// Returns the cache key of a stage shortened to fit in a label value.
+func cacheKeyLabel(stage *pipeline.Stage) string {
+	return stage.CacheKey()[:32]
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testPipeline(name string) *pipeline.Pipeline {
+	return &pipeline.Pipeline{
+		Name: name,
+		Stages: []*pipeline.Stage{
+			{Name: "a", Image: "ubuntu:latest", Cmd: []string{"true"}, Cache: true},
+			{Name: "b", Image: "ubuntu:latest", Cmd: []string{"true"}, Inputs: []string{"a"}},
+		},
+	}
+}
+
+// Runs a stage and marks its job as completed once it has been created.
+func runTestStage(t *testing.T, k *kubernetesExecutor, p *pipeline.Pipeline, stage *pipeline.Stage, succeeded bool) {
+	t.Helper()
+
+	done := make(chan error)
+	go func() {
+		done <- k.Run(context.Background(), p, stage, "")
+	}()
+
+	name := k.jobName(stage)
+	jobs := k.client.BatchV1().Jobs(k.namespace)
+	for {
+		job, err := jobs.Get(context.Background(), name, metav1.GetOptions{})
+		if err == nil {
+			if succeeded {
+				job.Status.Succeeded = 1
+			} else {
+				job.Status.Failed = 1
+			}
+			_, err = jobs.UpdateStatus(context.Background(), job, metav1.UpdateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the job completed")
+	}
+}
+
+func startTestExecutor(t *testing.T, client kubernetes.Interface, p *pipeline.Pipeline, rootpath, runID string) *kubernetesExecutor {
+	t.Helper()
+	k := newKubernetesExecutor(client, "default", "walrus", "", rootpath, runID)
+	err := k.Start(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func mountSubPath(job *batchv1.Job, mountPath string) string {
+	for _, mount := range job.Spec.Template.Spec.Containers[0].VolumeMounts {
+		if mount.MountPath == mountPath {
+			return mount.SubPath
+		}
+	}
+	return ""
+}
+
+func TestKubernetesJobsOfRunsDoNotCollide(t *testing.T) {
+	jobPollInterval = time.Millisecond
+	client := fake.NewSimpleClientset()
+
+	p, q := testPipeline("p"), testPipeline("q")
+	runs := []*kubernetesExecutor{
+		startTestExecutor(t, client, p, "/out/1", "20200101-000000"),
+		startTestExecutor(t, client, p, "/out/2", "20200101-000001"),
+		startTestExecutor(t, client, q, "/out/1", "20200101-000000"),
+	}
+
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	for _, k := range runs {
+		job, err := k.job(testPipeline(k.pipeline).Stages[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names[job.Name] {
+			t.Errorf("Job name %s is used by two runs", job.Name)
+		}
+		names[job.Name] = true
+
+		path := mountSubPath(job, "/walrus/a")
+		if paths[path] {
+			t.Errorf("Output directory %s is used by two runs", path)
+		}
+		paths[path] = true
+	}
+
+	k := runs[0]
+	if got := k.jobName(p.Stages[0]); got != "walrus-p-20200101-000000-a" {
+		t.Errorf("Job name is %s", got)
+	}
+
+	long := &pipeline.Stage{Name: strings.Repeat("stage", 20) + "_parallel_1"}
+	other := &pipeline.Stage{Name: strings.Repeat("stage", 20) + "_parallel_2"}
+	if len(k.jobName(long)) > 63 {
+		t.Errorf("Job name %s is longer than 63 characters", k.jobName(long))
+	}
+	if k.jobName(long) == k.jobName(other) {
+		t.Errorf("Long stage names give the same job name %s", k.jobName(long))
+	}
+}
+
+func TestKubernetesRun(t *testing.T) {
+	jobPollInterval = time.Millisecond
+	client := fake.NewSimpleClientset()
+	p := testPipeline("p")
+	k := startTestExecutor(t, client, p, "/out", "run1")
+
+	runTestStage(t, k, p, p.Stages[0], true)
+	runTestStage(t, k, p, p.Stages[1], false)
+
+	code, _, err := k.ExitCode(context.Background(), p.Stages[0])
+	if err != nil || code != 0 {
+		t.Errorf("Exit code of stage a is %d, %v", code, err)
+	}
+	code, _, err = k.ExitCode(context.Background(), p.Stages[1])
+	if err != nil || code == 0 {
+		t.Errorf("Exit code of failed stage b is %d, %v", code, err)
+	}
+
+	job, err := client.BatchV1().Jobs("default").Get(context.Background(),
+		k.jobName(p.Stages[1]), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mountSubPath(job, "/walrus/b"); got != "p/run1/b" {
+		t.Errorf("Output of stage b is mounted from %s", got)
+	}
+	if got := mountSubPath(job, "/walrus/a"); got != "p/run1/a" {
+		t.Errorf("Input a of stage b is mounted from %s", got)
+	}
+	if job.Labels[labelRun] != "run1" || job.Labels[labelStage] != "b" {
+		t.Errorf("Job has labels %v", job.Labels)
+	}
+}
+
+func TestKubernetesCachedStage(t *testing.T) {
+	jobPollInterval = time.Millisecond
+	client := fake.NewSimpleClientset()
+	p := testPipeline("p")
+
+	first := startTestExecutor(t, client, p, "/out", "run1")
+	runTestStage(t, first, p, p.Stages[0], true)
+
+	// A later run in the same output directory finds the job of the first
+	// run, and the stage that depends on it reads the output of that run.
+	second := startTestExecutor(t, client, p, "/out", "run2")
+	code, _, err := second.ExitCode(context.Background(), p.Stages[0])
+	if err != nil || code != 0 {
+		t.Fatalf("Cached stage a has exit code %d, %v", code, err)
+	}
+	if !second.hasOutput(context.Background(), p.Stages[0]) {
+		t.Error("Output of cached stage a was not found")
+	}
+
+	job, err := second.job(p.Stages[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mountSubPath(job, "/walrus/a"); got != "p/run1/a" {
+		t.Errorf("Cached input a is mounted from %s", got)
+	}
+	if got := mountSubPath(job, "/walrus/b"); got != "p/run2/b" {
+		t.Errorf("Output of stage b is mounted from %s", got)
+	}
+
+	// Runs in other output directories, and stages with another
+	// configuration, do not use the cached job.
+	other := startTestExecutor(t, client, p, "/other", "run3")
+	_, _, err = other.ExitCode(context.Background(), p.Stages[0])
+	if err == nil {
+		t.Error("A run in another output directory used the cached stage")
+	}
+
+	changed := testPipeline("p")
+	changed.Stages[0].Cmd = []string{"false"}
+	third := startTestExecutor(t, client, changed, "/out", "run4")
+	_, _, err = third.ExitCode(context.Background(), changed.Stages[0])
+	if err == nil {
+		t.Error("A changed stage used the cached stage")
+	}
+}
+
+func TestKubernetesRunCancelled(t *testing.T) {
+	jobPollInterval = time.Millisecond
+	client := fake.NewSimpleClientset()
+	p := testPipeline("p")
+	k := startTestExecutor(t, client, p, "/out", "run1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- k.Run(ctx, p, p.Stages[0], "")
+	}()
+
+	jobs := client.BatchV1().Jobs("default")
+	for {
+		_, err := jobs.Get(context.Background(), k.jobName(p.Stages[0]), metav1.GetOptions{})
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	if err := <-done; err == nil {
+		t.Error("Run of a cancelled stage did not fail")
+	}
+	list, err := jobs.List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Errorf("The job of the cancelled stage was not deleted")
+	}
+}
+
+func TestKubernetesFollowsLogs(t *testing.T) {
+	jobPollInterval = time.Millisecond
+	client := fake.NewSimpleClientset()
+	p := testPipeline("p")
+	k := startTestExecutor(t, client, p, "/out", "run1")
+
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- k.Run(ctx, p, p.Stages[0], hostpath)
+	}()
+
+	name := k.jobName(p.Stages[0])
+	jobs := client.BatchV1().Jobs("default")
+	for {
+		_, err := jobs.Get(context.Background(), name, metav1.GetOptions{})
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name + "-abcde",
+			Labels: map[string]string{"job-name": name},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "stage",
+				State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			}},
+		},
+	}
+	_, err = client.CoreV1().Pods("default").Create(context.Background(), pod,
+		metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The logs are written while the job is still running.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(filepath.Join(hostpath, "walrus.log"))
+		if string(b) == "fake logs" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The logs of the running stage are %q", b)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("Run of a cancelled stage did not fail")
+	}
+}
+
+func TestKubernetesSecurityContext(t *testing.T) {
+	stage := &pipeline.Stage{Name: "a"}
+	sc := securityContext(stage, pipeline.Policy{})
+	if sc.RunAsNonRoot != nil {
+		t.Error("Stage may not run as root without a policy")
+	}
+	if sc.SeccompProfile == nil || sc.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+		t.Errorf("Stage without a seccomp profile has %v", sc.SeccompProfile)
+	}
+
+	sc = securityContext(stage, pipeline.Policy{ForbidRootUser: true})
+	if sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot {
+		t.Error("Stage may run as root when the policy forbids it")
+	}
+
+	stage.Security.SeccompProfile = "unconfined"
+	sc = securityContext(stage, pipeline.Policy{})
+	if sc.SeccompProfile.Type != corev1.SeccompProfileTypeUnconfined {
+		t.Errorf("Unconfined stage has %v", sc.SeccompProfile)
+	}
+
+	stage.Security.SeccompProfile = "profiles/walrus.json"
+	sc = securityContext(stage, pipeline.Policy{})
+	if sc.SeccompProfile.Type != corev1.SeccompProfileTypeLocalhost ||
+		*sc.SeccompProfile.LocalhostProfile != "profiles/walrus.json" {
+		t.Errorf("Stage with a seccomp profile has %v", sc.SeccompProfile)
+	}
+}
+
+func TestKubernetesTmpfs(t *testing.T) {
+	p := testPipeline("p")
+	p.Stages[0].Security.Tmpfs = []string{"/tmp:size=64m", "/scratch"}
+	k := startTestExecutor(t, fake.NewSimpleClientset(), p, "/out", "run1")
+
+	job, err := k.job(p.Stages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := make(map[string]string)
+	spec := job.Spec.Template.Spec
+	for _, mount := range spec.Containers[0].VolumeMounts {
+		for _, volume := range spec.Volumes {
+			if volume.Name != mount.Name || volume.EmptyDir == nil {
+				continue
+			}
+			if volume.EmptyDir.Medium != corev1.StorageMediumMemory {
+				t.Errorf("Tmpfs %s is not memory backed", mount.MountPath)
+			}
+			sizes[mount.MountPath] = ""
+			if volume.EmptyDir.SizeLimit != nil {
+				sizes[mount.MountPath] = volume.EmptyDir.SizeLimit.String()
+			}
+		}
+	}
+	if len(sizes) != 2 || sizes["/tmp"] != "64Mi" || sizes["/scratch"] != "" {
+		t.Errorf("Tmpfs mounts are %v", sizes)
+	}
+}
+
+func TestKubernetesRejectsUnsupportedSettings(t *testing.T) {
+	stages := map[string]func(stage *pipeline.Stage){
+		"network":       func(stage *pipeline.Stage) { stage.Network = "none" },
+		"tmpfs options": func(stage *pipeline.Stage) { stage.Security.Tmpfs = []string{"/tmp:noexec"} },
+		"tmpfs size":    func(stage *pipeline.Stage) { stage.Security.Tmpfs = []string{"/tmp:size=lots"} },
+		"seccomp path":  func(stage *pipeline.Stage) { stage.Security.SeccompProfile = "/etc/seccomp.json" },
+	}
+
+	for name, set := range stages {
+		p := testPipeline("p")
+		set(p.Stages[0])
+		k := newKubernetesExecutor(fake.NewSimpleClientset(), "default", "walrus",
+			"", "/out", "run1")
+		err := k.Start(context.Background(), p)
+		if err == nil {
+			t.Errorf("Stage with %s was accepted", name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package lfs
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"log"
@@ -15,11 +16,16 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
-	git "gopkg.in/libgit2/git2go.v26"
 
 	"github.com/pkg/errors"
 )
 
+// The author and committer of the commits walrus makes.
+const (
+	authorName  = "walrus"
+	authorEmail = "walrus@github.com/fjukstad/walrus"
+)
+
 // git lfs track
 // Since the git-lfs devs discourage using git-lfs in go projects we're just
 // calling the git-lfs CLI.
@@ -61,19 +67,19 @@ func AddAndCommitData(path, msg string) (string, error) {
 // Add a file to the index
 func Add(filename string) error {
 	// Open repository at path.
-	repo, _, err := openContainingRepository(filename)
+	repositoryLocation, err := openContainingRepository(filename)
 	if err != nil {
 		return err
 	}
 
 	// Check if the file has been changed and commit it if it has.
-	changed, err := fileChanged(repo, filename)
+	changed, err := fileChanged(repositoryLocation, filename)
 	if err != nil {
 		return err
 	}
 
 	if changed {
-		err := addToIndex(repo, filename)
+		err := addToIndex(repositoryLocation, filename)
 		if err != nil {
 			return err
 		}
@@ -82,14 +88,13 @@ func Add(filename string) error {
 	return nil
 }
 
-func openContainingRepository(filename string) (repo *git.Repository,
-	repositoryLocation string, err error) {
+func openContainingRepository(filename string) (repositoryLocation string, err error) {
 
 	// Strip path from filename
 	path := filepath.Dir(filename)
 	path, err = filepath.Abs(path)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
 
 	// Open repository at path.
@@ -99,13 +104,13 @@ func openContainingRepository(filename string) (repo *git.Repository,
 // Add and commit file
 func AddAndCommit(filename, msg string) (string, error) {
 	// Open repository at path.
-	repo, repositoryLocation, err := openContainingRepository(filename)
+	repositoryLocation, err := openContainingRepository(filename)
 	if err != nil {
 		return "", err
 	}
 
 	// Check if the file has been changed and commit it if it has.
-	changed, err := fileChanged(repo, filename)
+	changed, err := fileChanged(repositoryLocation, filename)
 	if err != nil {
 		return "", err
 	}
@@ -113,7 +118,7 @@ func AddAndCommit(filename, msg string) (string, error) {
 	var commitId string
 
 	if changed {
-		err := addToIndex(repo, filename)
+		err := addToIndex(repositoryLocation, filename)
 		if err != nil {
 			return "", err
 		}
@@ -133,18 +138,20 @@ func AddAndCommit(filename, msg string) (string, error) {
 // to be committed.
 func AddData(path string) (changes bool, repositoryLocation string, err error) {
 
-	wd, err := os.Getwd()
+	path, err = filepath.Abs(path)
 	if err != nil {
 		return false, "", err
 	}
-	defer os.Chdir(wd)
-
-	repo, repositoryLocation, err := openRepository(path)
+	// git reports the location of the repository with symlinks resolved.
+	path, err = filepath.EvalSymlinks(path)
 	if err != nil {
 		return false, "", err
 	}
 
-	os.Chdir(repositoryLocation)
+	repositoryLocation, err = openRepository(path)
+	if err != nil {
+		return false, "", err
+	}
 
 	dataPath, err := filepath.Rel(repositoryLocation, path)
 	if err != nil {
@@ -158,12 +165,9 @@ func AddData(path string) (changes bool, repositoryLocation string, err error) {
 	gitAttr := ".gitattributes"
 
 	// if pattern already exists don't rerun the track command
-	b, err := ioutil.ReadFile(gitAttr)
-	if err != nil {
-		pe := err.(*os.PathError)
-		if pe.Err.Error() != "no such file or directory" {
-			return false, "", err
-		}
+	b, err := ioutil.ReadFile(filepath.Join(repositoryLocation, gitAttr))
+	if err != nil && !os.IsNotExist(err) {
+		return false, "", err
 	}
 
 	if !strings.Contains(string(b), dataPattern) {
@@ -173,41 +177,20 @@ func AddData(path string) (changes bool, repositoryLocation string, err error) {
 		}
 	}
 
-	changed, err := fileChanged(repo, gitAttr)
+	changed, err := fileChanged(repositoryLocation, gitAttr)
 	if err != nil {
 		return false, "", err
 	}
 
 	if changed {
-		err := addToIndex(repo, gitAttr)
+		err := addToIndex(repositoryLocation, gitAttr)
 		if err != nil {
 			return false, "", err
 		}
 		changes = changed
 	}
 
-	changed = false
-
-	err = filepath.Walk(dataPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return errors.Wrap(err, "Could not add "+path+"to repository")
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-		changedFile, err := fileChanged(repo, path)
-		if err != nil {
-			return err
-		}
-		// One file is changed we can return
-		if changedFile {
-			changed = true
-			return nil
-		}
-		return nil
-	})
-
+	changed, err = fileChanged(repositoryLocation, dataPath)
 	if err != nil {
 		return false, "", err
 	}
@@ -217,35 +200,18 @@ func AddData(path string) (changes bool, repositoryLocation string, err error) {
 			return false, "", errors.Wrap(err, "Could not add files "+output)
 		}
 	}
-	changes = changed
+	changes = changes || changed
 
 	return changes, repositoryLocation, nil
 }
 
 // Add a path to the index.
-func addToIndex(repo *git.Repository, path string) error {
-
-	index, err := repo.Index()
-	if err != nil {
-		return err
-	}
-
-	err = index.AddByPath(path)
+func addToIndex(repositoryLocation, path string) error {
+	output, err := git(repositoryLocation, "add", "--", path)
 	if err != nil {
-		return err
-	}
-
-	_, err = index.WriteTree()
-	if err != nil {
-		return err
-	}
-
-	err = index.Write()
-	if err != nil {
-		return err
+		return errors.Wrap(err, "Could not add "+path+" to the index: "+output)
 	}
-
-	return err
+	return nil
 }
 
 // Removes the last directory in a path and returns it.
@@ -259,16 +225,21 @@ func popLastDirectory(path string) string {
 	return path
 }
 
-// Returns true if file is new, modified or deleted.
-func fileChanged(repo *git.Repository, path string) (bool, error) {
-	status, err := repo.StatusFile(path)
+// Returns true if a file, or any file in a directory, is new, modified or
+// deleted in the working tree.
+func fileChanged(repositoryLocation, path string) (bool, error) {
+	output, err := git(repositoryLocation, "status", "--porcelain",
+		"--untracked-files=all", "--", path)
 	if err != nil {
-		return false, err
+		return false, errors.Wrap(err, "Could not get the status of "+path+": "+output)
 	}
 
-	if status == git.StatusWtNew || status == git.StatusWtModified ||
-		status == git.StatusWtDeleted {
-		return true, nil
+	for _, line := range strings.Split(output, "\n") {
+		// The second column is the status in the working tree, and
+		// untracked files are ??.
+		if strings.HasPrefix(line, "??") || (len(line) > 1 && line[1] != ' ') {
+			return true, nil
+		}
 	}
 
 	return false, nil
@@ -276,104 +247,71 @@ func fileChanged(repo *git.Repository, path string) (bool, error) {
 
 // Commits staged changes.
 func commit(path, msg string) (string, error) {
-
-	repo, err := git.OpenRepository(path)
+	output, err := git(path, "-c", "user.name="+authorName,
+		"-c", "user.email="+authorEmail, "commit", "--quiet",
+		"--allow-empty", "--message", msg)
 	if err != nil {
-		return "", err
-	}
-
-	index, err := repo.Index()
-	if err != nil {
-		return "", err
-	}
-
-	treeId, err := index.WriteTree()
-	if err != nil {
-		return "", err
+		return "", errors.Wrap(err, "Could not commit: "+output)
 	}
 
-	tree, err := repo.LookupTree(treeId)
-	if err != nil {
-		return "", err
-	}
-
-	err = index.Write()
-	if err != nil {
-		return "", err
-	}
-
-	var sig = &git.Signature{
-		"walrus",
-		"walrus@github.com/fjukstad/walrus",
-		time.Now(),
-	}
-
-	var commitId *git.Oid
-
-	currentBranch, err := repo.Head()
-	if err != nil {
-		commitId, err = repo.CreateCommit("HEAD", sig, sig, msg, tree)
-	} else {
-		currentTip, err := repo.LookupCommit(currentBranch.Target())
-		if err != nil {
-			return "", err
-		}
-		commitId, err = repo.CreateCommit("HEAD", sig, sig, msg, tree, currentTip)
-	}
-	if err != nil {
-		return "", err
-	}
-
-	err = index.Write()
-	if err != nil {
-		return "", err
-	}
-
-	return commitId.String(), nil
+	return head(path)
 }
 
 // Will try to open a git repository located at the given path. If it is not
 // found it will traverse the directory tree outwards until i either finds a
 // repository or hits the root. If no repository is found it will initialize one
 // in the current working directory.
-func openRepository(path string) (repo *git.Repository, repositoryPath string, err error) {
+func openRepository(path string) (repositoryPath string, err error) {
 
 	wd, err := os.Getwd()
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
 	for {
-		repo, err = git.OpenRepository(path)
+		repositoryPath, err = git(path, "rev-parse", "--show-toplevel")
 		if err != nil {
 			path = popLastDirectory(path)
 			// Root hit
 			if path == "/" {
-				path = wd
-				log.Println("Output directory is not in a git repository. Creating one in " + path)
-				repo, err = git.InitRepository(wd, false)
+				log.Println("Output directory is not in a git repository. Creating one in " + wd)
+				output, err := git(wd, "init", "--quiet")
 				if err != nil {
-					return nil, "", errors.Wrap(err, "Could not initialize git repository")
+					return "", errors.Wrap(err, "Could not initialize git repository: "+output)
 				}
-				break
+				return wd, nil
 			}
 		} else {
 			break
 		}
 	}
-	return repo, path, nil
+	return repositoryPath, nil
 }
 
 // git add
-// To speed up dev time for the prototype, use the exec pkg not git2go package
-// to add files. Future versions will get rid of this hacky way of doing things
-// by creating the blobs, softlinks etc. but that's for later!
 func add(path, repositoryLocation string) (string, error) {
-	cmd := exec.Command("git", "add", path)
-	cmd.Dir = repositoryLocation
-	out, err := cmd.Output()
-	output := string(out)
-	output = strings.TrimRight(output, "\n")
-	return output, err
+	return git(repositoryLocation, "add", "--", path)
+}
+
+// Runs git in a directory and returns its output without the trailing
+// newline. The output includes what git wrote to stderr, so that errors can
+// be reported.
+func git(dir string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return strings.TrimRight(out.String(), "\n"), err
+}
+
+// Returns the id of the commit HEAD points to.
+func head(repositoryLocation string) (string, error) {
+	output, err := git(repositoryLocation, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return "", errors.Wrap(err, output)
+	}
+	return output, nil
 }
 
 // Starts a git-lfs server in a Docker container
@@ -404,7 +342,7 @@ func StartServer(mountDir string) error {
 	ps["9999/tcp"] = struct{}{}
 
 	pm := make(nat.PortMap)
-	pm["9999/tcp"] = []nat.PortBinding{nat.PortBinding{"0.0.0.0", "9999"}}
+	pm["9999/tcp"] = []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "9999"}}
 
 	resp, err := c.ContainerCreate(context.Background(),
 		&container.Config{Image: image,
@@ -413,6 +351,7 @@ func StartServer(mountDir string) error {
 			Binds:        []string{bind},
 			PortBindings: pm},
 		&network.NetworkingConfig{},
+		nil,
 		"git-lfs-server")
 
 	if err != nil || resp.ID == " " {
@@ -429,19 +368,17 @@ func StartServer(mountDir string) error {
 // Get the head id of the repository found at hostpath
 func GetHead(hostpath string) (string, error) {
 
-	repo, _, err := openRepository(hostpath)
+	repositoryLocation, err := openRepository(hostpath)
 	if err != nil {
 		return "", errors.Wrap(err, "Could not open repository")
 	}
 
-	ref, err := repo.Head()
+	id, err := head(repositoryLocation)
 	if err != nil {
 		return "", errors.Wrap(err, "Could not get head")
 	}
 
-	head := ref.Target()
-
-	return head.String(), nil
+	return id, nil
 }
 
 func PrintDiff(path, id string) (string, error) {
@@ -450,42 +387,18 @@ func PrintDiff(path, id string) (string, error) {
 		return "", errors.Wrap(err, "Could not get absolute path of output directory")
 	}
 
-	repo, _, err := openRepository(path)
+	repositoryLocation, err := openRepository(path)
 	if err != nil {
 		return "", errors.Wrap(err, "Could not open repository")
 	}
 
-	index, err := repo.Index()
-	if err != nil {
-		return "", errors.Wrap(err, "Could not get head")
-	}
-
-	oid, err := git.NewOid(id)
+	// The changes between the commit and the index.
+	output, err := git(repositoryLocation, "diff", "--cached", "--stat=80", id, "--")
 	if err != nil {
-		return "", errors.Wrap(err, "Could not create oid for id "+id)
+		return "", errors.Wrap(err, "Could not diff commit id "+id+" to index: "+output)
 	}
 
-	commit, err := repo.LookupCommit(oid)
-	if err != nil {
-		return "", errors.Wrap(err, "Could not lookup commit id "+id)
-	}
-
-	oldTree, err := commit.Tree()
-	if err != nil {
-		return "", errors.Wrap(err, "Could not lookup tree")
-	}
-
-	diff, err := repo.DiffTreeToIndex(oldTree, index, &git.DiffOptions{})
-	if err != nil {
-		return "", errors.Wrap(err, "Could not diff tree to index")
-	}
-
-	stats, err := diff.Stats()
-	if err != nil {
-		return "", errors.Wrap(err, "Could not get diff stats")
-	}
-
-	return stats.String(git.DiffStatsFull, 80)
+	return output, nil
 }
 
 func Reset(path, id string) error {
@@ -494,24 +407,14 @@ func Reset(path, id string) error {
 		return errors.Wrap(err, "Could not get absolute path of output directory")
 	}
 
-	repo, _, err := openRepository(path)
+	repositoryLocation, err := openRepository(path)
 	if err != nil {
 		return errors.Wrap(err, "Could not open repository")
 	}
 
-	oid, err := git.NewOid(id)
-	if err != nil {
-		return errors.Wrap(err, "Could not create oid for id "+id)
-	}
-
-	commit, err := repo.LookupCommit(oid)
-	if err != nil {
-		return errors.Wrap(err, "Could not lookup commit id "+id)
-	}
-
-	err = repo.ResetToCommit(commit, git.ResetMixed, &git.CheckoutOpts{})
+	output, err := git(repositoryLocation, "reset", "--mixed", "--quiet", id)
 	if err != nil {
-		return errors.Wrap(err, "Could not reset to id "+id)
+		return errors.Wrap(err, "Could not reset to id "+id+": "+output)
 	}
 	return nil
 }
@@ -0,0 +1,84 @@
+package lfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddAndCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walrus-repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = git(dir, "init", "--quiet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "pipeline.json")
+	err = ioutil.WriteFile(filename, []byte("{}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := AddAndCommit(filename, "Add pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := GetHead(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != first {
+		t.Errorf("HEAD is %s, expected the commit %s", head, first)
+	}
+
+	// Nothing to commit if the file has not changed.
+	_, err = AddAndCommit(filename, "Add pipeline")
+	if err == nil {
+		t.Error("Committed a file without changes")
+	}
+
+	err = ioutil.WriteFile(filename, []byte(`{"Name": "p"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := AddAndCommit(filename, "Update pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Error("The update was not committed")
+	}
+
+	diff, err := PrintDiff(dir, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == "" {
+		t.Error("No diff between the commits")
+	}
+
+	err = Reset(dir, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err = GetHead(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != first {
+		t.Errorf("HEAD is %s after reset, expected %s", head, first)
+	}
+	changed, err := fileChanged(dir, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("A reset to an earlier commit did not keep the changes in the working tree")
+	}
+}
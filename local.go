@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+)
+
+// Runs pipeline stages as processes on the host, without containers. The
+// stage image is ignored and the Entrypoint and Cmd are run directly. Paths
+// under /walrus are rewritten to the output directory on the host, which is
+// also available to the stage in the WALRUS environment variable. The exit
+// code and output of every stage are kept in the walrus configuration
+// directory so that stages can be cached between runs. Processes run as the
+// user that started walrus with the network of the host, so stages with
+// security, network or resource settings are rejected.
+type localExecutor struct {
+	rootpath string
+}
+
+// The outcome of a stage run by the local executor.
+type localResult struct {
+	ExitCode int
+	Error    string
+}
+
+func (l *localExecutor) Start(ctx context.Context, p *pipeline.Pipeline) error {
+	for _, stage := range p.Stages {
+		err := l.checkStage(stage)
+		if err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(l.statePath(), 0755)
+}
+
+// Returns an error if a stage has settings that can not be applied to a
+// process on the host.
+func (l *localExecutor) checkStage(stage *pipeline.Stage) error {
+	security := stage.Security
+	var unsupported []string
+	if security.User != "" {
+		unsupported = append(unsupported, "User")
+	}
+	if len(security.CapAdd) > 0 {
+		unsupported = append(unsupported, "CapAdd")
+	}
+	if len(security.CapDrop) > 0 {
+		unsupported = append(unsupported, "CapDrop")
+	}
+	if security.ReadOnlyRootfs {
+		unsupported = append(unsupported, "ReadOnlyRootfs")
+	}
+	if len(security.Tmpfs) > 0 {
+		unsupported = append(unsupported, "Tmpfs")
+	}
+	if security.NoNewPrivileges {
+		unsupported = append(unsupported, "NoNewPrivileges")
+	}
+	if security.SeccompProfile != "" {
+		unsupported = append(unsupported, "SeccompProfile")
+	}
+	if stage.Network != "" {
+		unsupported = append(unsupported, "Network")
+	}
+	if stage.Resources != (pipeline.Resources{}) {
+		unsupported = append(unsupported, "Resources")
+	}
+
+	if len(unsupported) > 0 {
+		return errors.New("Stage " + stage.Name + " sets " +
+			strings.Join(unsupported, ", ") + ", which can not be applied " +
+			"by the local executor")
+	}
+	return nil
+}
+
+func (l *localExecutor) Stop(ctx context.Context, p *pipeline.Pipeline) error {
+	return nil
+}
+
+func (l *localExecutor) Prepare(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage) error {
+	return nil
+}
+
+func (l *localExecutor) Run(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage, hostpath string) error {
+	args := append(l.rewrite(stage.Entrypoint, stage), l.rewrite(stage.Cmd, stage)...)
+	if len(args) == 0 {
+		return errors.New("Stage " + stage.Name + " has no command to run")
+	}
+
+	// Forget the outcome of any previous run, it is no longer valid.
+	os.Remove(l.resultFilename(stage))
+
+	logFile, err := os.Create(l.logFilename(stage))
+	if err != nil {
+		return errors.Wrap(err, "Could not create log file for stage "+stage.Name)
+	}
+	defer logFile.Close()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = hostpath
+	cmd.Env = append(os.Environ(), l.rewriteEnv(stage.Env, stage)...)
+	cmd.Env = append(cmd.Env, "WALRUS="+l.rootpath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	result := localResult{}
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "Stage "+stage.Name+" did not complete")
+	}
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return errors.Wrap(err, "Could not run stage "+stage.Name)
+		}
+		result.ExitCode = 1
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			result.ExitCode = status.ExitStatus()
+		}
+		result.Error = exitErr.Error()
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.resultFilename(stage), b, 0644)
+}
+
+func (l *localExecutor) ExitCode(ctx context.Context, stage *pipeline.Stage) (int, string, error) {
+	b, err := ioutil.ReadFile(l.resultFilename(stage))
+	if err != nil {
+		return 0, "", err
+	}
+
+	result := localResult{}
+	err = json.Unmarshal(b, &result)
+	if err != nil {
+		return 0, "", err
+	}
+	return result.ExitCode, result.Error, nil
+}
+
+func (l *localExecutor) Logs(ctx context.Context, stage *pipeline.Stage) (string, error) {
+	b, err := ioutil.ReadFile(l.logFilename(stage))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Rewrites paths in the arguments of a stage so that they point to the host
+// instead of the container. Arguments starting with /walrus are mapped to the
+// output directory, and arguments starting with the container side of a
+// volume to its host side.
+func (l *localExecutor) rewrite(args []string, stage *pipeline.Stage) []string {
+	paths := [][2]string{{"/walrus", l.rootpath}}
+	for _, volume := range stage.Volumes {
+		hostClientPath := strings.Split(volume, ":")
+		if len(hostClientPath) > 1 {
+			paths = append(paths, [2]string{hostClientPath[1], hostClientPath[0]})
+		}
+	}
+
+	var rewritten []string
+	for _, arg := range args {
+		rewritten = append(rewritten, rewritePath(arg, paths))
+	}
+	return rewritten
+}
+
+// Rewrites the paths in the values of environment variables (KEY=VALUE) the
+// same way as in arguments.
+func (l *localExecutor) rewriteEnv(env []string, stage *pipeline.Stage) []string {
+	var rewritten []string
+	for _, variable := range env {
+		keyValue := strings.SplitN(variable, "=", 2)
+		if len(keyValue) == 2 {
+			variable = keyValue[0] + "=" + l.rewrite([]string{keyValue[1]}, stage)[0]
+		}
+		rewritten = append(rewritten, variable)
+	}
+	return rewritten
+}
+
+// Replaces the first container path (from) that is a prefix of the path with
+// its host path (to). Paths elsewhere in the argument are left alone.
+func rewritePath(arg string, paths [][2]string) string {
+	for _, path := range paths {
+		from, to := strings.TrimSuffix(path[0], "/"), strings.TrimSuffix(path[1], "/")
+		if arg == from || strings.HasPrefix(arg, from+"/") {
+			return to + strings.TrimPrefix(arg, from)
+		}
+	}
+	return arg
+}
+
+func (l *localExecutor) statePath() string {
+	return filepath.Join(createConfigPath(l.rootpath), "local")
+}
+
+func (l *localExecutor) logFilename(stage *pipeline.Stage) string {
+	return filepath.Join(l.statePath(), stage.Name+".log")
+}
+
+func (l *localExecutor) resultFilename(stage *pipeline.Stage) string {
+	return filepath.Join(l.statePath(), stage.Name+".json")
+}
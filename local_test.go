@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+func testLocalExecutor(t *testing.T) (*localExecutor, *pipeline.Pipeline) {
+	t.Helper()
+
+	rootpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(rootpath) })
+
+	l := &localExecutor{rootpath: rootpath}
+	p := &pipeline.Pipeline{Name: "p"}
+	err = l.Start(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, p
+}
+
+func TestLocalRewrite(t *testing.T) {
+	l := &localExecutor{rootpath: "/output"}
+	stage := &pipeline.Stage{Volumes: []string{"/host/data:/data"}}
+
+	rewritten := l.rewrite([]string{
+		"/walrus",
+		"/walrus/a/file",
+		"/data/input.csv",
+		"/database",
+		"/home/walrus/a",
+		"s|/walrus/|x|",
+		"--out=/walrus/a",
+	}, stage)
+	expected := []string{
+		"/output",
+		"/output/a/file",
+		"/host/data/input.csv",
+		"/database",
+		"/home/walrus/a",
+		"s|/walrus/|x|",
+		"--out=/walrus/a",
+	}
+	if !reflect.DeepEqual(rewritten, expected) {
+		t.Errorf("Got %q, expected %q", rewritten, expected)
+	}
+
+	env := l.rewriteEnv([]string{"OUT=/walrus/a", "PATTERN=a/walrus/b", "EMPTY"}, stage)
+	expected = []string{"OUT=/output/a", "PATTERN=a/walrus/b", "EMPTY"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Got environment %q, expected %q", env, expected)
+	}
+}
+
+func TestLocalRun(t *testing.T) {
+	l, p := testLocalExecutor(t)
+	hostpath := filepath.Join(l.rootpath, "a")
+	err := os.Mkdir(hostpath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stage := &pipeline.Stage{Name: "a", Entrypoint: []string{"sh", "-c"},
+		Cmd: []string{`echo $WALRUS > "$1"; echo failed; exit 3`, "sh", "/walrus/a/out"}}
+	err = l.Run(context.Background(), p, stage, hostpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(hostpath, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(b)) != l.rootpath {
+		t.Errorf("WALRUS is %q", b)
+	}
+
+	logs, err := l.Logs(context.Background(), stage)
+	if err != nil || strings.TrimSpace(logs) != "failed" {
+		t.Errorf("Got logs %q, %v", logs, err)
+	}
+
+	// The exit code is kept for later runs, e.g. to decide whether the
+	// stage can be cached.
+	cached := &localExecutor{rootpath: l.rootpath}
+	code, msg, err := cached.ExitCode(context.Background(), stage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 || msg == "" {
+		t.Errorf("Got exit code %d with error %q", code, msg)
+	}
+
+	// Running the stage again replaces the outcome of the previous run.
+	stage.Cmd = []string{"true"}
+	err = l.Run(context.Background(), p, stage, hostpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, msg, err = cached.ExitCode(context.Background(), stage)
+	if err != nil || code != 0 || msg != "" {
+		t.Errorf("Got exit code %d with error %q, %v", code, msg, err)
+	}
+}
+
+func TestLocalRunFailures(t *testing.T) {
+	l, p := testLocalExecutor(t)
+
+	stages := map[string]*pipeline.Stage{
+		"no command":      {Name: "a"},
+		"missing command": {Name: "b", Cmd: []string{"walrus-no-such-command"}},
+	}
+	for name, stage := range stages {
+		err := l.Run(context.Background(), p, stage, l.rootpath)
+		if err == nil {
+			t.Errorf("Running a stage with %s did not fail", name)
+		}
+		_, _, err = l.ExitCode(context.Background(), stage)
+		if err == nil {
+			t.Errorf("A stage with %s has an exit code", name)
+		}
+	}
+
+	// Cancelled stages do not complete.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stage := &pipeline.Stage{Name: "c", Cmd: []string{"sleep", "10"}}
+	err := l.Run(ctx, p, stage, l.rootpath)
+	if err == nil {
+		t.Error("A cancelled stage completed")
+	}
+	_, _, err = l.ExitCode(context.Background(), stage)
+	if err == nil {
+		t.Error("A cancelled stage has an exit code")
+	}
+}
+
+func TestLocalRejectsUnsupportedSettings(t *testing.T) {
+	l := &localExecutor{rootpath: os.TempDir()}
+
+	stages := map[string]pipeline.Stage{
+		"User":           {Security: pipeline.Security{User: "1000"}},
+		"CapDrop":        {Security: pipeline.Security{CapDrop: []string{"ALL"}}},
+		"ReadOnlyRootfs": {Security: pipeline.Security{ReadOnlyRootfs: true}},
+		"SeccompProfile": {Security: pipeline.Security{SeccompProfile: "unconfined"}},
+		"Network":        {Network: pipeline.NetworkNone},
+		"Resources":      {Resources: pipeline.Resources{Memory: "1g"}},
+	}
+	for setting, stage := range stages {
+		stage := stage
+		stage.Name = "a"
+		p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{&stage}}
+		err := l.Start(context.Background(), p)
+		if err == nil || !strings.Contains(err.Error(), setting) {
+			t.Errorf("A stage with %s was not rejected: %v", setting, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// A lock on an output directory. Only one walrus process at a time may write
+// to an output directory. The lock is an advisory lock on a file in the walrus
+// configuration directory, so it is released by the operating system if the
+// walrus process holding it dies.
+type outputLock struct {
+	file *os.File
+}
+
+// Returns the path of the lock file for an output directory.
+func lockFilename(hostpath string) string {
+	return filepath.Join(createConfigPath(hostpath), "lock")
+}
+
+// Locks the output directory. It returns an error without waiting if another
+// walrus process holds the lock.
+func lockOutput(hostpath string) (*outputLock, error) {
+	err := os.MkdirAll(createConfigPath(hostpath), 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create walrus configuration directory")
+	}
+
+	filename := lockFilename(hostpath)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open lock file")
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.New("Output directory " + hostpath +
+				" is in use by another walrus process" + lockHolder(filename))
+		}
+		return nil, errors.Wrap(err, "Could not lock output directory")
+	}
+
+	// Record who holds the lock to help users find the other process.
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	return &outputLock{file: file}, nil
+}
+
+// Releases the lock on the output directory. The lock file is left in place,
+// removing it could let two processes lock different files.
+func (lock *outputLock) unlock() error {
+	lock.file.Truncate(0)
+	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	return lock.file.Close()
+}
+
+// Returns a description of the process holding a lock, if it is known.
+func lockHolder(filename string) string {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	pid := strings.TrimSpace(string(b))
+	if pid == "" {
+		return ""
+	}
+	return " (pid " + pid + ")"
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	wcontainer "github.com/fjukstad/walrus/container"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of pipeline runs. Stage durations, image pulls, retries
+// and cache hits are recorded from the event stream of the runs, and the state
+// of the stages is read from the state of the running runs when the metrics
+// are scraped. Container CPU and memory usage is sampled by the docker
+// executor, and kept for every run until the container stops.
+type metrics struct {
+	registry *prometheus.Registry
+
+	stageDuration *prometheus.HistogramVec
+	pullDuration  *prometheus.HistogramVec
+	stageRuns     *prometheus.CounterVec
+	retries       *prometheus.CounterVec
+
+	mu     sync.Mutex
+	states []*runState
+	usage  map[usageKey]resourceUsage
+}
+
+// A stage container in a run.
+type usageKey struct {
+	pipeline, run, stage string
+}
+
+// The latest sample of the resource usage of a stage container. CPU is the
+// total CPU time used in seconds.
+type resourceUsage struct {
+	cpu    float64
+	memory float64
+}
+
+var (
+	stagesDesc = prometheus.NewDesc("walrus_stages",
+		"Number of stages in a pipeline run by state.",
+		[]string{"pipeline", "run", "state"}, nil)
+	cacheHitRatioDesc = prometheus.NewDesc("walrus_cache_hit_ratio",
+		"Fraction of the completed stages in a pipeline run that were cached.",
+		[]string{"pipeline", "run"}, nil)
+	cpuUsageDesc = prometheus.NewDesc("walrus_stage_cpu_seconds_total",
+		"CPU time used by the container of a running stage.",
+		[]string{"pipeline", "run", "stage"}, nil)
+	memoryUsageDesc = prometheus.NewDesc("walrus_stage_memory_usage_bytes",
+		"Memory used by the container of a running stage.",
+		[]string{"pipeline", "run", "stage"}, nil)
+)
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "walrus_stage_duration_seconds",
+			Help:    "Time it took to run a stage.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		}, []string{"pipeline", "stage", "status"}),
+		pullDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "walrus_image_pull_duration_seconds",
+			Help:    "Time it took to pull a stage image.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		}, []string{"image"}),
+		stageRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "walrus_stage_runs_total",
+			Help: "Number of completed stages.",
+		}, []string{"pipeline", "stage", "status", "cached"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "walrus_stage_retries_total",
+			Help: "Number of times starting a stage was retried.",
+		}, []string{"pipeline", "stage"}),
+		usage: make(map[usageKey]resourceUsage),
+	}
+
+	m.registry.MustRegister(m.stageDuration, m.pullDuration, m.stageRuns,
+		m.retries, m, prometheus.NewGoCollector())
+	return m
+}
+
+// Returns the HTTP handler serving the metrics in the Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Starts recording the metrics of a pipeline run. The stages of the run are
+// reported while it is running, and again if it is restarted.
+func (m *metrics) watch(state *runState) {
+	state.mu.Lock()
+	running := state.Status == statusRunning
+	state.mu.Unlock()
+	if running {
+		m.add(state)
+	}
+
+	state.events.listen(func(ev event) {
+		switch ev.Type {
+		case eventPipelineStarted:
+			m.add(state)
+		case eventPipelineFinished:
+			m.remove(state)
+		}
+		m.record(ev)
+	})
+}
+
+// Reports the stages of a run.
+func (m *metrics) add(state *runState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.states {
+		if s == state {
+			return
+		}
+	}
+	m.states = append(m.states, state)
+}
+
+// Stops reporting the stages of a completed run.
+func (m *metrics) remove(state *runState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, s := range m.states {
+		if s == state {
+			m.states = append(m.states[:i], m.states[i+1:]...)
+			return
+		}
+	}
+}
+
+// Records the metrics of an event.
+func (m *metrics) record(ev event) {
+	switch ev.Type {
+	case eventImagePulled:
+		m.pullDuration.WithLabelValues(ev.Image).Observe(ev.Duration.Seconds())
+	case eventStageRetry:
+		m.retries.WithLabelValues(ev.Pipeline, ev.Stage).Inc()
+	case eventStageFinished:
+		cached := "false"
+		if ev.Cached {
+			cached = "true"
+		} else {
+			m.stageDuration.WithLabelValues(ev.Pipeline, ev.Stage,
+				ev.Status).Observe(ev.Duration.Seconds())
+		}
+		m.stageRuns.WithLabelValues(ev.Pipeline, ev.Stage, ev.Status,
+			cached).Inc()
+	}
+}
+
+// Returns a function that records the resource usage of the container of a
+// stage in a run, or nil if metrics are not collected.
+func (m *metrics) sampler(pipeline, run, stage string) func(wcontainer.ContainerStats) {
+	if m == nil {
+		return nil
+	}
+	key := usageKey{pipeline, run, stage}
+	return func(stats wcontainer.ContainerStats) {
+		cpu := time.Duration(stats.CPUStats.CPUUsage.TotalUsage)
+		m.mu.Lock()
+		m.usage[key] = resourceUsage{cpu.Seconds(), float64(stats.MemoryUsage())}
+		m.mu.Unlock()
+	}
+}
+
+// Removes the resource usage of a stage in a run once its container has
+// stopped, so that completed stages are not reported as still using CPU and
+// memory.
+func (m *metrics) forget(pipeline, run, stage string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.usage, usageKey{pipeline, run, stage})
+	m.mu.Unlock()
+}
+
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stagesDesc
+	ch <- cacheHitRatioDesc
+	ch <- cpuUsageDesc
+	ch <- memoryUsageDesc
+}
+
+// Reports the number of stages in each state and the cache hit ratio of every
+// running run, and the resource usage of the running stage containers.
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, usage := range m.usage {
+		ch <- prometheus.MustNewConstMetric(cpuUsageDesc,
+			prometheus.CounterValue, usage.cpu, key.pipeline, key.run, key.stage)
+		ch <- prometheus.MustNewConstMetric(memoryUsageDesc,
+			prometheus.GaugeValue, usage.memory, key.pipeline, key.run, key.stage)
+	}
+
+	statuses := []string{statusQueued, statusPulling, statusRunning,
+		statusCached, statusSucceeded, statusFailed}
+
+	for _, state := range m.states {
+		state.mu.Lock()
+
+		counts := make(map[string]int)
+		completed, cached := 0, 0
+		for _, stage := range state.Stages {
+			counts[stage.Status]++
+			if stage.Status == statusSucceeded || stage.Status == statusFailed ||
+				stage.Status == statusCached {
+				completed++
+			}
+			if stage.Cached {
+				cached++
+			}
+		}
+
+		for _, status := range statuses {
+			ch <- prometheus.MustNewConstMetric(stagesDesc,
+				prometheus.GaugeValue, float64(counts[status]),
+				state.Pipeline, state.ID, status)
+		}
+
+		if completed > 0 {
+			ch <- prometheus.MustNewConstMetric(cacheHitRatioDesc,
+				prometheus.GaugeValue, float64(cached)/float64(completed),
+				state.Pipeline, state.ID)
+		}
+
+		state.mu.Unlock()
+	}
+}
+
+type metricsKey struct{}
+
+// Returns a context that carries the metrics, so that executors can record
+// the resource usage of the stages they run.
+func withMetrics(ctx context.Context, m *metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// Returns the metrics carried by the context, or nil.
+func metricsFrom(ctx context.Context) *metrics {
+	m, _ := ctx.Value(metricsKey{}).(*metrics)
+	return m
+}
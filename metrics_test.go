@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	wcontainer "github.com/fjukstad/walrus/container"
+	"github.com/fjukstad/walrus/pipeline"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsResourceUsageByRun(t *testing.T) {
+	m := newMetrics()
+
+	stats := wcontainer.ContainerStats{}
+	stats.CPUStats.CPUUsage.TotalUsage = 2e9
+	stats.MemoryStats.Usage = 1 << 20
+	m.sampler("p", "run1", "a")(stats)
+
+	// Another run of the same pipeline does not overwrite the samples.
+	stats.CPUStats.CPUUsage.TotalUsage = 5e8
+	m.sampler("p", "run2", "a")(stats)
+
+	expected := `
+# HELP walrus_stage_cpu_seconds_total CPU time used by the container of a running stage.
+# TYPE walrus_stage_cpu_seconds_total counter
+walrus_stage_cpu_seconds_total{pipeline="p",run="run1",stage="a"} 2
+walrus_stage_cpu_seconds_total{pipeline="p",run="run2",stage="a"} 0.5
+`
+	err := testutil.CollectAndCompare(m, strings.NewReader(expected),
+		"walrus_stage_cpu_seconds_total")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The stage of the first run completing leaves the second run alone.
+	m.forget("p", "run1", "a")
+	expected = `
+# HELP walrus_stage_memory_usage_bytes Memory used by the container of a running stage.
+# TYPE walrus_stage_memory_usage_bytes gauge
+walrus_stage_memory_usage_bytes{pipeline="p",run="run2",stage="a"} 1.048576e+06
+`
+	err = testutil.CollectAndCompare(m, strings.NewReader(expected),
+		"walrus_stage_memory_usage_bytes")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Metrics are optional.
+	var none *metrics
+	none.forget("p", "run1", "a")
+}
+
+func TestMetricsForgetCompletedRuns(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{{Name: "a"}}}
+	state, err := newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.events = newEventStream("run1", "p")
+
+	m := newMetrics()
+	m.watch(state)
+	if n := testutil.CollectAndCount(m, "walrus_stages"); n == 0 {
+		t.Error("No stages are reported for a running run")
+	}
+
+	state.finish(nil)
+	if n := testutil.CollectAndCount(m, "walrus_stages"); n != 0 {
+		t.Errorf("%d stage states are reported after the run completed", n)
+	}
+	if len(m.states) != 0 {
+		t.Errorf("%d runs are kept after the run completed", len(m.states))
+	}
+
+	// A restarted run is reported again.
+	state.events.emit(event{Type: eventPipelineStarted})
+	if n := testutil.CollectAndCount(m, "walrus_stages"); n == 0 {
+		t.Error("No stages are reported for a restarted run")
+	}
+}
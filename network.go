@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fjukstad/walrus/pipeline"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// Returns the name of the pipeline-private network for this run. Every run
+// gets its own network so that concurrent runs of the same pipeline can't
+// reach each other's stages.
+func (d *dockerExecutor) networkName() string {
+	name := "walrus-" + d.pipeline + "-" + d.runID
+	return invalidContainerNameChars.ReplaceAllString(name, "-")
+}
+
+// Creates the pipeline-private network if any of the stages have requested
+// it. The network is internal, meaning that stages can reach each other but
+// not the outside world.
+func (d *dockerExecutor) createPipelineNetwork(p *pipeline.Pipeline) error {
+	if !p.UsesPipelineNetwork() {
+		return nil
+	}
+
+	name := d.networkName()
+	_, err := d.client.NetworkCreate(context.Background(), name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Internal:       true,
+		Labels: map[string]string{
+			labelPipeline: d.pipeline,
+			labelOutput:   d.rootpath,
+			labelRun:      d.runID,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not create network "+name)
+	}
+	return nil
+}
+
+// Removes the pipeline-private network. It is not an error if the network
+// does not exist.
+func (d *dockerExecutor) removePipelineNetwork(p *pipeline.Pipeline) error {
+	if !p.UsesPipelineNetwork() {
+		return nil
+	}
+
+	name := d.networkName()
+	err := d.client.NetworkRemove(context.Background(), name)
+	if err != nil && !isNotFound(err) {
+		return errors.Wrap(err, "Could not remove network "+name)
+	}
+	return nil
+}
+
+// Removes pipeline-private networks left behind by previous runs of the
+// pipeline that writes to the output directory, e.g. runs that were stopped.
+func removePreviousNetworks(c *client.Client, p *pipeline.Pipeline, rootpath string) error {
+	args := filters.NewArgs()
+	args.Add("label", labelPipeline+"="+p.Name)
+	args.Add("label", labelOutput+"="+rootpath)
+
+	networks, err := c.NetworkList(context.Background(),
+		types.NetworkListOptions{Filters: args})
+	if err != nil {
+		return errors.Wrap(err, "Could not list networks")
+	}
+
+	for _, network := range networks {
+		err = c.NetworkRemove(context.Background(), network.ID)
+		if err != nil && !isNotFound(err) {
+			return errors.Wrap(err, "Could not remove network "+network.Name)
+		}
+	}
+	return nil
+}
+
+// Returns the Docker network mode for a stage, translating the
+// pipeline-private network setting into the name of the network walrus
+// created for this run.
+func (d *dockerExecutor) networkMode(stage *pipeline.Stage) string {
+	mode := stage.NetworkMode()
+	if mode == pipeline.NetworkPipeline {
+		return d.networkName()
+	}
+	return mode
+}
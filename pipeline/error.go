@@ -10,3 +10,12 @@ type NameError struct {
 func (ne *NameError) Error() string {
 	return fmt.Sprintf("Name Error: '%s' %s", ne.OffendingName, ne.Explanation)
 }
+
+type PolicyError struct {
+	Stage       string
+	Explanation string
+}
+
+func (pe *PolicyError) Error() string {
+	return fmt.Sprintf("Policy Error: stage '%s' %s", pe.Stage, pe.Explanation)
+}
@@ -1,6 +1,8 @@
 package pipeline
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -8,11 +10,15 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/docker/go-units"
 	"gopkg.in/yaml.v2"
 )
 
-var parallelIdentifier string = "_parallel_"
+// Separates the name of a stage from the index of its parallel copies, as in
+// stage_parallel_0.
+var ParallelIdentifier string = "_parallel_"
 
 // Parses the pipeline configuration and returns the pipeline. It will verify
 // that names are valid, find and replace variable names and create parallel
@@ -41,6 +47,13 @@ func ParseConfig(filename string) (*Pipeline, error) {
 
 	p.FixDependencies()
 
+	// The user stages without a user run as is not known until the pipeline
+	// is run, which checks the policy again.
+	err = CheckPolicy(p, "")
+	if err != nil {
+		return &p, err
+	}
+
 	return &p, nil
 }
 
@@ -95,9 +108,9 @@ func (p Pipeline) FixDependencies() {
 	for _, stage := range p.Stages {
 		// This is a parallelized stage, we'll need to find any dependent stages
 		// and update their list of "inputs"
-		if strings.Contains(stage.Name, parallelIdentifier) {
-			originalName := strings.Split(stage.Name, parallelIdentifier)[0]
-			parallelName := strings.Split(stage.Name, parallelIdentifier)[1]
+		if strings.Contains(stage.Name, ParallelIdentifier) {
+			originalName := strings.Split(stage.Name, ParallelIdentifier)[0]
+			parallelName := strings.Split(stage.Name, ParallelIdentifier)[1]
 			for _, dependentStage := range p.Stages {
 				if dependentStage.Name != stage.Name {
 					// Stage has parallel stage as a dependency
@@ -105,12 +118,12 @@ func (p Pipeline) FixDependencies() {
 						// Dependent stage is itself a parallel stage. Find and
 						// replace all occurences of the 'non-parallel' name
 						// with the newly updated one
-						if strings.HasSuffix(dependentStage.Name, parallelIdentifier+parallelName) {
+						if strings.HasSuffix(dependentStage.Name, ParallelIdentifier+parallelName) {
 							dependentStage.Inputs = sliceReplaceMatching(dependentStage.Inputs, originalName, stage.Name, -1)
-						} else if !strings.Contains(dependentStage.Name, parallelIdentifier) {
+						} else if !strings.Contains(dependentStage.Name, ParallelIdentifier) {
 							// If dependent stage has any parallel stages as
 							// input, add the stage to this list.
-							if sliceContains(dependentStage.Inputs, parallelIdentifier) {
+							if sliceContains(dependentStage.Inputs, ParallelIdentifier) {
 								dependentStage.Inputs = append(dependentStage.Inputs, stage.Name)
 							} else {
 								// if not find and replace all matching
@@ -163,6 +176,7 @@ func (stage Stage) String() string {
 	str += "\t Env: " + strings.Join(stage.Env, " ") + "\n"
 	str += "\t Inputs: " + strings.Join(stage.Inputs, " ") + "\n"
 	str += "\t Volumes: " + strings.Join(stage.Volumes, " ") + "\n"
+	str += "\t Network: " + stage.NetworkMode() + "\n"
 	//str +=\t  "Parallelism:" + stage.Parallelism + "\n"
 	//str +=\t  "Cache:" + stage.Cache + "\n"
 	//str +=\t  "Mount Propagation:" + stage.MountPropagation + "\n"
@@ -173,6 +187,68 @@ func (stage Stage) String() string {
 	return str
 }
 
+// Returns the network the stage should be attached to. Stages default to
+// having no network access.
+func (stage Stage) NetworkMode() string {
+	if stage.Network == "" {
+		return NetworkNone
+	}
+	return stage.Network
+}
+
+// Returns the maximum time the stage is allowed to run, or 0 if the stage has
+// no timeout. The timeout is given as a duration string, e.g. "1h30m".
+func (stage Stage) TimeoutDuration() (time.Duration, error) {
+	if stage.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(stage.Timeout)
+	if err != nil {
+		return 0, errors.New("Invalid timeout for stage " + stage.Name + ": " + err.Error())
+	}
+	return timeout, nil
+}
+
+// Returns the memory limit of the stage in bytes, or 0 if the stage has no
+// memory limit.
+func (r Resources) MemoryBytes() (int64, error) {
+	if r.Memory == "" {
+		return 0, nil
+	}
+	return units.RAMInBytes(r.Memory)
+}
+
+// Returns true if any of the pipeline stages use the pipeline-private network.
+func (p Pipeline) UsesPipelineNetwork() bool {
+	for _, stage := range p.Stages {
+		if stage.NetworkMode() == NetworkPipeline {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a key identifying the configuration of the stage. Two runs of a
+// stage with the same key run the same image with the same command, inputs
+// and settings, so the output of one can be used in place of the other.
+func (stage Stage) CacheKey() string {
+	b, _ := json.Marshal(struct {
+		Image            string
+		Entrypoint       []string
+		Cmd              []string
+		Env              []string
+		Inputs           []string
+		Volumes          []string
+		MountPropagation string
+		Network          string
+		Security         Security
+	}{stage.Image, stage.Entrypoint, stage.Cmd, stage.Env, stage.Inputs,
+		stage.Volumes, stage.MountPropagation, stage.Network, stage.Security})
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 // Checks if a string maches an item within a slice.
 func inSlice(s []string, substr string) bool {
 	for _, str := range s {
@@ -277,8 +353,8 @@ func CheckNames(p Pipeline) error {
 				"Stage name should be a single word without any special characters"}
 		}
 
-		if strings.Contains(stage.Name, parallelIdentifier) {
-			return &NameError{stage.Name, "Stage names should not contain " + parallelIdentifier}
+		if strings.Contains(stage.Name, ParallelIdentifier) {
+			return &NameError{stage.Name, "Stage names should not contain " + ParallelIdentifier}
 		}
 	}
 	return nil
@@ -297,3 +373,49 @@ func badName(name string) bool {
 
 	return false
 }
+
+// Verify that the security settings of all pipeline stages comply with the
+// pipeline policy. Stages that do not set a user run as defaultUser, which is
+// empty if it is not known.
+func CheckPolicy(p Pipeline, defaultUser string) error {
+	policy := p.Policy
+	for _, stage := range p.Stages {
+		security := stage.Security
+
+		if policy.ForbidCapAdd && len(security.CapAdd) > 0 {
+			return &PolicyError{stage.Name, "adds capabilities, which the pipeline policy forbids"}
+		}
+
+		user := security.User
+		if user == "" {
+			user = defaultUser
+		}
+		if policy.ForbidRootUser && isRootUser(user) {
+			return &PolicyError{stage.Name, "runs as root, which the pipeline policy forbids"}
+		}
+
+		if policy.ForbidUnconfined && security.SeccompProfile == "unconfined" {
+			return &PolicyError{stage.Name, "runs without a seccomp profile, which the pipeline policy forbids"}
+		}
+
+		if policy.RequireReadOnlyRootfs && !security.ReadOnlyRootfs {
+			return &PolicyError{stage.Name, "must have a read-only root filesystem"}
+		}
+
+		if policy.RequireNoNewPrivileges && !security.NoNewPrivileges {
+			return &PolicyError{stage.Name, "must set NoNewPrivileges"}
+		}
+
+		network := stage.NetworkMode()
+		if policy.RequirePrivateNetwork && network != NetworkNone && network != NetworkPipeline {
+			return &PolicyError{stage.Name, "uses the " + network + " network, which the pipeline policy forbids"}
+		}
+	}
+	return nil
+}
+
+// Checks if a user on the form user[:group] refers to the root user.
+func isRootUser(user string) bool {
+	name := strings.Split(user, ":")[0]
+	return name == "root" || name == "0"
+}
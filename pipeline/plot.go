@@ -43,11 +43,15 @@ func (e Edge) ID() int64 {
 	return e.id
 }
 
+func (e Edge) ReversedEdge() graph.Edge {
+	return Edge{F: e.T, T: e.F, id: e.id}
+}
+
 func (p *Pipeline) WriteDOT(filename string) error {
 
 	graph := p.createGraph()
 
-	b, err := dot.Marshal(graph, p.Name, "", "", false)
+	b, err := dot.Marshal(graph, p.Name, "", "")
 	if err != nil {
 		return errors.Wrap(err, "Could not marshal graph")
 	}
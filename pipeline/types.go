@@ -7,6 +7,7 @@ type Pipeline struct {
 	Stages    []*Stage
 	Comment   string
 	Variables []Variable
+	Policy    Policy
 	Commit    bool
 	Runtime   time.Duration
 	Version   string
@@ -29,9 +30,71 @@ type Stage struct {
 	Cache            bool
 	Comment          string
 	MountPropagation string
+	Network          string
+	Security         Security
+	Resources        Resources
+	Timeout          string
 	Version          string
 	remove           bool
 	Runtime          time.Duration
+	Retries          int
+	Profile          *ResourceUsage `json:",omitempty" yaml:"profile,omitempty"`
+}
+
+// The resource usage of a stage that ran with profiling. CPU percentages are
+// of a single CPU, and block IO and network bytes are totals for the stage.
+type ResourceUsage struct {
+	PeakMemory     int64
+	MeanCPUPercent float64
+	MaxCPUPercent  float64
+	BlockRead      int64
+	BlockWrite     int64
+	NetworkRx      int64
+	NetworkTx      int64
+}
+
+// Network settings for a stage. Stages without a network setting are run
+// without any network access. Any other value is taken as the name of an
+// existing Docker network, e.g. "bridge" for the default Docker networking.
+const (
+	NetworkNone     = "none"
+	NetworkPipeline = "pipeline"
+)
+
+// Security settings for the container running a stage. User overrides the
+// default of running stages as the user that started walrus. Tmpfs lists
+// scratch directories (path[:options]) mounted in the container, which is
+// useful in combination with a read-only root filesystem. SeccompProfile is the
+// path to a seccomp profile on the host, or "unconfined".
+type Security struct {
+	User            string
+	CapAdd          []string
+	CapDrop         []string
+	ReadOnlyRootfs  bool
+	Tmpfs           []string
+	NoNewPrivileges bool
+	SeccompProfile  string
+}
+
+// Compute resources available to a stage. CPUs is the number of CPUs the stage
+// may use (e.g. 0.5 or 4) and Memory the maximum amount of memory, e.g. "512m"
+// or "4g". Zero values mean no limit.
+type Resources struct {
+	CPUs   float64
+	Memory string
+}
+
+// A pipeline-wide security policy. Pipelines with stages that violate the
+// policy are rejected when the pipeline description is parsed.
+// RequirePrivateNetwork only allows the none and pipeline networks, so stages
+// can't use the host network or join other Docker networks.
+type Policy struct {
+	ForbidCapAdd           bool
+	ForbidRootUser         bool
+	ForbidUnconfined       bool
+	RequireReadOnlyRootfs  bool
+	RequireNoNewPrivileges bool
+	RequirePrivateNetwork  bool
 }
 
 type Parallelism struct {
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+)
+
+// Configuration of a pool of Docker hosts. Stages write their output to the
+// same output directory no matter which host they run on, so the output
+// directory must be on a filesystem that all hosts share and mounted at the
+// same path on every host. SharedFilesystem declares that this is the case.
+type poolConfig struct {
+	SharedFilesystem bool
+	Hosts            []poolHostConfig
+}
+
+// A Docker host in the pool. Capacity is the number of stages that can run
+// on the host at the same time.
+type poolHostConfig struct {
+	Address  string
+	Capacity int
+}
+
+// A Docker host in the pool and the number of stages currently running on it.
+type poolHost struct {
+	address  string
+	capacity int
+	running  int
+	docker   *dockerExecutor
+}
+
+// Runs pipeline stages as Docker containers on a pool of Docker hosts. Ready
+// stages are placed on the least loaded host that has a free slot, and wait
+// for a slot if all hosts are busy.
+type poolExecutor struct {
+	hosts []*poolHost
+
+	mu    sync.Mutex
+	freed *sync.Cond
+
+	// The host each stage ran on in this run.
+	placements map[string]*poolHost
+}
+
+// Reads a pool configuration file and connects to all hosts in the pool.
+func newPoolExecutor(filename, runtime, rootpath, runID string) (*poolExecutor, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read host pool configuration")
+	}
+
+	config := poolConfig{}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse host pool configuration")
+	}
+
+	if len(config.Hosts) == 0 {
+		return nil, errors.New("No hosts in host pool configuration " + filename)
+	}
+
+	if !config.SharedFilesystem {
+		return nil, errors.New("Running stages on a pool of hosts requires " +
+			"the output directory to be on a shared filesystem. Set " +
+			"SharedFilesystem in " + filename + " once it is")
+	}
+
+	pool := &poolExecutor{placements: make(map[string]*poolHost)}
+	pool.freed = sync.NewCond(&pool.mu)
+
+	for _, host := range config.Hosts {
+		if host.Capacity < 1 {
+			return nil, errors.New("Host " + host.Address + " must have a capacity of at least 1")
+		}
+
+		c, err := newClient(runtime, host.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		pool.hosts = append(pool.hosts, &poolHost{
+			address:  host.Address,
+			capacity: host.Capacity,
+			docker:   newDockerExecutor(c, runtime, rootpath, runID),
+		})
+	}
+
+	return pool, nil
+}
+
+// Returns the total number of stages that can run at the same time.
+func (pool *poolExecutor) capacity() int {
+	capacity := 0
+	for _, host := range pool.hosts {
+		capacity += host.capacity
+	}
+	return capacity
+}
+
+// Stops previous runs on all hosts. The pipeline-private network is local to
+// a single host, so stages on different hosts would not be able to reach each
+// other on it.
+func (pool *poolExecutor) Start(ctx context.Context, p *pipeline.Pipeline) error {
+	if p.UsesPipelineNetwork() && len(pool.hosts) > 1 {
+		return errors.New("The pipeline network can't be used when running " +
+			"stages on a pool of hosts")
+	}
+
+	for _, host := range pool.hosts {
+		err := host.docker.Start(ctx, p)
+		if err != nil {
+			return errors.Wrap(err, "Could not start pipeline on "+host.address)
+		}
+	}
+	return nil
+}
+
+// Stops the pipeline on all hosts, also if it could not be stopped on some of
+// them. The first error is returned and the others are logged.
+func (pool *poolExecutor) Stop(ctx context.Context, p *pipeline.Pipeline) error {
+	var stopErr error
+	for _, host := range pool.hosts {
+		err := host.docker.Stop(ctx, p)
+		if err == nil {
+			continue
+		}
+		err = errors.Wrap(err, "Could not stop pipeline on "+host.address)
+		if stopErr == nil {
+			stopErr = err
+		} else {
+			log.Println("Warning:", err)
+		}
+	}
+	return stopErr
+}
+
+// Images are pulled once the stage has been placed on a host.
+func (pool *poolExecutor) Prepare(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage) error {
+	return nil
+}
+
+func (pool *poolExecutor) Run(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage, hostpath string) error {
+	host, err := pool.acquire(ctx, stage)
+	if err != nil {
+		return err
+	}
+	defer pool.release(host)
+
+	log.Println("Running stage", stage.Name, "on", host.address)
+
+	// Earlier runs of the stage may have run on other hosts. Their
+	// containers are removed so that they are not mistaken for a cached run
+	// of the stage later.
+	for _, other := range pool.hosts {
+		if other != host {
+			other.docker.removePreviousContainers(ctx, stage)
+		}
+	}
+
+	err = host.docker.Prepare(ctx, p, stage)
+	if err != nil {
+		return errors.Wrap(err, "Could not prepare stage on "+host.address)
+	}
+
+	return host.docker.Run(ctx, p, stage, hostpath)
+}
+
+// Returns the exit code of the stage from the host it ran on. Cached stages
+// may have run on any host in a previous run, so all hosts are searched for
+// the most recent run.
+func (pool *poolExecutor) ExitCode(ctx context.Context, stage *pipeline.Stage) (int, string, error) {
+	host, err := pool.find(ctx, stage)
+	if err != nil {
+		return 0, "", err
+	}
+	return host.docker.ExitCode(ctx, stage)
+}
+
+func (pool *poolExecutor) Logs(ctx context.Context, stage *pipeline.Stage) (string, error) {
+	host, err := pool.find(ctx, stage)
+	if err != nil {
+		return "", err
+	}
+	return host.docker.Logs(ctx, stage)
+}
+
+// Waits for a free slot and places the stage on the least loaded host. It
+// stops waiting when ctx is done.
+func (pool *poolExecutor) acquire(ctx context.Context, stage *pipeline.Stage) (*poolHost, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	// Wake up the wait below when the context is done. Taking the lock
+	// first makes sure that the wait has started, or that the context is
+	// checked before waiting.
+	waiting := make(chan struct{})
+	defer close(waiting)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pool.mu.Lock()
+			pool.mu.Unlock()
+			pool.freed.Broadcast()
+		case <-waiting:
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), "Stage "+stage.Name+" did not start")
+		}
+
+		var best *poolHost
+		for _, host := range pool.hosts {
+			if host.running >= host.capacity {
+				continue
+			}
+			if best == nil || load(host) < load(best) ||
+				(load(host) == load(best) && host.capacity > best.capacity) {
+				best = host
+			}
+		}
+
+		if best != nil {
+			best.running++
+			pool.placements[stage.Name] = best
+			return best, nil
+		}
+
+		pool.freed.Wait()
+	}
+}
+
+// Frees the slot a stage used on a host.
+func (pool *poolExecutor) release(host *poolHost) {
+	pool.mu.Lock()
+	host.running--
+	pool.mu.Unlock()
+	pool.freed.Broadcast()
+}
+
+// Returns the host a stage ran on, either in this run or a previous one. If
+// containers of previous runs are on several hosts the host with the most
+// recent one is used.
+func (pool *poolExecutor) find(ctx context.Context, stage *pipeline.Stage) (*poolHost, error) {
+	pool.mu.Lock()
+	host, ok := pool.placements[stage.Name]
+	pool.mu.Unlock()
+	if ok {
+		return host, nil
+	}
+
+	var latest *poolHost
+	var created int64
+	for _, host := range pool.hosts {
+		container, err := host.docker.latestContainer(ctx, stage)
+		if err != nil {
+			continue
+		}
+		if latest == nil || container.Created > created {
+			latest, created = host, container.Created
+		}
+	}
+	if latest == nil {
+		return nil, errors.New("Could not find a container for stage " + stage.Name + " on any host")
+	}
+
+	pool.mu.Lock()
+	pool.placements[stage.Name] = latest
+	pool.mu.Unlock()
+	return latest, nil
+}
+
+// Returns the fraction of a host's slots that are in use.
+func load(host *poolHost) float64 {
+	return float64(host.running) / float64(host.capacity)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+func TestPoolAcquireStopsWhenCancelled(t *testing.T) {
+	pool := &poolExecutor{placements: make(map[string]*poolHost)}
+	pool.freed = sync.NewCond(&pool.mu)
+	pool.hosts = []*poolHost{{address: "busy", capacity: 1, running: 1}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		_, err := pool.acquire(ctx, &pipeline.Stage{Name: "stage"})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("A stage was placed on a host without free slots")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting for a free slot did not stop when the run was cancelled")
+	}
+}
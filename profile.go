@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	wcontainer "github.com/fjukstad/walrus/container"
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+)
+
+var profileTemplate = template.Must(template.New("profile.html").Funcs(template.FuncMap{
+	"bytes":     formatBytes,
+	"percent":   formatPercent,
+	"resources": formatResources,
+}).ParseFS(assets, "assets/profile.html"))
+
+func profileCommand() *command {
+	cmd := newCommand("profile", "report [DIR...]",
+		"Write a report of the resource usage of profiled pipeline runs.")
+	cmd.description = "Reads the profiles that `walrus run -profile` wrote to the output\n" +
+		"directories DIR (default walrus) and the resource usage recorded in their\n" +
+		"run history, plots the CPU, memory, block IO and network usage of every\n" +
+		"stage over time, and suggests CPU and memory limits for every stage from the\n" +
+		"peaks observed across all runs. Give several output directories, or the\n" +
+		"directory of walrus serve, to compare runs."
+
+	reportDir := cmd.flags.String("report", "walrus-profile",
+		"directory to write the report and plots to")
+	format := cmd.flags.String("format", "svg", "image format of the plots (svg or png)")
+	headroom := cmd.flags.Float64("headroom", 1.25,
+		"factor the observed peaks are multiplied by to suggest limits")
+
+	cmd.run = func(args []string) error {
+		if len(args) == 0 || args[0] != "report" {
+			cmd.usage(os.Stderr)
+			return errors.New("profile requires a subcommand: report")
+		}
+
+		// Flags may also be given after the subcommand.
+		err := cmd.flags.Parse(args[1:])
+		if err == flag.ErrHelp {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if *format != "svg" && *format != "png" {
+			return errors.New("Unsupported plot format " + *format + ", must be svg or png")
+		}
+		if *headroom < 1 {
+			return errors.New("The headroom must be at least 1")
+		}
+
+		dirs := cmd.flags.Args()
+		if len(dirs) == 0 {
+			dirs = []string{"walrus"}
+		}
+
+		report, err := readProfiles(dirs)
+		if err != nil {
+			return err
+		}
+		if len(report.Stages) == 0 {
+			return errors.New("No profiles found in " + strings.Join(dirs, ", ") +
+				", run the pipeline with walrus run -profile")
+		}
+		report.recommend(*headroom)
+
+		err = report.write(*reportDir, *format)
+		if err != nil {
+			return err
+		}
+
+		err = report.print(os.Stdout)
+		if err != nil {
+			return err
+		}
+		log.Println("Profile report was written to:", filepath.Join(*reportDir, "index.html"))
+		return nil
+	}
+	return cmd
+}
+
+// The resource usage of the stages of one or more pipeline runs.
+type profileReport struct {
+	Generated time.Time
+	Headroom  float64
+	Stages    []*stageUsage
+}
+
+// The resource usage of a stage across runs. Series are the profiles of the
+// stage, one for every run output directory, and Runs the number of recorded
+// runs with a summary of the resource usage of the stage. Limits are the
+// resources of the stage in its most recently recorded run.
+type stageUsage struct {
+	Name          string
+	Series        []profileSeries
+	Runs          int
+	PeakMemory    int64
+	MaxCPUPercent float64
+	Limits        pipeline.Resources
+	Recommended   pipeline.Resources
+	Plots         []string
+}
+
+// The samples of a profile of a stage, labeled with the output directory of
+// the run.
+type profileSeries struct {
+	Label   string
+	Samples []profileSample
+}
+
+// A sample of the resource usage of a stage container. Time is since the first
+// sample of the profile, and block IO and network usage are in bytes per
+// second since the previous sample.
+type profileSample struct {
+	Time       time.Duration
+	CPUPercent float64
+	Memory     int64
+	BlockRead  float64
+	BlockWrite float64
+	NetworkRx  float64
+	NetworkTx  float64
+}
+
+// Finds the profile files in the output directories and the resource usage
+// recorded in their run history. Profiles are written to the top level of the
+// output directory of every stage. Profiles that can't be read are skipped.
+func readProfiles(dirs []string) (*profileReport, error) {
+	report := &profileReport{Generated: time.Now()}
+	stages := make(map[string]*stageUsage)
+	stage := func(name string) *stageUsage {
+		if _, ok := stages[name]; !ok {
+			stages[name] = &stageUsage{Name: name}
+		}
+		return stages[name]
+	}
+
+	runDirs := make(map[string]bool)
+	for _, dir := range dirs {
+		outputs, err := outputDirs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, output := range outputs {
+			runDirs[output] = true
+
+			stageDirs, err := ioutil.ReadDir(output)
+			if err != nil {
+				return nil, errors.Wrap(err, "Could not list output directory "+output)
+			}
+			for _, stageDir := range stageDirs {
+				if !stageDir.IsDir() || strings.HasPrefix(stageDir.Name(), ".") {
+					continue
+				}
+
+				path := filepath.Join(output, stageDir.Name())
+				files, err := ioutil.ReadDir(path)
+				if err != nil {
+					log.Println("Warning: Could not list", path+":", err)
+					continue
+				}
+
+				for _, info := range files {
+					name, ok := profileStageName(info)
+					if !ok {
+						continue
+					}
+
+					filename := filepath.Join(path, info.Name())
+					samples, err := readProfile(filename)
+					if err != nil {
+						log.Println("Warning: Skipping", filename+":", err)
+						continue
+					}
+					if len(samples) == 0 {
+						continue
+					}
+
+					s := stage(name)
+					s.Series = append(s.Series, profileSeries{Label: output, Samples: samples})
+					for _, sample := range samples {
+						s.observe(sample.Memory, sample.CPUPercent)
+					}
+				}
+			}
+		}
+	}
+
+	var sorted []string
+	for dir := range runDirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	for _, dir := range sorted {
+		ids, err := runIDs(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			record, err := readRunRecord(dir, id)
+			if err != nil {
+				// Runs that were started before runs were recorded, or that
+				// have not completed, have no record.
+				continue
+			}
+			for _, st := range record.Pipeline.Stages {
+				s := stage(st.Name)
+				s.Limits = st.Resources
+				if st.Profile == nil {
+					continue
+				}
+				s.Runs++
+				s.observe(st.Profile.PeakMemory, st.Profile.MaxCPUPercent)
+			}
+		}
+	}
+
+	for _, s := range stages {
+		if s.PeakMemory > 0 || s.MaxCPUPercent > 0 {
+			report.Stages = append(report.Stages, s)
+		}
+	}
+	sort.Slice(report.Stages, func(i, j int) bool {
+		return report.Stages[i].Name < report.Stages[j].Name
+	})
+	for _, s := range report.Stages {
+		sort.Slice(s.Series, func(i, j int) bool {
+			return s.Series[i].Label < s.Series[j].Label
+		})
+	}
+	return report, nil
+}
+
+// Returns the output directories in a directory given to the report: the
+// output directories of the runs in it if it is the directory of walrus
+// serve, and otherwise the directory itself.
+func outputDirs(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(createConfigPath(dir)); err == nil {
+		return []string{dir}, nil
+	}
+
+	runs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read profiles in "+dir)
+	}
+
+	var outputs []string
+	for _, run := range runs {
+		output := (&serverRun{dir: filepath.Join(dir, run.Name())}).hostpath()
+		if _, err := os.Stat(createConfigPath(output)); run.IsDir() && err == nil {
+			outputs = append(outputs, output)
+		}
+	}
+	if len(outputs) == 0 {
+		return []string{dir}, nil
+	}
+	return outputs, nil
+}
+
+// Returns the name of the stage a profile file is of, and false if the file
+// is not a profile. Profiles are JSON lines, or a JSON array in profiles
+// written by earlier versions of walrus.
+func profileStageName(info os.FileInfo) (string, bool) {
+	name := info.Name()
+	if !info.Mode().IsRegular() || !strings.HasPrefix(name, "profile-") {
+		return "", false
+	}
+	for _, ext := range []string{".jsonl", ".json"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(strings.TrimPrefix(name, "profile-"), ext), true
+		}
+	}
+	return "", false
+}
+
+// Reads the container statistics in a profile file and returns the resource
+// usage they add up to.
+func readProfile(filename string) ([]profileSample, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open profile")
+	}
+	defer f.Close()
+
+	var stats []wcontainer.ContainerStats
+	if strings.HasSuffix(filename, ".jsonl") {
+		decoder := json.NewDecoder(f)
+		for {
+			s := wcontainer.ContainerStats{}
+			err := decoder.Decode(&s)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "Could not parse profile "+filename)
+			}
+			stats = append(stats, s)
+		}
+	} else {
+		err = json.NewDecoder(f).Decode(&stats)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not parse profile "+filename)
+		}
+	}
+
+	var samples []profileSample
+	for i, s := range stats {
+		sample := profileSample{Memory: s.MemoryUsage()}
+		if i > 0 {
+			previous := stats[i-1]
+			// Profiles written by earlier versions of walrus have no
+			// statistics of the previous sample Docker took.
+			if s.PrecpuStats.SystemCPUUsage == 0 {
+				s.PrecpuStats = previous.CPUStats
+			}
+			sample.BlockRead, sample.BlockWrite = s.BlockIORate(previous)
+			sample.NetworkRx, sample.NetworkTx = s.NetworkRate(previous)
+		}
+		sample.CPUPercent = s.CPUPercent()
+		if !s.Read.IsZero() && !stats[0].Read.IsZero() {
+			sample.Time = s.Read.Sub(stats[0].Read)
+		} else {
+			sample.Time = time.Duration(i) * time.Second
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// Adds an observed memory usage and CPU percentage to the peaks of the stage.
+func (s *stageUsage) observe(memory int64, cpuPercent float64) {
+	if memory > s.PeakMemory {
+		s.PeakMemory = memory
+	}
+	if cpuPercent > s.MaxCPUPercent {
+		s.MaxCPUPercent = cpuPercent
+	}
+}
+
+// Suggests limits for every stage: the observed peaks multiplied by the
+// headroom, with CPUs rounded up to a quarter of a CPU and memory rounded up to
+// a mebibyte.
+func (r *profileReport) recommend(headroom float64) {
+	r.Headroom = headroom
+	for _, s := range r.Stages {
+		if s.MaxCPUPercent > 0 {
+			cpus := s.MaxCPUPercent / 100 * headroom
+			s.Recommended.CPUs = math.Ceil(cpus*4) / 4
+		}
+		if s.PeakMemory > 0 {
+			mib := math.Ceil(float64(s.PeakMemory) * headroom / (1 << 20))
+			s.Recommended.Memory = fmt.Sprintf("%.0fm", mib)
+		}
+	}
+}
+
+// Writes the plots of every stage and an HTML page with the plots and the
+// suggested limits to dir.
+func (r *profileReport) write(dir, format string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Could not create report directory")
+	}
+
+	for _, s := range r.Stages {
+		if len(s.Series) == 0 {
+			continue
+		}
+		for _, m := range profileMetrics {
+			filename := s.Name + "-" + m.name + "." + format
+			err := s.plot(m, filepath.Join(dir, filename))
+			if err != nil {
+				return err
+			}
+			s.Plots = append(s.Plots, filename)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return errors.Wrap(err, "Could not create report")
+	}
+	defer f.Close()
+
+	err = profileTemplate.Execute(f, r)
+	if err != nil {
+		return errors.Wrap(err, "Could not write report")
+	}
+	return f.Close()
+}
+
+// A resource plotted over time. Values returns the values of a sample to plot,
+// one line for each, in the unit of the plot.
+type profileMetric struct {
+	name   string
+	title  string
+	unit   string
+	lines  []string
+	values func(profileSample) []float64
+}
+
+var profileMetrics = []profileMetric{
+	{"cpu", "CPU", "% of a CPU", []string{""},
+		func(s profileSample) []float64 { return []float64{s.CPUPercent} }},
+	{"memory", "Memory", "MiB", []string{""},
+		func(s profileSample) []float64 { return []float64{float64(s.Memory) / (1 << 20)} }},
+	{"blockio", "Block IO", "MiB/s", []string{"read", "write"},
+		func(s profileSample) []float64 {
+			return []float64{s.BlockRead / (1 << 20), s.BlockWrite / (1 << 20)}
+		}},
+	{"network", "Network", "MiB/s", []string{"rx", "tx"},
+		func(s profileSample) []float64 {
+			return []float64{s.NetworkRx / (1 << 20), s.NetworkTx / (1 << 20)}
+		}},
+}
+
+// Plots a resource over time with a line for every profile of the stage.
+func (s *stageUsage) plot(m profileMetric, filename string) error {
+	p := plot.New()
+	p.Title.Text = s.Name + ": " + m.title
+	p.X.Label.Text = "seconds"
+	p.Y.Label.Text = m.unit
+	p.Y.Min = 0
+	p.Legend.Top = true
+
+	var lines []interface{}
+	for _, series := range s.Series {
+		for i, line := range m.lines {
+			xys := make(plotter.XYs, len(series.Samples))
+			for j, sample := range series.Samples {
+				xys[j].X = sample.Time.Seconds()
+				xys[j].Y = m.values(sample)[i]
+			}
+
+			label := series.Label
+			if line != "" {
+				label += " " + line
+			}
+			lines = append(lines, label, xys)
+		}
+	}
+
+	err := plotutil.AddLines(p, lines...)
+	if err != nil {
+		return errors.Wrap(err, "Could not plot "+m.title+" of stage "+s.Name)
+	}
+
+	err = p.Save(8*vg.Inch, 4*vg.Inch, filename)
+	if err != nil {
+		return errors.Wrap(err, "Could not write plot "+filename)
+	}
+	return nil
+}
+
+// Prints the peaks and the suggested limits of every stage.
+func (r *profileReport) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tPROFILES\tRUNS\tPEAK MEMORY\tMAX CPU\tLIMITS\tSUGGESTED LIMITS")
+	for _, s := range r.Stages {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", s.Name, len(s.Series),
+			s.Runs, formatBytes(s.PeakMemory), formatPercent(s.MaxCPUPercent),
+			formatResources(s.Limits), formatResources(s.Recommended))
+	}
+	return tw.Flush()
+}
+
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
+
+func formatPercent(percent float64) string {
+	return fmt.Sprintf("%.0f%%", percent)
+}
+
+// Formats resources the way they are given in a pipeline description.
+func formatResources(r pipeline.Resources) string {
+	var s []string
+	if r.CPUs > 0 {
+		s = append(s, fmt.Sprintf("CPUs %g", r.CPUs))
+	}
+	if r.Memory != "" {
+		s = append(s, "Memory "+r.Memory)
+	}
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.Join(s, ", ")
+}
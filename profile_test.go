@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadProfilesOnlyReadsStageDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sample := `{"read": "2026-01-01T00:00:00Z", "memory_stats": {"usage": 1048576}}` + "\n"
+	write := func(path, contents string) {
+		path = filepath.Join(dir, path)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a/profile-a.jsonl", sample)
+	// A file in the output of a stage that happens to be named like a profile.
+	write("a/data/profile-b.jsonl", sample)
+	// A profile that can't be parsed is skipped.
+	write("c/profile-c.jsonl", "not json")
+
+	report, err := readProfiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Stages) != 1 || report.Stages[0].Name != "a" {
+		var names []string
+		for _, stage := range report.Stages {
+			names = append(names, stage.Name)
+		}
+		t.Fatalf("Got profiles of stages %v, expected only a", names)
+	}
+	if len(report.Stages[0].Series) != 1 || report.Stages[0].Series[0].Label != dir {
+		t.Errorf("Got series %+v", report.Stages[0].Series)
+	}
+}
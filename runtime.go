@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// Container runtimes walrus can talk to. Podman is supported through its
+// Docker-compatible API socket.
+const (
+	runtimeDocker = "docker"
+	runtimePodman = "podman"
+)
+
+// Returns the user id walrus runs as.
+var getuid = os.Getuid
+
+// Creates a client for the given container runtime. If host is empty the
+// Docker client uses the DOCKER_HOST environment variable (or the default
+// Docker socket), while the Podman client uses the socket of the current
+// user's Podman service.
+func newClient(runtime, host string) (*client.Client, error) {
+	switch runtime {
+	case runtimeDocker:
+	case runtimePodman:
+		if host == "" {
+			host = defaultPodmanHost()
+		}
+	default:
+		return nil, errors.New("Unknown container runtime " + runtime +
+			", must be " + runtimeDocker + " or " + runtimePodman)
+	}
+
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+
+	c, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create "+runtime+" client")
+	}
+
+	return c, nil
+}
+
+// Returns the socket of the Podman service. Rootless Podman listens on a
+// socket in the user's runtime directory, while rootful Podman uses a system
+// wide socket.
+func defaultPodmanHost() string {
+	if os.Getuid() == 0 {
+		return "unix:///run/podman/podman.sock"
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = "/run/user/" + strings.Split(currentUser, ":")[0]
+	}
+	return "unix://" + runtimeDir + "/podman/podman.sock"
+}
+
+// Applies runtime specific settings to the host configuration of a stage
+// container. Rootless Podman maps root in the container to the current user
+// and any other user to a subordinate uid. We keep the current user's id
+// inside the container so that output files are owned by the user that
+// started walrus, just like with Docker.
+func applyRuntime(runtime string, hostConfig *container.HostConfig) {
+	if runtime == runtimePodman && getuid() != 0 {
+		hostConfig.UsernsMode = "keep-id"
+	}
+}
+
+// Reports whether an error from the container runtime says that a container
+// or network does not exist. Docker and Podman word these errors differently.
+func isNotFound(err error) bool {
+	if client.IsErrNotFound(err) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such") || strings.Contains(msg, "not found")
+}
+
+// Reports whether an error from the container runtime says that a container
+// is not running.
+func isNotRunning(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not running") ||
+		strings.Contains(msg, "state improper")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestApplyRuntimePerExecutor(t *testing.T) {
+	getuid = func() int { return 1000 }
+	defer func() { getuid = os.Getuid }()
+
+	var executors []*dockerExecutor
+	for _, runtime := range []string{runtimeDocker, runtimePodman} {
+		c, err := newClient(runtime, "unix:///run/"+runtime+".sock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		executors = append(executors, newDockerExecutor(c, runtime, "", "run1"))
+	}
+
+	// Clients for other runtimes created while stages start don't change the
+	// settings of an executor.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, d := range executors {
+			wg.Add(1)
+			go func(d *dockerExecutor) {
+				defer wg.Done()
+				_, err := newClient(runtimeDocker, "")
+				if err != nil {
+					t.Error(err)
+				}
+
+				hostConfig := &container.HostConfig{}
+				applyRuntime(d.runtime, hostConfig)
+				expected := container.UsernsMode("")
+				if d.runtime == runtimePodman {
+					expected = "keep-id"
+				}
+				if hostConfig.UsernsMode != expected {
+					t.Errorf("A %s container has user namespace mode %q", d.runtime, hostConfig.UsernsMode)
+				}
+			}(d)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/fjukstad/walrus/pipeline"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+)
+
+// Returns the user a stage container runs as. Unless the stage overrides it,
+// containers run as the user that started walrus.
+func stageUser(stage *pipeline.Stage) string {
+	if stage.Security.User != "" {
+		return stage.Security.User
+	}
+	return currentUser
+}
+
+// Applies the security settings of a stage to the host configuration of its
+// container.
+func applySecurity(stage *pipeline.Stage, hostConfig *container.HostConfig) error {
+	security := stage.Security
+
+	hostConfig.CapAdd = security.CapAdd
+	hostConfig.CapDrop = security.CapDrop
+	hostConfig.ReadonlyRootfs = security.ReadOnlyRootfs
+
+	if len(security.Tmpfs) > 0 {
+		hostConfig.Tmpfs = make(map[string]string, len(security.Tmpfs))
+		for _, mount := range security.Tmpfs {
+			pathAndOptions := strings.SplitN(mount, ":", 2)
+			options := ""
+			if len(pathAndOptions) == 2 {
+				options = pathAndOptions[1]
+			}
+			hostConfig.Tmpfs[pathAndOptions[0]] = options
+		}
+	}
+
+	if security.NoNewPrivileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt,
+			"no-new-privileges")
+	}
+
+	// The Docker API expects the contents of the seccomp profile, not its
+	// location on the host.
+	switch security.SeccompProfile {
+	case "":
+	case "unconfined":
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt,
+			"seccomp=unconfined")
+	default:
+		filename, err := filepath.Abs(security.SeccompProfile)
+		if err != nil {
+			return errors.Wrap(err, "Could not get the absolute path of the seccomp profile")
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return errors.Wrap(err, "Could not read seccomp profile for stage "+stage.Name)
+		}
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt,
+			"seccomp="+string(b))
+	}
+
+	return nil
+}
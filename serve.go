@@ -0,0 +1,792 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+)
+
+// Runs pipelines submitted over HTTP. Every run has its own directory in the
+// run directory with the submitted pipeline description and the output
+// directory of the run, so runs never share output data. The run state is
+// kept in the output directory, which lets the server pick up its runs again
+// after a restart. Every submitted pipeline must comply with the policy of the
+// server as well as its own, and may only mount volumes and read seccomp
+// profiles from the directories the server allows.
+//
+//	GET  /api/runs                          all runs
+//	POST /api/runs                          start a run of the pipeline
+//	                                        description in the request body
+//	GET  /api/runs/ID                       a single run
+//	POST /api/runs/ID/cancel                cancel a run
+//	POST /api/runs/ID/stages/STAGE/rerun    re-run a failed stage of a run
+//	     /runs/ID/                          visualization and web API of a run
+//	     /history                           history and comparison of the runs
+type server struct {
+	dir          string
+	executorName string
+	config       executorConfig
+	policy       pipeline.Policy
+	volumes      []string
+	seccomp      []string
+	metrics      *metrics
+
+	mu   sync.Mutex
+	runs map[string]*serverRun
+}
+
+// A pipeline run started by the server.
+type serverRun struct {
+	id          string
+	dir         string
+	description string
+	state       *runState
+	handler     http.Handler
+
+	// Set while the stages of the run are running, and cancels them.
+	running bool
+	cancel  context.CancelFunc
+}
+
+// Returns the output directory of the run.
+func (run *serverRun) hostpath() string {
+	return filepath.Join(run.dir, "walrus")
+}
+
+// Creates a server that keeps its runs in dir, and restores the runs from a
+// previous server. Stages can mount volumes from the given host directories,
+// and use seccomp profiles in the seccomp directories.
+func newServer(dir, executorName string, config executorConfig, policy pipeline.Policy, volumes, seccomp []string) (*server, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Check run directory")
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create run directory")
+	}
+
+	for i, volume := range volumes {
+		volumes[i], err = resolvePath(volume)
+		if err != nil {
+			return nil, errors.Wrap(err, "Check allowed volume directory")
+		}
+	}
+	for i, profiles := range seccomp {
+		seccomp[i], err = resolvePath(profiles)
+		if err != nil {
+			return nil, errors.Wrap(err, "Check allowed seccomp profile directory")
+		}
+	}
+
+	s := &server{
+		dir:          dir,
+		executorName: executorName,
+		config:       config,
+		policy:       policy,
+		volumes:      volumes,
+		seccomp:      seccomp,
+		metrics:      newMetrics(),
+		runs:         make(map[string]*serverRun),
+	}
+	return s, s.restore()
+}
+
+// Restores the runs in the run directory. Runs that were running when the
+// previous server stopped are marked as failed, they can be resumed by
+// re-running their failed stages.
+func (s *server) restore() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "Could not list runs")
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		run := &serverRun{id: file.Name(), dir: filepath.Join(s.dir, file.Name())}
+		run.description = descriptionFilename(run.dir)
+		run.state, err = readRunState(run.hostpath(), run.id)
+		if err != nil {
+			log.Println("Warning: Could not restore run", run.id+":", err)
+			continue
+		}
+
+		if run.state.Status == statusRunning {
+			msg := "The run was interrupted by a restart of walrus serve"
+			for _, stage := range run.state.Stages {
+				if stage.Status == statusPulling || stage.Status == statusRunning {
+					stage.Status = statusFailed
+					stage.Error = msg
+				}
+			}
+			run.state.finish(errors.New(msg))
+		}
+
+		p, err := pipeline.ParseConfig(run.description)
+		if err != nil {
+			log.Println("Warning: Could not parse pipeline of run", run.id+":", err)
+			p = &pipeline.Pipeline{Name: run.state.Pipeline}
+		}
+
+		s.add(run, p)
+	}
+	return nil
+}
+
+// Returns the pipeline description in a run directory.
+func descriptionFilename(dir string) string {
+	yaml := filepath.Join(dir, "pipeline.yaml")
+	if _, err := os.Stat(yaml); err == nil {
+		return yaml
+	}
+	return filepath.Join(dir, "pipeline.json")
+}
+
+// Registers a run with the server.
+func (s *server) add(run *serverRun, p *pipeline.Pipeline) {
+	if run.state.events == nil {
+		run.state.events = newEventStream(run.id, run.state.Pipeline)
+	}
+	s.metrics.watch(run.state)
+
+	run.handler = visualizationHandler(p, &runAPI{
+		state:       run.state,
+		hostpath:    run.hostpath(),
+		description: filepath.Join(run.hostpath(), filepath.Base(run.description)),
+	})
+
+	s.mu.Lock()
+	s.runs[run.id] = run
+	s.mu.Unlock()
+}
+
+func (s *server) run(id string) *serverRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runs[id]
+}
+
+// Creates the directory of a new run. Run IDs are the time the run started,
+// with a number appended in the unlikely case that two runs get the same ID.
+func (s *server) newRunDir() (id, dir string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	base := newRunID()
+	for i := 1; ; i++ {
+		id = base
+		if i > 1 {
+			id = base + "-" + strconv.Itoa(i)
+		}
+		dir = filepath.Join(s.dir, id)
+		if _, ok := s.runs[id]; ok {
+			continue
+		}
+		err = os.Mkdir(dir, 0755)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", "", errors.Wrap(err, "Could not create run directory")
+		}
+		return id, dir, nil
+	}
+}
+
+// Starts a run of a pipeline description. The description is in YAML if
+// yaml is set and JSON otherwise.
+func (s *server) start(description []byte, yaml bool) (*serverRun, error) {
+	id, dir, err := s.newRunDir()
+	if err != nil {
+		return nil, err
+	}
+
+	run := &serverRun{
+		id:          id,
+		dir:         dir,
+		description: filepath.Join(dir, "pipeline.json"),
+		running:     true,
+	}
+	if yaml {
+		run.description = filepath.Join(dir, "pipeline.yaml")
+	}
+
+	err = ioutil.WriteFile(run.description, description, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrap(err, "Could not write pipeline description")
+	}
+
+	p, err := s.parse(run)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	run.state, err = newRunState(run.hostpath(), id, s.executorName, p)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s.add(run, p)
+	return run, s.execute(run, p, nil)
+}
+
+// Re-runs a failed stage, or a stage that never ran, of a completed run,
+// followed by the stages depending on it that never ran. The other stages keep the output from the earlier
+// attempt of the run.
+func (s *server) rerun(run *serverRun, stage string) error {
+	s.mu.Lock()
+	if run.running {
+		s.mu.Unlock()
+		return errors.New("Run " + run.id + " is still running")
+	}
+	run.running = true
+	s.mu.Unlock()
+
+	statuses := make(map[string]string)
+	run.state.mu.Lock()
+	for _, st := range run.state.Stages {
+		statuses[st.Name] = st.Status
+	}
+	run.state.mu.Unlock()
+	status := statuses[stage]
+	switch status {
+	case statusFailed, statusQueued:
+	case "":
+		s.stopped(run)
+		return errors.New("Run " + run.id + " has no stage named " + stage)
+	default:
+		s.stopped(run)
+		return errors.New("Stage " + stage + " of run " + run.id + " has already completed")
+	}
+
+	p, err := s.parse(run)
+	if err != nil {
+		s.stopped(run)
+		return err
+	}
+
+	only := map[string]bool{stage: true}
+	for added := true; added; {
+		added = false
+		for _, st := range p.Stages {
+			if only[st.Name] || statuses[st.Name] != statusQueued {
+				continue
+			}
+			for _, input := range st.Inputs {
+				if only[input] {
+					only[st.Name] = true
+					added = true
+				}
+			}
+		}
+	}
+
+	for _, st := range p.Stages {
+		if st.Name == stage {
+			st.Cache = false
+		}
+	}
+
+	run.state.restart(stage)
+	return s.execute(run, p, only)
+}
+
+// Parses the pipeline description of a run the same way `walrus run` does,
+// and adds the policy of the server to the policy of the pipeline. Runs
+// started by the server are not committed.
+func (s *server) parse(run *serverRun) (*pipeline.Pipeline, error) {
+	p, err := pipeline.ParseConfig(run.description)
+	if err != nil {
+		return nil, err
+	}
+	p.Commit = false
+	p.Policy = strictestPolicy(p.Policy, s.policy)
+
+	err = fixMountPaths(p.Stages)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkVolumes(p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkSeccompProfiles(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checked here as well as when the run starts, so that pipelines that
+	// violate the policy are rejected without starting a run.
+	err = pipeline.CheckPolicy(*p, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Returns a policy with the restrictions of both policies.
+func strictestPolicy(a, b pipeline.Policy) pipeline.Policy {
+	return pipeline.Policy{
+		ForbidCapAdd:           a.ForbidCapAdd || b.ForbidCapAdd,
+		ForbidRootUser:         a.ForbidRootUser || b.ForbidRootUser,
+		ForbidUnconfined:       a.ForbidUnconfined || b.ForbidUnconfined,
+		RequireReadOnlyRootfs:  a.RequireReadOnlyRootfs || b.RequireReadOnlyRootfs,
+		RequireNoNewPrivileges: a.RequireNoNewPrivileges || b.RequireNoNewPrivileges,
+		RequirePrivateNetwork:  a.RequirePrivateNetwork || b.RequirePrivateNetwork,
+	}
+}
+
+// Checks that stages only mount volumes from the directories the server
+// allows. Submitted pipelines could otherwise read and write any file on the
+// host the stages run on.
+func (s *server) checkVolumes(p *pipeline.Pipeline) error {
+	for _, stage := range p.Stages {
+		for _, volume := range stage.Volumes {
+			hostPath, err := resolvePath(strings.Split(volume, ":")[0])
+			if err != nil {
+				return errors.Wrap(err, "Check volume "+volume)
+			}
+
+			if !inDirectories(hostPath, s.volumes) {
+				return errors.New("Stage " + stage.Name + " mounts " + volume +
+					", which is not in a directory the server allows volumes from")
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that stages only use seccomp profiles from the directories the server
+// allows. The profile is read by the server, so submitted pipelines could
+// otherwise have it read any file on the host.
+func (s *server) checkSeccompProfiles(p *pipeline.Pipeline) error {
+	for _, stage := range p.Stages {
+		profile := stage.Security.SeccompProfile
+		if profile == "" || profile == "unconfined" {
+			continue
+		}
+
+		filename, err := resolvePath(profile)
+		if err != nil {
+			return errors.Wrap(err, "Check seccomp profile "+profile)
+		}
+
+		if !inDirectories(filename, s.seccomp) {
+			return errors.New("Stage " + stage.Name + " uses the seccomp profile " +
+				profile + ", which is not in a directory the server allows seccomp profiles from")
+		}
+	}
+	return nil
+}
+
+// Returns true if a path is in one of the directories. Both are resolved.
+func inDirectories(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the absolute path with symbolic links resolved, as far as the path
+// exists.
+func resolvePath(name string) (string, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(name)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	dir, err := resolvePath(filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(name)), nil
+}
+
+// Runs the stages of a run in the background, or only the given stages if
+// only is not nil.
+func (s *server) execute(run *serverRun, p *pipeline.Pipeline, only map[string]bool) error {
+	lock, err := lockOutput(run.hostpath())
+	if err != nil {
+		s.stopped(run)
+		run.state.finish(err)
+		return err
+	}
+
+	config := s.config
+	config.RunID = run.id
+	r, err := newRunner(s.executorName, config, run.hostpath(), p, run.state)
+	if err != nil {
+		lock.unlock()
+		s.stopped(run)
+		run.state.finish(err)
+		return err
+	}
+	r.only = only
+
+	ctx, cancel := context.WithCancel(withMetrics(context.Background(), s.metrics))
+	s.mu.Lock()
+	run.cancel = cancel
+	s.mu.Unlock()
+
+	go func() {
+		defer lock.unlock()
+		defer cancel()
+
+		log.Println("Starting pipeline run", run.id)
+
+		err := r.run(ctx)
+		if ctx.Err() == context.Canceled && err != nil {
+			err = errors.New("The run was cancelled")
+		}
+		if err == nil {
+			if pending := run.state.pending(); len(pending) > 0 {
+				err = errors.New("Stages " + strings.Join(pending, ", ") +
+					" have not completed")
+			}
+		}
+		if err == nil {
+			completed := filepath.Join(run.hostpath(), filepath.Base(run.description))
+			err = p.WritePipelineDescription(completed)
+			if err != nil {
+				err = errors.Wrap(err, "Could not write pipeline description")
+			}
+		}
+
+		s.stopped(run)
+		run.state.finish(err)
+		if err != nil {
+			log.Println("Pipeline run", run.id, "failed:", err)
+			return
+		}
+		log.Println("Pipeline run", run.id, "completed in:", p.Runtime)
+	}()
+	return nil
+}
+
+// Records that the stages of a run have stopped running.
+func (s *server) stopped(run *serverRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run.running = false
+	run.cancel = nil
+}
+
+// Cancels a running run.
+func (s *server) cancel(run *serverRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if run.cancel == nil {
+		return errors.New("Run " + run.id + " is not running")
+	}
+	run.cancel()
+	return nil
+}
+
+// Returns the HTTP handler of the server. Requests that change anything must
+// come from the server's own pages or from clients that are not browsers.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/runs", s.serveRuns)
+	mux.HandleFunc("/api/runs/", s.serveRun)
+	mux.HandleFunc("/runs/", s.serveVisualization)
+	mux.Handle("/metrics", s.metrics.handler())
+	mux.Handle("/assets/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/history", serveHistoryPage)
+	history := http.StripPrefix("/api/history", &historyAPI{s.history})
+	mux.Handle("/api/history", history)
+	mux.Handle("/api/history/", history)
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		http.Redirect(w, req, "/history", http.StatusFound)
+	})
+	return sameOrigin(mux)
+}
+
+// Rejects requests other than GET and HEAD from pages on other sites.
+// Browsers send the origin of the page with such requests, other clients
+// usually don't send one.
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if req.Method != http.MethodGet && req.Method != http.MethodHead && origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != req.Host {
+				http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Media types of pipeline descriptions, and whether they are YAML.
+var descriptionTypes = map[string]bool{
+	"application/json":   false,
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+}
+
+// Returns the runs of the server, oldest first.
+func (s *server) history() ([]historyEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []historyEntry
+	for id, run := range s.runs {
+		entries = append(entries, historyEntry{
+			hostpath: run.hostpath(),
+			id:       id,
+			link:     "/runs/" + id + "/",
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id < entries[j].id
+	})
+	return entries, nil
+}
+
+// Lists the runs, oldest first, or starts a new run.
+func (s *server) serveRuns(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		s.mu.Lock()
+		var ids []string
+		for id := range s.runs {
+			ids = append(ids, id)
+		}
+		runs := make([]json.RawMessage, 0, len(ids))
+		sort.Strings(ids)
+		for _, id := range ids {
+			b, err := s.runs[id].state.json()
+			if err == nil {
+				runs = append(runs, b)
+			}
+		}
+		s.mu.Unlock()
+		writeJSON(w, runs)
+
+	case http.MethodPost:
+		// Forms can't be posted with these types, so that other sites can't
+		// start runs from the browser of a user.
+		contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		yaml, ok := descriptionTypes[contentType]
+		if !ok {
+			http.Error(w, "Pipeline descriptions must be sent as application/json "+
+				"or application/yaml", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		description, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Could not read pipeline description", http.StatusBadRequest)
+			return
+		}
+
+		run, err := s.start(description, yaml)
+		if run == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", "/api/runs/"+run.id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		s.writeState(w, run)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Serves a single run, and cancels runs and re-runs failed stages.
+func (s *server) serveRun(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/runs/"), "/")
+
+	run := s.run(parts[0])
+	if run == nil {
+		http.Error(w, "No run with ID "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	var action func() error
+	switch {
+	case len(parts) == 1:
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeState(w, run)
+		return
+	case len(parts) == 2 && parts[1] == "cancel":
+		action = func() error { return s.cancel(run) }
+	case len(parts) == 4 && parts[1] == "stages" && parts[3] == "rerun":
+		action = func() error { return s.rerun(run, parts[2]) }
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := action()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	s.writeState(w, run)
+}
+
+func (s *server) writeState(w http.ResponseWriter, run *serverRun) {
+	b, err := run.state.json()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// Serves the visualization of a run under /runs/ID/.
+func (s *server) serveVisualization(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/runs/"), "/", 2)
+
+	run := s.run(parts[0])
+	if run == nil {
+		http.Error(w, "No run with ID "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		http.Redirect(w, req, req.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	http.StripPrefix("/runs/"+run.id, run.handler).ServeHTTP(w, req)
+}
+
+func serveCommand() *command {
+	cmd := newCommand("serve", "", "Run pipelines submitted over HTTP.")
+	cmd.description = "Pipeline descriptions are POSTed to /api/runs. Every run gets its own\n" +
+		"output directory in the run directory, and runs are kept across restarts."
+
+	dir := cmd.flags.String("dir", "walrus-runs",
+		"directory to keep the runs in")
+	port := cmd.flags.String("p", "localhost:9090",
+		"address to serve the web API on, e.g. :9090 to serve it on all interfaces")
+	collectProfile := cmd.flags.Bool("profile", false,
+		"collect runtime metrics for the pipeline stages")
+	interval := cmd.flags.Duration("profile-interval", time.Second,
+		"how often to sample the resource usage of stages when profiling")
+	policyFilename := cmd.flags.String("policy", "",
+		"file with a pipeline policy (JSON) that every submitted pipeline must\n"+
+			"comply with in addition to its own")
+	volumes := cmd.flags.String("allow-volumes", "",
+		"comma-separated host directories stages may mount volumes from\n"+
+			"(default is no volumes)")
+	seccomp := cmd.flags.String("allow-seccomp-profiles", "",
+		"comma-separated host directories stages may use seccomp profiles from\n"+
+			"(default is no profile files)")
+	executorName, executorConf := executorFlags(cmd)
+	webConf := webFlags(cmd)
+	traceConf := traceFlags(cmd)
+
+	cmd.run = func(args []string) error {
+		profile = collectProfile
+		profileInterval = *interval
+
+		policy := pipeline.Policy{}
+		if *policyFilename != "" {
+			b, err := ioutil.ReadFile(*policyFilename)
+			if err != nil {
+				return errors.Wrap(err, "Could not read policy")
+			}
+			err = json.Unmarshal(b, &policy)
+			if err != nil {
+				return errors.Wrap(err, "Could not parse policy")
+			}
+		}
+
+		var allowed, profiles []string
+		if *volumes != "" {
+			allowed = strings.Split(*volumes, ",")
+		}
+		if *seccomp != "" {
+			profiles = strings.Split(*seccomp, ",")
+		}
+
+		srv, err := newWebServer(*webConf)
+		if err != nil {
+			return err
+		}
+
+		err = lookupCurrentUser()
+		if err != nil {
+			return err
+		}
+
+		s, err := newServer(*dir, *executorName, *executorConf, policy, allowed, profiles)
+		if err != nil {
+			return err
+		}
+
+		stopTracing, err := traceConf.start()
+		if err != nil {
+			return err
+		}
+		defer stopTracing()
+
+		fmt.Println("Serving pipeline runs in", s.dir, "on", srv.url(*port))
+		return srv.listenAndServe(*port, s.handler())
+	}
+	return cmd
+}
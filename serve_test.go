@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+func testServer(t *testing.T, policy pipeline.Policy, volumes, seccomp []string) *server {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "walrus-runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := newServer(dir, executorLocal, executorConfig{}, policy, volumes, seccomp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func post(s *server, contentType, origin, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/api/runs",
+		strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, req)
+	return w
+}
+
+const testDescription = `{"Name": "p", "Stages": [{"Name": "a", "Image": "ubuntu", "Cmd": ["true"]}]}`
+
+func TestServeRejectsCrossSiteRequests(t *testing.T) {
+	s := testServer(t, pipeline.Policy{}, nil, nil)
+
+	// Forms can only be posted with these content types.
+	for _, contentType := range []string{"", "text/plain",
+		"application/x-www-form-urlencoded", "multipart/form-data"} {
+		w := post(s, contentType, "", testDescription)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("POST with content type %q: %d %s", contentType, w.Code, w.Body)
+		}
+	}
+
+	w := post(s, "application/json", "http://evil.example.com", testDescription)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST from another origin: %d %s", w.Code, w.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:9090/api/runs/1/cancel", nil)
+	req.Header.Set("Origin", "http://evil.example.com")
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Cancel from another origin: %d %s", rec.Code, rec.Body)
+	}
+
+	w = post(s, "application/json; charset=utf-8", "http://localhost:9090", testDescription)
+	if w.Code != http.StatusCreated {
+		t.Errorf("POST from the server's own origin: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestServeAppliesServerPolicy(t *testing.T) {
+	s := testServer(t, pipeline.Policy{ForbidRootUser: true}, nil, nil)
+
+	// The description can't turn the policy of the server off.
+	description := `{"Name": "p", "Policy": {"ForbidRootUser": false},
+		"Stages": [{"Name": "a", "Image": "ubuntu", "Cmd": ["true"],
+		"Security": {"User": "root"}}]}`
+	w := post(s, "application/json", "", description)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "root") {
+		t.Errorf("POST of a pipeline that runs as root: %d %s", w.Code, w.Body)
+	}
+	if len(s.runs) != 0 {
+		t.Errorf("A run was started for a pipeline that violates the policy")
+	}
+}
+
+func TestServeAllowsVolumes(t *testing.T) {
+	data, err := ioutil.TempDir("", "walrus-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+
+	err = os.Symlink("/etc", filepath.Join(data, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testServer(t, pipeline.Policy{}, []string{data}, nil)
+
+	volumes := map[string]int{
+		data + "/input:/input":    http.StatusCreated,
+		data + ":/data":           http.StatusCreated,
+		"/etc:/data":              http.StatusBadRequest,
+		data + "/../etc:/data":    http.StatusBadRequest,
+		data + "/etc/passwd:/pwd": http.StatusBadRequest,
+	}
+	for volume, code := range volumes {
+		description := `{"Name": "p", "Stages": [{"Name": "a", "Image": "ubuntu",
+			"Cmd": ["true"], "Volumes": ["` + volume + `"]}]}`
+		w := post(s, "application/json", "", description)
+		if w.Code != code {
+			t.Errorf("POST of a pipeline that mounts %s: %d %s", volume, w.Code, w.Body)
+		}
+	}
+
+	// No volumes are allowed by default.
+	s = testServer(t, pipeline.Policy{}, nil, nil)
+	description := `{"Name": "p", "Stages": [{"Name": "a", "Image": "ubuntu",
+		"Cmd": ["true"], "Volumes": ["` + data + `:/data"]}]}`
+	w := post(s, "application/json", "", description)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST of a pipeline with a volume: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestServeAllowsSeccompProfiles(t *testing.T) {
+	profiles, err := ioutil.TempDir("", "walrus-seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(profiles)
+
+	err = os.Symlink("/etc/passwd", filepath.Join(profiles, "passwd.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testServer(t, pipeline.Policy{}, nil, []string{profiles})
+
+	codes := map[string]int{
+		"":                                http.StatusCreated,
+		"unconfined":                      http.StatusCreated,
+		profiles + "/default.json":        http.StatusCreated,
+		"/etc/passwd":                     http.StatusBadRequest,
+		profiles + "/../etc/passwd":       http.StatusBadRequest,
+		profiles + "/passwd.json":         http.StatusBadRequest,
+		"relative/to/the/server/dir.json": http.StatusBadRequest,
+	}
+	for profile, code := range codes {
+		description := `{"Name": "p", "Stages": [{"Name": "a", "Image": "ubuntu",
+			"Cmd": ["true"], "Security": {"SeccompProfile": "` + profile + `"}}]}`
+		w := post(s, "application/json", "", description)
+		if w.Code != code {
+			t.Errorf("POST of a pipeline with seccomp profile %q: %d %s", profile, w.Code, w.Body)
+		}
+	}
+}
+
+func TestServeRequiresPrivateNetwork(t *testing.T) {
+	s := testServer(t, pipeline.Policy{RequirePrivateNetwork: true}, nil, nil)
+
+	codes := map[string]int{
+		"":         http.StatusCreated,
+		"none":     http.StatusCreated,
+		"pipeline": http.StatusCreated,
+		"host":     http.StatusBadRequest,
+		"bridge":   http.StatusBadRequest,
+	}
+	for network, code := range codes {
+		description := `{"Name": "p", "Stages": [{"Name": "a", "Image": "ubuntu",
+			"Cmd": ["true"], "Network": "` + network + `"}]}`
+		w := post(s, "application/json", "", description)
+		if w.Code != code {
+			t.Errorf("POST of a pipeline with network %q: %d %s", network, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+)
+
+// How often the slurm executor checks the state of submitted jobs, and how
+// many times in a row checking may fail before the stage fails. squeue and
+// sacct fail now and then when the Slurm controller is busy.
+var (
+	slurmPollInterval    = 10 * time.Second
+	slurmMaxPollFailures = 5
+)
+
+// Runs pipeline stages as Slurm batch jobs. Every stage is submitted with
+// sbatch as a job that runs the stage image with a container runtime available
+// on the compute nodes (e.g. singularity). walrus polls squeue until the job
+// has left the queue, and sacct until the job has reached a final state and
+// its exit code is known. The output directory
+// must be on a filesystem shared by the compute nodes and the host running
+// walrus. Job scripts, logs and results are kept in the walrus configuration
+// directory.
+type slurmExecutor struct {
+	rootpath  string
+	runtime   string
+	partition string
+}
+
+// The state of a stage run by the slurm executor.
+type slurmJob struct {
+	JobID    string
+	State    string
+	ExitCode int
+	Done     bool
+}
+
+// Container runtimes the slurm executor can run stages with.
+var slurmRuntimes = []string{"singularity", "apptainer", "podman", "docker"}
+
+func newSlurmExecutor(rootpath, runtime, partition string) (*slurmExecutor, error) {
+	supported := false
+	for _, r := range slurmRuntimes {
+		supported = supported || r == runtime
+	}
+	if !supported {
+		return nil, errors.New("Unknown container runtime " + runtime +
+			" for the slurm executor, must be one of " +
+			strings.Join(slurmRuntimes, ", "))
+	}
+	return &slurmExecutor{rootpath: rootpath, runtime: runtime,
+		partition: partition}, nil
+}
+
+// Checks that the security settings of all stages can be applied with the
+// container runtime, and creates the directory for job scripts and logs.
+func (s *slurmExecutor) Start(ctx context.Context, p *pipeline.Pipeline) error {
+	for _, stage := range p.Stages {
+		err := s.checkSecurity(stage)
+		if err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(s.statePath(), 0755)
+}
+
+// Singularity and Apptainer run containers as the user that submitted the
+// job, without any capabilities, with a read-only image and with no new
+// privileges. They can run containers without network access or with the
+// network of the host. Settings that ask for anything else can not be applied.
+func (s *slurmExecutor) checkSecurity(stage *pipeline.Stage) error {
+	if s.runtime != "singularity" && s.runtime != "apptainer" {
+		return nil
+	}
+
+	security := stage.Security
+	var unsupported []string
+	if security.User != "" {
+		unsupported = append(unsupported, "User")
+	}
+	if len(security.CapAdd) > 0 {
+		unsupported = append(unsupported, "CapAdd")
+	}
+	if len(security.Tmpfs) > 0 {
+		unsupported = append(unsupported, "Tmpfs")
+	}
+	if security.SeccompProfile != "" {
+		unsupported = append(unsupported, "SeccompProfile")
+	}
+	switch stage.NetworkMode() {
+	case pipeline.NetworkNone, pipeline.NetworkPipeline, "host":
+	default:
+		unsupported = append(unsupported, "Network")
+	}
+
+	if len(unsupported) > 0 {
+		return errors.New("Stage " + stage.Name + " sets " +
+			strings.Join(unsupported, ", ") + ", which can not be applied with " +
+			s.runtime + " on the slurm executor")
+	}
+	return nil
+}
+
+func (s *slurmExecutor) Stop(ctx context.Context, p *pipeline.Pipeline) error {
+	return nil
+}
+
+// Images are pulled by the container runtime on the compute nodes.
+func (s *slurmExecutor) Prepare(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage) error {
+	return nil
+}
+
+func (s *slurmExecutor) Run(ctx context.Context, p *pipeline.Pipeline, stage *pipeline.Stage, hostpath string) error {
+	// Forget the outcome of any previous run, it is no longer valid.
+	os.Remove(s.jobFilename(stage))
+
+	script := "#!/bin/sh\nexec " + shellJoin(s.command(stage, hostpath)) + "\n"
+	err := ioutil.WriteFile(s.scriptFilename(stage), []byte(script), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Could not write job script for stage "+stage.Name)
+	}
+
+	args, err := s.sbatchArgs(stage)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.CommandContext(ctx, "sbatch", args...).Output()
+	if err != nil {
+		return errors.Wrap(commandError(err), "Could not submit job for stage "+stage.Name)
+	}
+
+	// With --parsable sbatch prints jobid[;cluster]
+	job := slurmJob{JobID: strings.Split(strings.TrimSpace(string(out)), ";")[0]}
+	if job.JobID == "" {
+		return errors.New("sbatch did not return a job id for stage " + stage.Name)
+	}
+
+	err = s.writeJob(stage, job)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			// The stage timed out or the run was cancelled.
+			exec.Command("scancel", job.JobID).Run()
+			return errors.Wrap(ctx.Err(), "Stage "+stage.Name+" did not complete")
+		case <-time.After(slurmPollInterval):
+		}
+
+		state, exitCode, err := jobState(ctx, job.JobID)
+		if err != nil {
+			failures++
+			if failures >= slurmMaxPollFailures {
+				return errors.Wrap(err, "Could not get the state of job "+
+					job.JobID+" for stage "+stage.Name)
+			}
+			continue
+		}
+		failures = 0
+
+		// The job is still queued or running, or has left the queue but
+		// does not show up in the accounting database yet.
+		if !slurmFinalStates[state] {
+			continue
+		}
+
+		job.State = state
+		job.ExitCode = exitCode
+		job.Done = true
+
+		// Jobs that were cancelled or ran out of time or memory have exit
+		// code 0 but did not complete.
+		if state != "COMPLETED" && exitCode == 0 {
+			job.ExitCode = 1
+		}
+
+		return s.writeJob(stage, job)
+	}
+}
+
+func (s *slurmExecutor) ExitCode(ctx context.Context, stage *pipeline.Stage) (int, string, error) {
+	b, err := ioutil.ReadFile(s.jobFilename(stage))
+	if err != nil {
+		return 0, "", err
+	}
+
+	job := slurmJob{}
+	err = json.Unmarshal(b, &job)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if !job.Done {
+		return 0, "", errors.New("Job " + job.JobID + " for stage " + stage.Name + " has not completed")
+	}
+
+	errmsg := ""
+	if job.State != "COMPLETED" {
+		errmsg = "Job " + job.JobID + " " + job.State
+	}
+	return job.ExitCode, errmsg, nil
+}
+
+func (s *slurmExecutor) Logs(ctx context.Context, stage *pipeline.Stage) (string, error) {
+	b, err := ioutil.ReadFile(s.logFilename(stage))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Returns the arguments to sbatch for a stage. Stage resources and timeouts
+// are passed on to Slurm.
+func (s *slurmExecutor) sbatchArgs(stage *pipeline.Stage) ([]string, error) {
+	args := []string{"--parsable",
+		"--job-name=walrus-" + stage.Name,
+		"--output=" + s.logFilename(stage),
+	}
+
+	if s.partition != "" {
+		args = append(args, "--partition="+s.partition)
+	}
+
+	if stage.Resources.CPUs > 0 {
+		cpus := int(stage.Resources.CPUs + 0.999)
+		args = append(args, "--cpus-per-task="+strconv.Itoa(cpus))
+	}
+
+	memory, err := stage.Resources.MemoryBytes()
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid memory limit for stage "+stage.Name)
+	}
+	if memory > 0 {
+		megabytes := (memory + 1<<20 - 1) >> 20
+		args = append(args, "--mem="+strconv.FormatInt(megabytes, 10)+"M")
+	}
+
+	timeout, err := stage.TimeoutDuration()
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		minutes := int((timeout + time.Minute - 1) / time.Minute)
+		args = append(args, "--time="+strconv.Itoa(minutes))
+	}
+
+	return append(args, s.scriptFilename(stage)), nil
+}
+
+// Returns the command that runs the stage image on a compute node. As with
+// the docker executor the stage can only write to its own output directory.
+func (s *slurmExecutor) command(stage *pipeline.Stage, hostpath string) []string {
+	mounts := [][]string{{hostpath, stageMountPath(stage), "rw"}}
+	for _, volume := range getInputVolumes(stage.Inputs, s.rootpath) {
+		mounts = append(mounts, strings.Split(volume, ":"))
+	}
+	for _, volume := range stage.Volumes {
+		hostClientPath := strings.Split(volume, ":")
+		if len(hostClientPath) == 1 {
+			hostClientPath = append(hostClientPath, hostClientPath[0])
+		}
+		mounts = append(mounts, []string{hostClientPath[0], hostClientPath[1], "rw"})
+	}
+
+	switch s.runtime {
+	case "singularity", "apptainer":
+		cmd := []string{s.runtime}
+		args := append(append([]string{}, stage.Entrypoint...), stage.Cmd...)
+		if len(args) == 0 {
+			cmd = append(cmd, "run")
+		} else {
+			cmd = append(cmd, "exec")
+		}
+		cmd = append(cmd, singularityFlags(stage)...)
+		for _, mount := range mounts {
+			cmd = append(cmd, "--bind", strings.Join(mount, ":"))
+		}
+		for _, env := range stage.Env {
+			cmd = append(cmd, "--env", env)
+		}
+		cmd = append(cmd, "docker://"+stageImage(stage))
+		return append(cmd, args...)
+	default:
+		// The pipeline network only exists on a single Docker host, so
+		// stages that ask for it run without network access.
+		network := stage.NetworkMode()
+		if network == pipeline.NetworkPipeline {
+			network = pipeline.NetworkNone
+		}
+		cmd := []string{s.runtime, "run", "--rm", "--network=" + network}
+		cmd = append(cmd, securityFlags(stage)...)
+		for _, mount := range mounts {
+			cmd = append(cmd, "-v", strings.Join(mount, ":"))
+		}
+		for _, env := range stage.Env {
+			cmd = append(cmd, "-e", env)
+		}
+		args := stage.Cmd
+		if len(stage.Entrypoint) > 0 {
+			cmd = append(cmd, "--entrypoint", stage.Entrypoint[0])
+			args = append(append([]string{}, stage.Entrypoint[1:]...), stage.Cmd...)
+		}
+		cmd = append(cmd, stageImage(stage))
+		return append(cmd, args...)
+	}
+}
+
+// Returns the docker and podman flags for the security settings of a stage.
+// Stages run as the user that started walrus unless they set a user, as with
+// the docker executor.
+func securityFlags(stage *pipeline.Stage) []string {
+	security := stage.Security
+	var flags []string
+	if user := stageUser(stage); user != "" {
+		flags = append(flags, "--user="+user)
+	}
+	for _, capability := range security.CapAdd {
+		flags = append(flags, "--cap-add="+capability)
+	}
+	for _, capability := range security.CapDrop {
+		flags = append(flags, "--cap-drop="+capability)
+	}
+	if security.ReadOnlyRootfs {
+		flags = append(flags, "--read-only")
+	}
+	for _, mount := range security.Tmpfs {
+		flags = append(flags, "--tmpfs="+mount)
+	}
+	if security.NoNewPrivileges {
+		flags = append(flags, "--security-opt=no-new-privileges")
+	}
+	if security.SeccompProfile != "" {
+		flags = append(flags, "--security-opt=seccomp="+security.SeccompProfile)
+	}
+	return flags
+}
+
+// Returns the singularity and apptainer flags for the network and security
+// settings of a stage. As with the docker executor stages that ask for the
+// pipeline network run without network access, since it only exists on a
+// single Docker host. The image is always read-only, so ReadOnlyRootfs needs
+// no flag, and settings that can not be applied are rejected by
+// checkSecurity.
+func singularityFlags(stage *pipeline.Stage) []string {
+	var flags []string
+	network := stage.NetworkMode()
+	if network == pipeline.NetworkNone || network == pipeline.NetworkPipeline {
+		flags = append(flags, "--net", "--network", pipeline.NetworkNone)
+	}
+
+	var capabilities []string
+	for _, capability := range stage.Security.CapDrop {
+		capability = strings.ToUpper(capability)
+		if capability != "ALL" && !strings.HasPrefix(capability, "CAP_") {
+			capability = "CAP_" + capability
+		}
+		capabilities = append(capabilities, capability)
+	}
+	if len(capabilities) > 0 {
+		flags = append(flags, "--drop-caps", strings.Join(capabilities, ","))
+	}
+	return flags
+}
+
+func (s *slurmExecutor) writeJob(stage *pipeline.Stage, job slurmJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.jobFilename(stage), b, 0644)
+}
+
+func (s *slurmExecutor) statePath() string {
+	return filepath.Join(createConfigPath(s.rootpath), "slurm")
+}
+
+func (s *slurmExecutor) scriptFilename(stage *pipeline.Stage) string {
+	return filepath.Join(s.statePath(), stage.Name+".sh")
+}
+
+func (s *slurmExecutor) logFilename(stage *pipeline.Stage) string {
+	return filepath.Join(s.statePath(), stage.Name+".log")
+}
+
+func (s *slurmExecutor) jobFilename(stage *pipeline.Stage) string {
+	return filepath.Join(s.statePath(), stage.Name+".json")
+}
+
+// States of jobs that have stopped running for good.
+var slurmFinalStates = map[string]bool{
+	"BOOT_FAIL":     true,
+	"CANCELLED":     true,
+	"COMPLETED":     true,
+	"DEADLINE":      true,
+	"FAILED":        true,
+	"NODE_FAIL":     true,
+	"OUT_OF_MEMORY": true,
+	"PREEMPTED":     true,
+	"TIMEOUT":       true,
+}
+
+// Returns the state of a job and, once the job is in a final state, its exit
+// code. The state is empty if the job has left the queue but has no
+// accounting record yet.
+func jobState(ctx context.Context, jobID string) (string, int, error) {
+	state, err := jobQueueState(ctx, jobID)
+	if err == nil && state != "" && !slurmFinalStates[state] {
+		return state, 0, nil
+	}
+
+	// squeue fails for job ids that have left the queue on some Slurm
+	// versions, but also when the controller is busy, so the accounting
+	// database decides if the job has completed. Completed jobs may also
+	// stay in the queue for a while, without their exit code.
+	return jobAccounting(ctx, jobID)
+}
+
+// Returns the state of a job in the queue, or the empty string if the job has
+// left the queue.
+func jobQueueState(ctx context.Context, jobID string) (string, error) {
+	out, err := exec.CommandContext(ctx, "squeue", "--noheader",
+		"--jobs="+jobID, "--format=%T").Output()
+	if err != nil {
+		return "", errors.Wrap(commandError(err), "Could not run squeue")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Returns the final state and exit code of a job from the Slurm accounting
+// database. The state is empty if the job has no accounting record yet.
+func jobAccounting(ctx context.Context, jobID string) (string, int, error) {
+	out, err := exec.CommandContext(ctx, "sacct", "--noheader", "--parsable2",
+		"--allocations", "--jobs="+jobID, "--format=State,ExitCode").Output()
+	if err != nil {
+		return "", 0, errors.Wrap(commandError(err), "Could not run sacct")
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+
+		// States may have a reason appended, e.g. "CANCELLED by 1000".
+		state := strings.Fields(fields[0])[0]
+
+		// The exit code is on the form exitcode:signal
+		exitCode, err := strconv.Atoi(strings.Split(fields[1], ":")[0])
+		if err != nil {
+			return "", 0, errors.New("Could not parse exit code " + fields[1] + " of job " + jobID)
+		}
+		return state, exitCode, nil
+	}
+	return "", 0, nil
+}
+
+// Adds the standard error output of a failed command to its error.
+func commandError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return errors.New(err.Error() + ": " + strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
+
+// Joins a command into a string that can be run by the shell.
+func shellJoin(args []string) string {
+	var quoted []string
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
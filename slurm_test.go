@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+// Puts fake Slurm commands first on PATH. Every command appends its arguments
+// to <name>.calls in the returned directory before it runs its script.
+func fakeSlurm(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "walrus-slurm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"sbatch", "squeue", "sacct", "scancel"} {
+		script := "#!/bin/sh\necho \"$@\" >> " + filepath.Join(dir, name+".calls") +
+			"\n" + scripts[name] + "\n"
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	slurmPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// Returns the arguments of every call to a fake Slurm command.
+func slurmCalls(t *testing.T, dir, name string) []string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, name+".calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// Returns a script that runs the nth command on the nth call, and the last
+// command on all later calls.
+func nthCall(lines ...string) string {
+	script := "n=$(cat \"$0.calls\" | wc -l)\ncase $n in\n"
+	for i, line := range lines[:len(lines)-1] {
+		script += strconv.Itoa(i+1) + ") " + line + " ;;\n"
+	}
+	return script + "*) " + lines[len(lines)-1] + " ;;\nesac"
+}
+
+func startSlurmExecutor(t *testing.T, runtime string, p *pipeline.Pipeline) *slurmExecutor {
+	t.Helper()
+
+	rootpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(rootpath) })
+
+	s, err := newSlurmExecutor(rootpath, runtime, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSlurmRun(t *testing.T) {
+	dir := fakeSlurm(t, map[string]string{
+		"sbatch": "echo '42;cluster'",
+		"squeue": nthCall("echo PENDING", "echo RUNNING", "true"),
+		"sacct":  "echo 'COMPLETED|0:0'",
+	})
+
+	p := testPipeline("p")
+	p.Stages[0].Resources = pipeline.Resources{CPUs: 1.5, Memory: "100m"}
+	s := startSlurmExecutor(t, "singularity", p)
+
+	err := s.Run(context.Background(), p, p.Stages[0], filepath.Join(s.rootpath, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, errmsg, err := s.ExitCode(context.Background(), p.Stages[0])
+	if err != nil || code != 0 || errmsg != "" {
+		t.Errorf("Exit code of stage a is %d, %q, %v", code, errmsg, err)
+	}
+
+	if n := len(slurmCalls(t, dir, "squeue")); n != 3 {
+		t.Errorf("squeue was called %d times, not until the job left the queue", n)
+	}
+
+	sbatch := slurmCalls(t, dir, "sbatch")
+	if len(sbatch) != 1 || !strings.Contains(sbatch[0], "--cpus-per-task=2") ||
+		!strings.Contains(sbatch[0], "--mem=100M") {
+		t.Errorf("sbatch was called with %v", sbatch)
+	}
+}
+
+func TestSlurmRunFailed(t *testing.T) {
+	fakeSlurm(t, map[string]string{
+		"sbatch": "echo 42",
+		"squeue": "true",
+		"sacct":  "echo 'FAILED|3:0'",
+	})
+
+	p := testPipeline("p")
+	s := startSlurmExecutor(t, "singularity", p)
+
+	err := s.Run(context.Background(), p, p.Stages[0], filepath.Join(s.rootpath, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, errmsg, err := s.ExitCode(context.Background(), p.Stages[0])
+	if err != nil || code != 3 || errmsg == "" {
+		t.Errorf("Exit code of failed stage a is %d, %q, %v", code, errmsg, err)
+	}
+}
+
+// A failing squeue does not mean that the job has completed. The job is done
+// once sacct says so.
+func TestSlurmRunSqueueFails(t *testing.T) {
+	dir := fakeSlurm(t, map[string]string{
+		"sbatch": "echo 42",
+		"squeue": "echo 'slurm_load_jobs error: Socket timed out' >&2; exit 1",
+		"sacct": nthCall("exit 1", "echo 'RUNNING|0:0'", "echo 'RUNNING|0:0'",
+			"echo 'COMPLETED|0:0'"),
+	})
+
+	p := testPipeline("p")
+	s := startSlurmExecutor(t, "singularity", p)
+
+	err := s.Run(context.Background(), p, p.Stages[0], filepath.Join(s.rootpath, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(slurmCalls(t, dir, "sacct")); n != 4 {
+		t.Errorf("sacct was called %d times, not until the job completed", n)
+	}
+
+	code, _, err := s.ExitCode(context.Background(), p.Stages[0])
+	if err != nil || code != 0 {
+		t.Errorf("Exit code of stage a is %d, %v", code, err)
+	}
+}
+
+func TestSlurmRunCancelled(t *testing.T) {
+	dir := fakeSlurm(t, map[string]string{
+		"sbatch": "echo 42",
+		"squeue": "echo RUNNING",
+	})
+
+	p := testPipeline("p")
+	s := startSlurmExecutor(t, "singularity", p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := s.Run(ctx, p, p.Stages[0], filepath.Join(s.rootpath, "a"))
+	if err == nil {
+		t.Error("Run of a cancelled stage did not fail")
+	}
+	if calls := slurmCalls(t, dir, "scancel"); len(calls) != 1 || calls[0] != "42" {
+		t.Errorf("scancel was called with %v", calls)
+	}
+}
+
+func TestSlurmSecurity(t *testing.T) {
+	p := testPipeline("p")
+	p.Stages[0].Security = pipeline.Security{User: "1000", CapAdd: []string{"NET_ADMIN"}}
+
+	s, err := newSlurmExecutor(os.TempDir(), "singularity", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start(context.Background(), p)
+	if err == nil || !strings.Contains(err.Error(), "User, CapAdd") {
+		t.Errorf("Security settings singularity can not apply were accepted: %v", err)
+	}
+
+	s, err = newSlurmExecutor(os.TempDir(), "podman", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(s.command(p.Stages[0], "/out/a"), " ")
+	for _, flag := range []string{"--user=1000", "--cap-add=NET_ADMIN"} {
+		if !strings.Contains(cmd, flag) {
+			t.Errorf("Stage is run with %s, without %s", cmd, flag)
+		}
+	}
+}
+
+func TestSlurmSingularityFlags(t *testing.T) {
+	p := testPipeline("p")
+	p.Stages[0].Security = pipeline.Security{
+		CapDrop:         []string{"NET_RAW", "cap_chown"},
+		ReadOnlyRootfs:  true,
+		NoNewPrivileges: true,
+	}
+	p.Stages[1].Network = "host"
+
+	for _, runtime := range []string{"singularity", "apptainer"} {
+		s := startSlurmExecutor(t, runtime, p)
+
+		cmd := strings.Join(s.command(p.Stages[0], "/out/a"), " ")
+		for _, flag := range []string{"--net --network none",
+			"--drop-caps CAP_NET_RAW,CAP_CHOWN"} {
+			if !strings.Contains(cmd, flag) {
+				t.Errorf("Stage is run with %s, without %s", cmd, flag)
+			}
+		}
+		if strings.Contains(cmd, "--writable") {
+			t.Errorf("Stage with a read-only root filesystem is run with %s", cmd)
+		}
+
+		cmd = strings.Join(s.command(p.Stages[1], "/out/b"), " ")
+		if strings.Contains(cmd, "--net") {
+			t.Errorf("Stage with the host network is run with %s", cmd)
+		}
+	}
+
+	p.Stages[1].Network = "bridge"
+	s, err := newSlurmExecutor(os.TempDir(), "singularity", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start(context.Background(), p)
+	if err == nil || !strings.Contains(err.Error(), "Network") {
+		t.Errorf("Network singularity can not apply was accepted: %v", err)
+	}
+}
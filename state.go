@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+	"github.com/pkg/errors"
+)
+
+// Pipeline and stage statuses.
+const (
+	statusQueued    = "queued"
+	statusPulling   = "pulling"
+	statusRunning   = "running"
+	statusCached    = "cached"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+)
+
+// The state of a pipeline run. It is written to the walrus configuration
+// directory on every change so that other walrus processes can follow the
+// run while it executes, and inspect it after it has completed.
+type runState struct {
+	ID       string
+	Pipeline string
+	Executor string
+	Status   string
+	Start    time.Time
+	End      time.Time
+	Error    string
+	Stages   []*stageState
+
+	mu        sync.Mutex
+	filename  string
+	events    *eventStream
+	listeners []func([]byte)
+}
+
+// The state of a single stage in a pipeline run.
+type stageState struct {
+	Name     string
+	Status   string
+	Start    time.Time
+	End      time.Time
+	Runtime  time.Duration
+	ExitCode int
+	Retries  int
+	Cached   bool
+	Error    string
+
+	// The state of the stage container as reported by the container
+	// runtime. Only set by `walrus status`.
+	Container string `json:",omitempty"`
+}
+
+// Returns the directory where the state of all pipeline runs is kept.
+func runsPath(hostpath string) string {
+	return filepath.Join(createConfigPath(hostpath), "runs")
+}
+
+// Returns the ID of a new pipeline run. IDs are the time the run started in
+// microseconds followed by a random suffix, so that runs started at the same
+// time get different IDs, and different container and network names. IDs
+// sort in the order the runs started.
+func newRunID() string {
+	now := time.Now()
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return now.Format("20060102-150405") + "-" +
+		fmt.Sprintf("%06d", now.Nanosecond()/1000) + "-" + hex.EncodeToString(suffix)
+}
+
+// Creates the state of a new pipeline run with all stages queued.
+func newRunState(hostpath, id, executor string, p *pipeline.Pipeline) (*runState, error) {
+	err := os.MkdirAll(runsPath(hostpath), 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create run state directory")
+	}
+
+	state := &runState{
+		ID:       id,
+		Pipeline: p.Name,
+		Executor: executor,
+		Status:   statusRunning,
+		Start:    time.Now(),
+		filename: filepath.Join(runsPath(hostpath), id+".json"),
+		events:   newEventStream(id, p.Name),
+	}
+
+	for _, stage := range p.Stages {
+		state.Stages = append(state.Stages, &stageState{
+			Name:   stage.Name,
+			Status: statusQueued,
+		})
+	}
+
+	return state, state.save()
+}
+
+// Updates the state of a stage and persists the run state. Failing to persist
+// the state does not affect the pipeline run, so errors are only logged.
+func (state *runState) updateStage(name string, update func(*stageState)) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for _, stage := range state.Stages {
+		if stage.Name == name {
+			update(stage)
+		}
+	}
+
+	err := state.save()
+	if err != nil {
+		log.Println("Warning:", err)
+	}
+}
+
+// Records that a stage failed and returns the error.
+func (state *runState) stageFailed(stage *pipeline.Stage, err error) error {
+	ev := event{Type: eventStageFinished, Stage: stage.Name,
+		Image: stage.Image, Status: statusFailed, Error: err.Error()}
+
+	state.updateStage(stage.Name, func(s *stageState) {
+		s.Status = statusFailed
+		s.End = time.Now()
+		s.Retries = stage.Retries
+		s.Error = err.Error()
+
+		if s.ExitCode != 0 {
+			exitCode := s.ExitCode
+			ev.ExitCode = &exitCode
+		}
+		if !s.Start.IsZero() {
+			ev.Duration = s.End.Sub(s.Start)
+		}
+		ev.Retries = s.Retries
+	})
+
+	state.events.emit(ev)
+	return err
+}
+
+// Marks the run as completed and persists the run state.
+func (state *runState) finish(err error) {
+	state.mu.Lock()
+
+	state.End = time.Now()
+	state.Status = statusSucceeded
+	if err != nil {
+		state.Status = statusFailed
+		state.Error = err.Error()
+	}
+
+	ev := event{Type: eventPipelineFinished, Status: state.Status,
+		Duration: state.End.Sub(state.Start), Error: state.Error}
+
+	err = state.save()
+	if err != nil {
+		log.Println("Warning:", err)
+	}
+	state.mu.Unlock()
+
+	// Listeners may read the run state, so the event is emitted once the
+	// state is no longer locked.
+	state.events.emit(ev)
+}
+
+// Starts another attempt of a completed run that re-runs the given stage. The
+// states of the other stages are kept.
+func (state *runState) restart(name string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.Status = statusRunning
+	state.End = time.Time{}
+	state.Error = ""
+	for i, stage := range state.Stages {
+		if stage.Name == name {
+			state.Stages[i] = &stageState{Name: name, Status: statusQueued}
+		}
+	}
+
+	err := state.save()
+	if err != nil {
+		log.Println("Warning:", err)
+	}
+}
+
+// Returns the names of the stages that have not completed successfully.
+func (state *runState) pending() []string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	var names []string
+	for _, stage := range state.Stages {
+		if stage.Status != statusSucceeded && stage.Status != statusCached {
+			names = append(names, stage.Name)
+		}
+	}
+	return names
+}
+
+// Adds a listener that is called with the run state as JSON every time it
+// changes. Listeners are called while the state is locked and must not block.
+func (state *runState) listen(listener func([]byte)) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.listeners = append(state.listeners, listener)
+}
+
+// Returns the run state as JSON.
+func (state *runState) json() ([]byte, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return json.Marshal(state)
+}
+
+// Writes the run state to a temporary file and moves it in place, so that
+// readers never see a partially written state. Listeners are notified of the
+// new state.
+func (state *runState) save() error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := state.filename + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Could not write run state")
+	}
+
+	err = os.Rename(tmp, state.filename)
+	if err != nil {
+		return errors.Wrap(err, "Could not write run state")
+	}
+
+	if len(state.listeners) > 0 {
+		b, err = json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		for _, listener := range state.listeners {
+			listener(b)
+		}
+	}
+	return nil
+}
+
+// Reads the state of a pipeline run. If id is empty the most recent run is
+// read.
+func readRunState(hostpath, id string) (*runState, error) {
+	if id == "" {
+		ids, err := runIDs(hostpath)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, errors.New("No pipeline runs found in " + hostpath)
+		}
+		id = ids[len(ids)-1]
+	}
+
+	filename := filepath.Join(runsPath(hostpath), id+".json")
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read state of run "+id)
+	}
+
+	state := &runState{filename: filename}
+	err = json.Unmarshal(b, state)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse state of run "+id)
+	}
+	return state, nil
+}
+
+// Returns the IDs of all pipeline runs in the output directory, oldest first.
+func runIDs(hostpath string) ([]string, error) {
+	files, err := ioutil.ReadDir(runsPath(hostpath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list pipeline runs")
+	}
+
+	var ids []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+
+	// IDs are timestamps, so they sort in the order the runs started.
+	sort.Strings(ids)
+	return ids, nil
+}
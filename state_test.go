@@ -0,0 +1,26 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestNewRunIDsAreUniqueAndSorted(t *testing.T) {
+	ids := make([]string, 1000)
+	seen := make(map[string]bool)
+	for i := range ids {
+		ids[i] = newRunID()
+		if seen[ids[i]] {
+			t.Fatalf("Run ID %s was returned twice", ids[i])
+		}
+		seen[ids[i]] = true
+	}
+
+	// Runs started in the same microsecond may sort either way.
+	started := len("20060102-150405-000000")
+	if !sort.SliceIsSorted(ids, func(i, j int) bool {
+		return ids[i][:started] < ids[j][:started]
+	}) {
+		t.Error("Run IDs do not sort in the order the runs started")
+	}
+}
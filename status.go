@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+func statusCommand() *command {
+	cmd := newCommand("status", "", "Print the status of a pipeline run.")
+	cmd.description = "Shows the status, start and end time, runtime, exit code, retries and\n" +
+		"cache hits of every stage in the most recent run, or the run given by -run.\n" +
+		"For stages that are running, the state of their container is included."
+
+	outputDir := outputFlag(cmd)
+	id := cmd.flags.String("run", "", "ID of the run to show (default the most recent run)")
+	jsonOutput := cmd.flags.Bool("json", false, "print the status as JSON")
+	watch := cmd.flags.Duration("watch", 0,
+		"refresh the status at the given interval (e.g. 2s) until the run completes")
+	runtime := cmd.flags.String("runtime", runtimeDocker,
+		"container runtime the stages run with (docker or podman)")
+	host := cmd.flags.String("host", "", "address of the container runtime API")
+
+	cmd.run = func(args []string) error {
+		hostpath, err := filepath.Abs(*outputDir)
+		if err != nil {
+			return errors.Wrap(err, "Check hostpath")
+		}
+
+		for {
+			state, err := readRunState(hostpath, *id)
+			if err != nil {
+				return err
+			}
+
+			if state.Executor == executorDocker {
+				addContainerStates(state, hostpath, *runtime, *host)
+			}
+
+			if *watch > 0 && !*jsonOutput {
+				// Clear the terminal before printing the status again.
+				fmt.Print("\033[H\033[2J")
+			}
+
+			if *jsonOutput {
+				err = json.NewEncoder(os.Stdout).Encode(state)
+			} else {
+				err = printStatus(os.Stdout, state)
+			}
+			if err != nil {
+				return err
+			}
+
+			if *watch <= 0 || state.Status != statusRunning {
+				return nil
+			}
+
+			// Follow the run that was shown, not any run started later.
+			*id = state.ID
+			time.Sleep(*watch)
+		}
+	}
+	return cmd
+}
+
+// Adds the state of the container of every running stage. Stages that the
+// run state says are running may have been left behind by a walrus process
+// that was stopped, in which case their container tells what happened to
+// them. Errors are ignored since the containers may be gone.
+func addContainerStates(state *runState, hostpath, runtime, host string) {
+	var c *client.Client
+	for _, stage := range state.Stages {
+		if stage.Status != statusRunning {
+			continue
+		}
+
+		if c == nil {
+			var err error
+			c, err = newClient(runtime, host)
+			if err != nil {
+				return
+			}
+		}
+
+		args := filters.NewArgs()
+		args.Add("label", labelOutput+"="+hostpath)
+		args.Add("label", labelRun+"="+state.ID)
+		args.Add("label", labelStage+"="+stage.Name)
+
+		containers, err := c.ContainerList(context.Background(),
+			types.ContainerListOptions{All: true, Filters: args})
+		if err != nil || len(containers) == 0 {
+			stage.Container = "not found"
+			continue
+		}
+
+		info, err := c.ContainerInspect(context.Background(), containers[0].ID)
+		if err != nil {
+			stage.Container = "not found"
+			continue
+		}
+
+		stage.Container = info.State.Status
+		if !info.State.Running {
+			stage.Container += " (exit code " + strconv.Itoa(info.State.ExitCode) + ")"
+		}
+	}
+}
+
+func printStatus(w io.Writer, state *runState) error {
+	fmt.Fprintf(w, "Pipeline: %s\n", state.Pipeline)
+	fmt.Fprintf(w, "Run:      %s (%s)\n", state.ID, state.Executor)
+	fmt.Fprintf(w, "Status:   %s\n", state.Status)
+	fmt.Fprintf(w, "Started:  %s\n", formatTime(state.Start))
+	if !state.End.IsZero() {
+		fmt.Fprintf(w, "Ended:    %s\n", formatTime(state.End))
+		fmt.Fprintf(w, "Runtime:  %s\n", state.End.Sub(state.Start).Round(time.Second))
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tSTATUS\tSTART\tEND\tRUNTIME\tEXIT CODE\tRETRIES\tCACHED\tCONTAINER")
+	for _, stage := range state.Stages {
+		runtime := stage.Runtime
+		if stage.Status == statusRunning && !stage.Start.IsZero() {
+			runtime = time.Since(stage.Start)
+		}
+
+		exitCode := ""
+		if stage.Status == statusSucceeded || stage.Status == statusFailed {
+			exitCode = strconv.Itoa(stage.ExitCode)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%t\t%s\n", stage.Name,
+			stage.Status, formatTime(stage.Start), formatTime(stage.End),
+			runtime.Round(time.Millisecond), exitCode, stage.Retries,
+			stage.Cached, stage.Container)
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+// Runs the status command with the given arguments and returns what it
+// printed.
+func runStatus(t *testing.T, args ...string) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		output <- string(b)
+	}()
+
+	cmd := statusCommand()
+	err = cmd.flags.Parse(args)
+	if err == nil {
+		err = cmd.run(cmd.flags.Args())
+	}
+	w.Close()
+	os.Stdout = stdout
+	out := <-output
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestStatus(t *testing.T) {
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{
+		{Name: "a"}, {Name: "b"}, {Name: "c"}}}
+
+	first, err := newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.finish(nil)
+
+	state, err := newRunState(hostpath, "run2", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	state.updateStage("a", func(s *stageState) {
+		s.Status = statusSucceeded
+		s.Start, s.End = start, start.Add(90*time.Second)
+		s.Runtime = 90 * time.Second
+		s.Cached = true
+	})
+	state.updateStage("b", func(s *stageState) {
+		s.Status = statusFailed
+		s.ExitCode = 3
+		s.Retries = 2
+	})
+	state.updateStage("c", func(s *stageState) {
+		s.Status = statusRunning
+		s.Start = time.Now()
+	})
+
+	// The most recent run is shown by default.
+	out := runStatus(t, "-o", hostpath)
+	for _, line := range []string{
+		"Pipeline: p",
+		"Run:      run2 (local)",
+		"Status:   running",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Status does not have %q:\n%s", line, out)
+		}
+	}
+
+	rows := make(map[string][]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			rows[fields[0]] = fields
+		}
+	}
+	want := map[string][]string{
+		"a": {"a", "succeeded", "2020-01-01", "12:00:00", "2020-01-01", "12:01:30",
+			"1m30s", "0", "0", "true"},
+		"b": {"b", "failed", "-", "-", "0s", "3", "2", "false"},
+	}
+	for stage, fields := range want {
+		if strings.Join(rows[stage], " ") != strings.Join(fields, " ") {
+			t.Errorf("Stage %s is shown as %v, not %v", stage, rows[stage], fields)
+		}
+	}
+	// Running stages have no end time and no exit code yet.
+	if c := rows["c"]; len(c) != 8 || c[1] != statusRunning || c[4] != "-" {
+		t.Errorf("Running stage c is shown as %v", c)
+	}
+
+	out = runStatus(t, "-o", hostpath, "-run", "run1", "-json")
+	shown := &runState{}
+	err = json.Unmarshal([]byte(out), shown)
+	if err != nil {
+		t.Fatalf("Status is not JSON: %v\n%s", err, out)
+	}
+	if shown.ID != "run1" || shown.Status != statusSucceeded || len(shown.Stages) != 3 {
+		t.Errorf("Status of run1 is %s %s with %d stages", shown.ID, shown.Status,
+			len(shown.Stages))
+	}
+}
+
+func TestStatusContainerStates(t *testing.T) {
+	state := &runState{ID: "run1", Stages: []*stageState{
+		{Name: "a", Status: statusSucceeded},
+		{Name: "b", Status: statusRunning},
+	}}
+
+	// Containers of running stages that can not be found are reported, so
+	// that stages left behind by a stopped walrus can be told apart.
+	host := "unix://" + filepath.Join(os.TempDir(), "walrus-missing.sock")
+	addContainerStates(state, "/out", runtimeDocker, host)
+	if state.Stages[0].Container != "" || state.Stages[1].Container != "not found" {
+		t.Errorf("Container states are %q and %q", state.Stages[0].Container,
+			state.Stages[1].Container)
+	}
+
+	var b bytes.Buffer
+	err := printStatus(&b, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "not found") {
+		t.Errorf("The container state is not shown:\n%s", b.String())
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Traces pipeline runs. Every run is a trace with a span for the pipeline, and
+// a span for every stage with child spans for pulling the image, waiting for
+// inputs, running the stage and collecting its logs. Without a tracer provider
+// set up by startTracing the spans are not recorded.
+var tracer = otel.Tracer(tracerName)
+
+// The instrumentation name of the spans walrus records.
+const tracerName = "github.com/fjukstad/walrus"
+
+// Settings for exporting traces, set from the command line.
+type traceConfig struct {
+	Endpoint string
+	Insecure bool
+}
+
+// Adds the flags for exporting traces to a command.
+func traceFlags(cmd *command) *traceConfig {
+	config := &traceConfig{}
+	cmd.flags.StringVar(&config.Endpoint, "trace", "",
+		"export traces of pipeline runs over OTLP/HTTP to the collector at the\n"+
+			"given address, e.g. localhost:4318")
+	cmd.flags.BoolVar(&config.Insecure, "trace-insecure", false,
+		"export traces over HTTP instead of HTTPS")
+	return config
+}
+
+// Starts exporting traces if a collector is set. It returns a function that
+// exports any remaining spans and stops the exporter, which does nothing if
+// traces are not exported.
+func (config traceConfig) start() (func(), error) {
+	if config.Endpoint == "" {
+		return func() {}, nil
+	}
+
+	stopTracing, err := startTracing(config.Endpoint, config.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		err := stopTracing(context.Background())
+		if err != nil {
+			log.Println("Warning: Could not export traces:", err)
+		}
+	}, nil
+}
+
+// Exports traces over OTLP/HTTP to the collector at endpoint (host:port). It
+// returns a function that flushes any remaining spans and stops the exporter.
+func startTracing(endpoint string, insecure bool) (func(context.Context) error, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create trace exporter")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("walrus"),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(tracerName)
+
+	return provider.Shutdown, nil
+}
+
+// Starts a span for a phase of a stage, e.g. pulling its image.
+func startStageSpan(ctx context.Context, name, stage string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("walrus.stage", stage)))
+}
+
+// Ends a span, marking it as failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fjukstad/walrus/lfs"
+	"github.com/fjukstad/walrus/pipeline"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRunTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+
+	global := tracer
+	tracer = provider.Tracer(tracerName)
+	defer func() { tracer = global }()
+
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	// The output is committed to a repository that is not there.
+	var committed []string
+	addAndCommitData = func(path, msg string) (string, error) {
+		committed = append(committed, path)
+		return "commit", nil
+	}
+	getHead = func(path string) (string, error) {
+		return "head", nil
+	}
+	defer func() {
+		addAndCommitData, getHead = lfs.AddAndCommitData, lfs.GetHead
+	}()
+
+	p := &pipeline.Pipeline{
+		Name:   "p",
+		Commit: true,
+		Stages: []*pipeline.Stage{
+			{Name: "a", Image: "ubuntu:latest", Cmd: []string{"true"}},
+			{Name: "b", Image: "ubuntu:latest", Cmd: []string{"true"}, Inputs: []string{"a"}},
+		},
+	}
+
+	state, err := newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRunner(executorLocal, executorConfig{RunID: "run1"}, hostpath, p, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		name := span.Name()
+		for _, attr := range span.Attributes() {
+			if attr.Key == "walrus.stage" && name != "stage "+attr.Value.AsString() {
+				name = attr.Value.AsString() + "/" + name
+			}
+		}
+		spans[name] = span
+	}
+
+	root, ok := spans["pipeline p"]
+	if !ok {
+		t.Fatalf("No pipeline span in %v", spanNames(spans))
+	}
+	if root.Parent().IsValid() {
+		t.Error("The pipeline span has a parent")
+	}
+
+	// Every stage has a span with child spans for its phases, and all spans
+	// are in the trace of the run.
+	for _, stage := range []string{"a", "b"} {
+		stageSpan, ok := spans["stage "+stage]
+		if !ok {
+			t.Fatalf("No span for stage %s in %v", stage, spanNames(spans))
+		}
+		if stageSpan.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("The parent of the span of stage %s is not the pipeline span", stage)
+		}
+
+		for _, phase := range []string{"pull", "wait", "run", "logs"} {
+			span, ok := spans[stage+"/"+phase]
+			if !ok {
+				t.Errorf("No %s span for stage %s in %v", phase, stage, spanNames(spans))
+				continue
+			}
+			if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+				t.Errorf("The %s span of stage %s is in another trace", phase, stage)
+			}
+			if span.Parent().SpanID() != stageSpan.SpanContext().SpanID() {
+				t.Errorf("The %s span of stage %s has the wrong parent", phase, stage)
+			}
+		}
+
+		// The output of all stages is committed after they have completed.
+		commit, ok := spans[stage+"/commit"]
+		if !ok {
+			t.Errorf("No commit span for stage %s in %v", stage, spanNames(spans))
+		} else if commit.Parent().SpanID() != stageSpan.SpanContext().SpanID() {
+			t.Errorf("The parent of the commit span of stage %s is not the stage span", stage)
+		} else if commit.EndTime().After(stageSpan.EndTime()) {
+			t.Errorf("The span of stage %s ended before its output was committed", stage)
+		}
+	}
+
+	if len(committed) != 2 {
+		t.Errorf("The output of %d stages was committed", len(committed))
+	}
+}
+
+func spanNames(spans map[string]sdktrace.ReadOnlySpan) []string {
+	var names []string
+	for name := range spans {
+		names = append(names, name)
+	}
+	return names
+}
+
+// An OTLP/HTTP collector that keeps the names of the spans it receives by the
+// service that sent them.
+type testCollector struct {
+	mu    sync.Mutex
+	spans map[string][]string
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/traces" || req.Method != http.MethodPost {
+		http.NotFound(w, req)
+		return
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	export := &coltracepb.ExportTraceServiceRequest{}
+	err = proto.Unmarshal(b, export)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, resourceSpans := range export.ResourceSpans {
+		service := ""
+		for _, attr := range resourceSpans.Resource.GetAttributes() {
+			if attr.Key == "service.name" {
+				service = attr.Value.GetStringValue()
+			}
+		}
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				c.spans[service] = append(c.spans[service], span.Name)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	b, _ = proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(b)
+}
+
+func TestTraceExport(t *testing.T) {
+	collector := &testCollector{spans: make(map[string][]string)}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	config := traceConfig{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Insecure: true,
+	}
+	global := tracer
+	stopTracing, err := config.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tracer = global }()
+
+	hostpath, err := ioutil.TempDir("", "walrus-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostpath)
+
+	p := &pipeline.Pipeline{
+		Name:   "p",
+		Stages: []*pipeline.Stage{{Name: "a", Image: "ubuntu:latest", Cmd: []string{"true"}}},
+	}
+	state, err := newRunState(hostpath, "run1", executorLocal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRunner(executorLocal, executorConfig{RunID: "run1"}, hostpath, p, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping exports the spans that have not been exported yet.
+	stopTracing()
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	exported := strings.Join(collector.spans["walrus"], ",")
+	for _, name := range []string{"pipeline p", "stage a", "run", "logs"} {
+		if !strings.Contains(","+exported+",", ","+name+",") {
+			t.Errorf("Span %s was not exported, the collector got %v", name,
+				collector.spans)
+		}
+	}
+}
@@ -2,13 +2,9 @@ package main
 
 import (
 	"context"
-	"flag"
-	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -16,127 +12,300 @@ import (
 	"syscall"
 	"time"
 
-	wcontainer "github.com/fjukstad/walrus/container"
 	"github.com/fjukstad/walrus/lfs"
 	"github.com/fjukstad/walrus/pipeline"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var stageMutexes []*sync.Mutex
-var completedConditions []*sync.Cond
-var completedStages []bool
-var stageIndex map[string]int
 var currentUser string
 var profile *bool
 
+// How often the resource usage of stages is sampled when profiling.
+var profileInterval = time.Second
+
+// The number of stages that run in parallel, unless the executor has a pool
+// of hosts with room for more.
 var numParallelWorkers = 5
 
-func run(c *client.Client, p *pipeline.Pipeline, rootpath, filename string) error {
+// Adds and commits the output of a stage with git-lfs, and returns the head
+// of the output repository.
+var (
+	addAndCommitData = lfs.AddAndCommitData
+	getHead          = lfs.GetHead
+)
+
+// The walrus version. Release builds set it with
+// -ldflags "-X main.version=VERSION".
+var version = "dev"
+
+// Runs the stages of a pipeline. Stages run as soon as their inputs have
+// completed, and at most workers stages run at a time. A runner runs the
+// pipeline once, both for `walrus run` and for runs started by `walrus serve`.
+type runner struct {
+	ex       executor
+	p        *pipeline.Pipeline
+	rootpath string
+	state    *runState
+	workers  int
+
+	// The stages to run. The other stages are expected to have completed in
+	// an earlier attempt of the run, e.g. when a failed stage is re-run. All
+	// stages run if it is nil.
+	only map[string]bool
+
+	mu        sync.Mutex
+	completed *sync.Cond
+	done      map[string]bool
+	aborted   bool
+}
+
+// Returns a runner for the pipeline with the named executor. The state of the
+// run is updated as the stages run.
+func newRunner(executorName string, config executorConfig, hostpath string, p *pipeline.Pipeline, state *runState) (*runner, error) {
+	// Stages without a user run as the user that started walrus, e.g. root
+	// in the walrus image.
+	err := pipeline.CheckPolicy(*p, currentUser)
+	if err != nil {
+		return nil, err
+	}
+
+	ex, err := newExecutor(executorName, hostpath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run as many stages in parallel as there are slots in the host pool.
+	workers := numParallelWorkers
+	if pool, ok := ex.(*poolExecutor); ok {
+		workers = pool.capacity()
+	}
+
+	return &runner{
+		ex:       ex,
+		p:        p,
+		rootpath: hostpath,
+		state:    state,
+		workers:  workers,
+	}, nil
+}
+
+// Marks a stage as completed and wakes up the stages waiting for it.
+func (r *runner) complete(name string) {
+	r.mu.Lock()
+	r.done[name] = true
+	r.mu.Unlock()
+	r.completed.Broadcast()
+}
+
+// Waits for the given stages to complete. It returns false if the run was
+// aborted while waiting.
+func (r *runner) wait(inputs []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for !r.aborted {
+		waiting := false
+		for _, input := range inputs {
+			if _, ok := r.done[input]; ok && !r.done[input] {
+				waiting = true
+			}
+		}
+		if !waiting {
+			return true
+		}
+		r.completed.Wait()
+	}
+	return false
+}
+
+func (r *runner) run(ctx context.Context) (err error) {
+	ex, p, rootpath, state := r.ex, r.p, r.rootpath, r.state
 
 	// We use a buffered channel to limit the number of stages that can run in
 	// parallel. Every stage will signal that it starts doing work by inserting
 	// a 1 into the channel. Once it completes it will pull one number out of
 	// the channel.
-	executing := make(chan int, numParallelWorkers)
-
-	stageMutexes = make([]*sync.Mutex, len(p.Stages))
-	completedConditions = make([]*sync.Cond, len(p.Stages))
-	completedStages = make([]bool, len(p.Stages))
+	executing := make(chan int, r.workers)
+
+	// Stages that don't run keep the runtime and version they had in the
+	// earlier attempt of the run.
+	if r.only != nil {
+		previous, err := readRunRecord(rootpath, state.ID)
+		if err == nil {
+			copyStageResults(p, previous.Pipeline, r.only)
+		}
+	}
 
 	pipelineStart := time.Now()
 	defer func() {
 		p.Runtime = time.Since(pipelineStart)
+
+		// The record lets later runs be compared with this one. The
+		// output of a failed run is not checksummed, since it may be
+		// partial.
+		completed := make(map[string]bool)
+		if err == nil {
+			pending := make(map[string]bool)
+			for _, name := range state.pending() {
+				pending[name] = true
+			}
+			for _, stage := range p.Stages {
+				completed[stage.Name] = !pending[stage.Name]
+			}
+		}
+		err := saveRunRecord(rootpath, state.ID, p, completed)
+		if err != nil {
+			log.Println("Warning:", err)
+		}
 	}()
 
-	for i := range stageMutexes {
-		stageMutexes[i] = &sync.Mutex{}
-		completedConditions[i] = sync.NewCond(stageMutexes[i])
+	// Every stage is either done or not, stages that are not in the
+	// pipeline are not waited for.
+	r.completed = sync.NewCond(&r.mu)
+	r.done = make(map[string]bool, len(p.Stages))
+	for _, stage := range p.Stages {
+		r.done[stage.Name] = false
 	}
 
-	stageIndex = make(map[string]int, len(p.Stages))
+	// The stages still running or waiting are stopped when the run is
+	// cancelled or a stage fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func(ctx context.Context) {
+		<-ctx.Done()
+		r.mu.Lock()
+		r.aborted = true
+		r.mu.Unlock()
+		r.completed.Broadcast()
+	}(ctx)
+
+	// Executors emit events to the run's event stream through the context.
+	ctx = withEvents(ctx, state.events)
+
+	ctx, span := tracer.Start(ctx, "pipeline "+p.Name, trace.WithAttributes(
+		attribute.String("walrus.pipeline", p.Name),
+		attribute.String("walrus.run", state.ID)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	state.events.emit(event{Type: eventPipelineStarted})
 
-	// Name to index mapping
-	for i, stage := range p.Stages {
-		stageIndex[stage.Name] = i
+	err = ex.Start(ctx, p)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		err := ex.Stop(ctx, p)
+		if err != nil {
+			log.Println("Warning:", err)
+		}
+	}()
 
 	e := make(chan error, len(p.Stages))
 
-	for i, stage := range p.Stages {
-		go func(i int, stage *pipeline.Stage) {
+	// If the output is committed the stage spans are ended once the output
+	// of their stage has been committed, so that the commit spans are their
+	// children.
+	stageSpans := make(map[string]trace.Span)
+	defer func() {
+		for _, span := range stageSpans {
+			span.End()
+		}
+	}()
+
+	for _, stage := range p.Stages {
+		if r.only != nil && !r.only[stage.Name] {
+			r.complete(stage.Name)
+			e <- nil
+			continue
+		}
+
+		spanCtx, stageSpan := startStageSpan(ctx, "stage "+stage.Name, stage.Name)
+		if p.Commit {
+			stageSpans[stage.Name] = stageSpan
+		}
+
+		go func(ctx context.Context, stage *pipeline.Stage, stageSpan trace.Span) {
 
 			// Even if might be a parallel stage we only use the first part of
 			// the name
 			stageName := strings.Split(stage.Name, "_")[0]
 
-			mountpath := "/walrus/" + stageName
 			hostpath := rootpath + "/" + stageName
 
-			repo, tag := getRepoAndTag(stage.Image)
-			image := repo + ":" + tag
+			if !p.Commit {
+				defer stageSpan.End()
+			}
+
+			fail := func(err error) {
+				stageSpan.RecordError(err)
+				stageSpan.SetStatus(codes.Error, err.Error())
+				e <- state.stageFailed(stage, err)
+			}
 
-			images, err := c.ImageList(context.Background(), types.ImageListOptions{})
+			state.events.emit(event{Type: eventStageQueued, Stage: stage.Name,
+				Image: stage.Image, Inputs: stage.Inputs})
+
+			timeout, err := stage.TimeoutDuration()
 			if err != nil {
-				e <- errors.Wrap(err, "Could not list images")
+				fail(err)
 				return
 			}
 
-			// Check if Docker image is present on the host. If not pull it
-			// down.
-			imagePresent := false
-			for _, img := range images {
-				for _, tag := range img.RepoTags {
-					if image == tag {
-						imagePresent = true
-					}
-				}
-			}
-			if !imagePresent {
-				rc, err := c.ImagePull(context.Background(), image,
-					types.ImagePullOptions{})
-				if err != nil {
-					e <- errors.Wrap(err, "Could not pull image")
-					return
-				}
+			state.updateStage(stage.Name, func(s *stageState) {
+				s.Status = statusPulling
+			})
 
-				defer rc.Close()
+			pullStart := time.Now()
+			pullCtx, pullSpan := startStageSpan(ctx, "pull", stage.Name)
+			err = ex.Prepare(pullCtx, p, stage)
+			endSpan(pullSpan, err)
+			if err != nil {
+				fail(err)
+				return
+			}
 
-				_, err = ioutil.ReadAll(rc)
-				if err != nil {
-					e <- errors.Wrap(err, "error reading image pull")
-				}
+			if puller, ok := ex.(imagePuller); ok && puller.pulledImage(stage) {
+				state.events.emit(event{Type: eventImagePulled, Stage: stage.Name,
+					Image: stage.Image, Duration: time.Since(pullStart)})
 			}
 
+			state.updateStage(stage.Name, func(s *stageState) {
+				s.Status = statusQueued
+			})
+
 			// If the stage has any inputs it waits for these stages to complete
 			// before starting.
-			if len(stage.Inputs) > 0 {
-				for _, input := range stage.Inputs {
-					index := stageIndex[input]
-					cond := completedConditions[index]
-					cond.L.Lock()
-					for !completedStages[index] {
-						cond.Wait()
-					}
-					cond.L.Unlock()
-				}
+			_, waitSpan := startStageSpan(ctx, "wait", stage.Name)
+			if !r.wait(stage.Inputs) {
+				waitSpan.End()
+				e <- ctx.Err()
+				return
 			}
 
 			// Requesting 'ticket' in workerpool.
-			executing <- 1
+			select {
+			case executing <- 1:
+			case <-ctx.Done():
+				waitSpan.End()
+				e <- ctx.Err()
+				return
+			}
+			waitSpan.End()
 
 			// If the stage can be cached, check for a previous run. If this
-			// container does not exist we need to run the stage again. Also if
-			// a cached stage has failed we'll need to re run it.
+			// run can't be found we need to run the stage again. Also if a
+			// cached stage has failed we'll need to re run it.
 			if stage.Cache {
-				code, _, err := exitCode(c, stage.Name)
+				code, _, err := ex.ExitCode(ctx, stage)
 				if err != nil {
 					log.Println(err)
-					log.Println("Warning: Could not find cached container", stage.Name, "will re-run the stage")
+					log.Println("Warning: Could not find cached run of", stage.Name, "will re-run the stage")
 					stage.Cache = false
 				}
 				if code != 0 {
@@ -146,130 +315,104 @@ func run(c *client.Client, p *pipeline.Pipeline, rootpath, filename string) erro
 
 			// try to open output directory, if it exists then we can serve the
 			// "cached"/old results
-			_, err = os.Open(hostpath)
+			if remote, ok := ex.(remoteOutputExecutor); ok {
+				if !remote.hasOutput(ctx, stage) {
+					err = errors.New("No output of stage " + stage.Name)
+				}
+			} else {
+				_, err = os.Open(hostpath)
+			}
 
 			if !stage.Cache || err != nil {
-				// Removes a container with the same name as the stage.
-				// This container could have been a previous run that the user
-				// does not wish to cache, or a cached container which output
-				// directory has been deleted. We ignore any error message
-				// thrown9.
-				c.ContainerRemove(context.Background(), stage.Name,
-					types.ContainerRemoveOptions{RemoveVolumes: true,
-						Force: true})
-
-				// Note the 0777 permission bits. We use such liberal bits since
-				// we do not know about the users within the docker containers
-				// that are going to be run. We want to fix this later!
-				err = os.MkdirAll(hostpath, 0777)
+				// The stages run as the current user, so the output
+				// directory only needs to be writable by its owner.
+				err = os.MkdirAll(hostpath, 0755)
 				if err != nil {
-					e <- errors.Wrap(err, "Could not create output directory for stage")
+					fail(errors.Wrap(err, "Could not create output directory for stage"))
 					return
 				}
 
-				binds := []string{hostpath + ":" + mountpath}
-				binds = append(binds, stage.Volumes...)
-
-				resp, err := c.ContainerCreate(context.Background(),
-					&container.Config{Image: image,
-						Env:        stage.Env,
-						Cmd:        stage.Cmd,
-						Entrypoint: stage.Entrypoint,
-						User:       currentUser,
-					},
-					&container.HostConfig{
-						Binds:       binds,
-						VolumesFrom: stage.Inputs},
-					&network.NetworkingConfig{},
-					stage.Name)
-
-				if err != nil || resp.ID == " " {
-					e <- errors.Wrap(err, "Could not create container "+stage.Name)
-					return
+				stageCtx := ctx
+				if timeout > 0 {
+					var cancel context.CancelFunc
+					stageCtx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
 				}
-				containerId := resp.ID
 
 				stageStart := time.Now()
 
-				numTries := 0
+				state.updateStage(stage.Name, func(s *stageState) {
+					s.Status = statusRunning
+					s.Start = stageStart
+				})
 
-				if *profile {
-					go wcontainer.Profile(c, containerId, hostpath+"/profile-"+stage.Name+".json")
-				}
+				state.events.emit(event{Type: eventStageStarted, Stage: stage.Name,
+					Image: stage.Image})
 
-				for {
-					err = c.ContainerStart(context.Background(), containerId,
-						types.ContainerStartOptions{})
-					if err != nil {
-						log.Println("Warning: Could not start container", stage.Name, "retrying. Error:", err)
-						if numTries > 10 {
-							e <- errors.Wrap(err, "Could not start container "+stage.Name)
-							return
-						}
-						numTries += 1
-						time.Sleep(10 * time.Second)
-					} else {
-						break
-					}
-				}
-
-				okC, errC := c.ContainerWait(context.Background(), containerId,
-					container.WaitConditionNotRunning)
-				select {
-				case err := <-errC:
-					if err != nil {
-						e <- errors.Wrap(err, "Failed to wait for container to finish")
-						return
-					}
-				case <-okC: // simply drain wait ok channel
+				runCtx, runSpan := startStageSpan(stageCtx, "run", stage.Name)
+				err = ex.Run(runCtx, p, stage, hostpath)
+				endSpan(runSpan, err)
+				if err != nil {
+					fail(err)
+					return
 				}
 
 				stage.Runtime = time.Since(stageStart)
 
+			} else {
+				state.updateStage(stage.Name, func(s *stageState) {
+					s.Status = statusCached
+					s.Cached = true
+				})
+
+				state.events.emit(event{Type: eventStageCached, Stage: stage.Name,
+					Image: stage.Image})
+
+				stageSpan.SetAttributes(attribute.Bool("walrus.cached", true))
 			}
 
 			// Done executing, release ticket in worker pool.
 			<-executing
 
-			cond := completedConditions[i]
-			cond.L.Lock()
-
 			// Notifies waiting stages on completion
-			completedStages[i] = true
-
-			cond.L.Unlock()
-			cond.Broadcast()
-
-			exitCode, errmsg, err := exitCode(c, stage.Name)
-			if err != nil {
-				e <- errors.Wrap(err, "Could not get exit code for stage "+stage.Name)
-			}
+			r.complete(stage.Name)
 
-			logs, err := getLogs(c, stage.Name)
+			exitCode, errmsg, logs, err := collectLogs(ctx, ex, stage, hostpath)
 			if err != nil {
-				e <- err
+				fail(err)
 				return
 			}
 
-			err = writeLogs(logs, hostpath)
-			if err != nil {
-				e <- errors.Wrap(err, "Could not write logs for stage "+stage.Name)
-				return
-			}
+			stageSpan.SetAttributes(attribute.Int("walrus.exit_code", exitCode))
+
+			state.updateStage(stage.Name, func(s *stageState) {
+				if !s.Cached {
+					s.Status = statusSucceeded
+					s.End = time.Now()
+				}
+				s.Runtime = stage.Runtime
+				s.ExitCode = exitCode
+				s.Retries = stage.Retries
+			})
 
 			if exitCode != 0 {
+				stageSpan.SetStatus(codes.Error, "exit code "+strconv.Itoa(exitCode))
+				state.stageFailed(stage, errors.New("exit code "+strconv.Itoa(exitCode)+" "+errmsg))
 				e <- errors.New("ERROR: Stage " + stage.Name + " failed with exit code " + strconv.Itoa(exitCode) + "\n" + stage.String() + "\n" + errmsg + "\n" + logs)
 				return
 			}
 
+			state.events.emit(event{Type: eventStageFinished, Stage: stage.Name,
+				Image: stage.Image, Status: statusSucceeded, ExitCode: &exitCode,
+				Duration: stage.Runtime, Retries: stage.Retries,
+				Cached: stage.Cache})
+
 			log.Println("Stage", stage.Name, "completed successfully in", stage.Runtime)
 
 			e <- nil
-		}(i, stage)
+		}(spanCtx, stage, stageSpan)
 	}
 
-	var err error
-
 	// Check for any error and return
 	for range p.Stages {
 		err = <-e
@@ -292,15 +435,26 @@ func run(c *client.Client, p *pipeline.Pipeline, rootpath, filename string) erro
 			hostpath := rootpath + "/" + stageName
 
 			// add and commit output data
+			commitCtx := ctx
+			if stageSpan, ok := stageSpans[stage.Name]; ok {
+				commitCtx = trace.ContextWithSpan(ctx, stageSpan)
+			}
+			_, commitSpan := startStageSpan(commitCtx, "commit", stage.Name)
 			msg := "Add data pipeline stage: " + stageName
-			commitId, err := lfs.AddAndCommitData(hostpath, msg)
+			commitId, err := addAndCommitData(hostpath, msg)
 			if err != nil {
+				endSpan(commitSpan, err)
 				return errors.Wrap(err, "Could not commit output data "+stageName)
 			}
 
 			p.Stages[i].Version = commitId
 
-			head, err := lfs.GetHead(hostpath)
+			head, err := getHead(hostpath)
+			endSpan(commitSpan, err)
+			if stageSpan, ok := stageSpans[stage.Name]; ok {
+				stageSpan.End()
+				delete(stageSpans, stage.Name)
+			}
 			if err != nil {
 				return errors.Wrap(err, "Could not get git head")
 			}
@@ -312,78 +466,138 @@ func run(c *client.Client, p *pipeline.Pipeline, rootpath, filename string) erro
 	return nil
 }
 
-func writeLogs(logs, path string) error {
-	filename := path + "/walrus.log"
-	return ioutil.WriteFile(filename, []byte(logs), 0777)
+// Copies the runtime and version of the stages that are not in only from an
+// earlier attempt of the run.
+func copyStageResults(p, previous *pipeline.Pipeline, only map[string]bool) {
+	for _, stage := range p.Stages {
+		if only[stage.Name] {
+			continue
+		}
+		for _, prev := range previous.Stages {
+			if prev.Name == stage.Name {
+				stage.Runtime = prev.Runtime
+				stage.Version = prev.Version
+			}
+		}
+	}
 }
 
-func exitCode(c *client.Client, container string) (int, string, error) {
-	info, err := c.ContainerInspect(context.Background(), container)
+// Gets the exit code and logs of a stage, and writes the logs to the output
+// directory of the stage.
+func collectLogs(ctx context.Context, ex executor, stage *pipeline.Stage, hostpath string) (exitCode int, errmsg, logs string, err error) {
+	ctx, span := startStageSpan(ctx, "logs", stage.Name)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	exitCode, errmsg, err = ex.ExitCode(ctx, stage)
 	if err != nil {
-		return 0, "", err
+		return 0, "", "", errors.Wrap(err, "Could not get exit code for stage "+stage.Name)
 	}
-	state := info.State
-	return state.ExitCode, state.Error, nil
-}
 
-func getLogs(c *client.Client, container string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	client, _ := client.NewEnvClient()
-	reader, err := client.ContainerLogs(ctx, container, types.ContainerLogsOptions{
-		ShowStderr: true,
-		ShowStdout: true,
-	})
+	logs, err = ex.Logs(ctx, stage)
 	if err != nil {
-		return "", err
+		return 0, "", "", err
 	}
 
-	b, err := ioutil.ReadAll(reader)
-	if err != nil && err != io.EOF {
-		return "", err
+	err = writeLogs(logs, hostpath)
+	if err != nil {
+		return 0, "", "", errors.Wrap(err, "Could not write logs for stage "+stage.Name)
 	}
-	return string(b), nil
-}
 
-// Stops any previously run pipeline and deletes the containers.
-// Todo investigate if the docker pkg has defined some errors so that we don't
-// have to do any string comparisons (ugly af).
-func stopPreviousRun(c *client.Client, stages []*pipeline.Stage) error {
-	for _, stage := range stages {
-		err := c.ContainerKill(context.Background(), stage.Name, "9")
+	if remote, ok := ex.(remoteOutputExecutor); ok {
+		err = remote.writeLogs(ctx, stage, logs)
 		if err != nil {
-			if !strings.Contains(err.Error(), "No such") &&
-				!strings.Contains(err.Error(), "not running") {
-				return errors.Wrap(err, "Could not kill container "+stage.Name)
-			}
+			return 0, "", "", errors.Wrap(err, "Could not write logs for stage "+stage.Name)
 		}
+	}
+	return exitCode, errmsg, logs, nil
+}
 
-		// if the stage has caching enabled we can't remove it just yet. Its
-		// exits codes etc. may be used in later pipeline runs
-		if !stage.Cache {
-			err = c.ContainerRemove(context.Background(), stage.Name,
-				types.ContainerRemoveOptions{RemoveVolumes: true,
-					Force: true})
-			if err != nil {
-				if !strings.Contains(err.Error(), "No such") {
-					return errors.Wrap(err, "Could not remove container "+stage.Name)
-				}
-			}
-		}
+func writeLogs(logs, path string) error {
+	// The output directory of a cached stage that ran on a cluster may not
+	// exist on this host.
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
 	}
-	return nil
+	filename := path + "/walrus.log"
+	return ioutil.WriteFile(filename, []byte(logs), 0644)
 }
 
-// Generate a list of volume mounts on the form
-// /hostpath/stagename-containerid/:/walrus/stagename
+// Generate a list of read-only volume mounts on the form
+// /hostpath/stagename:/walrus/stagename:ro. Parallel stages share an output
+// directory so each directory is only mounted once.
 func getInputVolumes(inputs []string, hostpath string) (volumes []string) {
+	mounted := make(map[string]bool, len(inputs))
 	for _, input := range inputs {
-		volumes = append(volumes, hostpath+"/"+input+":"+"/walrus"+"/"+input)
+		stageName := strings.Split(input, "_")[0]
+		if mounted[stageName] {
+			continue
+		}
+		mounted[stageName] = true
+		volumes = append(volumes, hostpath+"/"+stageName+":"+"/walrus"+"/"+stageName+":ro")
 	}
 	return volumes
 }
 
+// Verifies that an output directory is owned by the user the stage container
+// runs as. Directories left behind by runs as another user (e.g. root) can't
+// be written to by the stage containers. Users given by name rather than uid
+// are not checked.
+func checkOwnership(path, user string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "Could not stat output directory")
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	uid := strings.Split(user, ":")[0]
+	if _, err := strconv.Atoi(uid); err != nil {
+		return nil
+	}
+
+	owner := strconv.Itoa(int(stat.Uid))
+	if owner != uid {
+		return errors.New("Output directory " + path + " is owned by uid " +
+			owner + ", but the stage runs as " + user +
+			". Change its owner or remove it before running the pipeline")
+	}
+	return nil
+}
+
+// Hands the output directory over to the user the stage runs as. This is only
+// possible when walrus itself runs as root, e.g. in the walrus Docker image.
+func chownOutputDirectory(path, user string) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+
+	ids := strings.Split(user, ":")
+	uid, err := strconv.Atoi(ids[0])
+	if err != nil {
+		return nil
+	}
+
+	gid := -1
+	if len(ids) > 1 {
+		gid, err = strconv.Atoi(ids[1])
+		if err != nil {
+			gid = -1
+		}
+	}
+
+	err = os.Chown(path, uid, gid)
+	if err != nil {
+		return errors.Wrap(err, "Could not change owner of output directory "+path)
+	}
+	return nil
+}
+
 func getRepoAndTag(pipelineImage string) (repo, tag string) {
 	repoAndTag := strings.Split(pipelineImage, ":")
 	if len(repoAndTag) == 1 {
@@ -444,209 +658,9 @@ func fixMountPaths(stages []*pipeline.Stage) error {
 }
 
 func main() {
-	var configFilename = flag.String("i", "",
-		"pipeline description file")
-	var outputDir = flag.String("o", "walrus",
-		"where walrus should store output data on the host")
-	var web = flag.Bool("web", false,
-		"host interactive visualization of the pipeline")
-	var port = flag.String("p", ":9090",
-		"port to run web server for pipeline visualization")
-	var lfsServer = flag.Bool("lfs-server", false,
-		"start an lfs-server, will not run the pipeline")
-	var lfsServerDir = flag.String("lfs-server-dir", "lfs",
-		"host directory to store lfs objects")
-	var commit = flag.Bool("commit", false, "add and commit output data")
-	var logs = flag.String("logs", "", "get logs for pipeline stage")
-	var graphFilename = flag.String("graph", "", "write dot graph of the pipeline to the given filename and stop.")
-	var printPipeline = flag.Bool("print", false, "print a pipeline configuration or completed pipeline \n\tconfiguration (use -i to specify its name and location)")
-	var diff = flag.String("diff", "", "print difference of current pipeline run and the given ID")
-
-	var results = flag.Bool("printResults", false, "print pipeline configuration of completed pipeline")
-
-	profile = flag.Bool("profile", false, "collect runtime metrics for the pipeline stages")
-
-	var reset = flag.String("reset", "", "reset walrus output back to a known configuration (warning: will roll back repository and delete newer changes)")
-
-	flag.Parse()
-
-	defaultConfigFilename := "pipeline.json"
-	if *configFilename == "" {
-		log.Println("No pipeline description file set. Using default", defaultConfigFilename)
-		*configFilename = defaultConfigFilename
-	}
-	if *results {
-		*printPipeline = true
-		*configFilename = *outputDir + "/" + filepath.Base(*configFilename)
-	}
-
-	if *diff != "" {
-		str, err := lfs.PrintDiff(*outputDir, *diff)
-		if err != nil {
-			log.Println(err)
-		}
-
-		log.Println("Difference from pipeline run " + *diff + ":\n" + str)
-		return
-	}
-
-	if *reset != "" {
-		fmt.Println("Are you sure you want to resset the walrus results?")
-		fmt.Println("This will remove all provenance information on files created later (Y/n).")
-
-		var input string
-		_, err := fmt.Fscanln(os.Stdin, &input)
-		if err != nil {
-			log.Println("Could not read input:", err)
-			return
-		}
-
-		if input == "Y" {
-			log.Println("Resetting data to pipeline run", *reset)
-			err = lfs.Reset(*outputDir, *reset)
-			if err != nil {
-				log.Println("Could not reset walrus results to id", *reset, err)
-				return
-			}
-			log.Println("Successfully reset to", *reset)
-			log.Println("Any data that was created later than this ID is still available")
-			return
-		} else {
-			return
-		}
-
-	}
-
-	if *lfsServer {
-		err := lfs.StartServer(*lfsServerDir)
-		if err != nil {
-			log.Println("Could not start git-lfs server", err)
-		} else {
-			log.Println("git-lfs server started successfully")
-		}
-		return
-	}
-
-	if *logs != "" {
-		stageName := *logs
-		filename := *outputDir + "/" + stageName + "/walrus.log"
-		b, err := ioutil.ReadFile(filename)
-		if err != nil {
-			log.Println("Could not read logs for stage: " + stageName)
-			log.Println(err)
-			return
-		}
-		log.Println(string(b))
-		return
-	}
-
-	if *printPipeline {
-		p, err := pipeline.ParseConfig(*configFilename)
-		switch err.(type) {
-		case nil:
-			fmt.Println(p)
-		case *pipeline.NameError:
-			fmt.Println(p)
-		default:
-			fmt.Println(err)
-		}
-		return
-	}
-
-	// set umask to 000 while walrus is running (we want to have full read/write
-	// permissions to the output dirs while running.
-	oldmask := syscall.Umask(000)
-	defer syscall.Umask(oldmask)
-
-	hostpath, err := filepath.Abs(*outputDir)
-	if err != nil {
-		log.Println("Check hostpath", err)
-		return
-	}
-
-	client, err := client.NewEnvClient()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	c, err := user.Current()
-	if err != nil {
-		log.Println(err)
-	}
-	currentUser = c.Uid + ":" + c.Gid
-
-	p, err := pipeline.ParseConfig(*configFilename)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	p.Commit = *commit
-
-	err = fixMountPaths(p.Stages)
+	err := execute(os.Args[1:])
 	if err != nil {
 		log.Println(err)
-		return
-	}
-
-	err = stopPreviousRun(client, p.Stages)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	if *graphFilename != "" {
-		err = p.WriteDOT(*graphFilename)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		log.Println("DOT graph of the pipeline was written to:", *graphFilename)
-		return
-	}
-
-	if *web {
-		go func() {
-			err = startPipelineVisualization(p, *port)
-			if err != nil {
-				log.Println("Could not start pipeline visualization:", err)
-			}
-		}()
-	}
-
-	err = run(client, p, hostpath, *configFilename)
-
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	log.Println("All stages completed successfully. Output written to ",
-		hostpath)
-
-	log.Println("Pipeline completed in:", p.Runtime)
-
-	completedPipelineDescription := *outputDir + "/" + filepath.Base(*configFilename)
-
-	err = p.WritePipelineDescription(completedPipelineDescription)
-	if err != nil {
-		log.Println("ERROR: Could not write pipeline description. ", err)
-		return
-	}
-
-	if p.Commit {
-		err = lfs.Add(*configFilename)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		commitId, err := lfs.AddAndCommit(completedPipelineDescription, "Add pipeline configurations")
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		log.Println("Pipeline completed. Use id", commitId, "to reference it later")
+		os.Exit(1)
 	}
-	return
 }
@@ -1,111 +1,56 @@
 package main
 
 import (
+	"embed"
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"log"
 	"net/http"
+	"sync"
 
-	"github.com/fjukstad/gotoscapejs"
 	"github.com/fjukstad/walrus/pipeline"
 )
 
-var vis = `
-<head>
-    <script src="https://cdnjs.cloudflare.com/ajax/libs/cytoscape/3.2.12/cytoscape.js"></script>
-    <script
-      src="https://code.jquery.com/jquery-3.1.1.js"
-      integrity="sha256-16cdPddA6VdVInumRGo6IbivbERE8p7CQR3HzTBuELA="
-      crossorigin="anonymous"></script>
-    <script src="https://unpkg.com/dagre@0.7.4/dist/dagre.js"></script>
-    <script src="https://cytoscape.github.io/cytoscape.js-dagre/cytoscape-dagre.js"></script> 
-    <script src="http://cdnjs.cloudflare.com/ajax/libs/qtip2/2.2.0/jquery.qtip.min.js"></script>
-    <link href="http://cdnjs.cloudflare.com/ajax/libs/qtip2/2.2.0/jquery.qtip.min.css" rel="stylesheet" type="text/css" />
-    <script src="https://cdn.rawgit.com/cytoscape/cytoscape.js-qtip/2.7.1/cytoscape-qtip.js"></script>
-    <style>
-        #cy {
-            width: 100%;
-            height: 100%;
-        }
-    </style> 
-</head>
-<body>
-    <div id="cy"></div> 
-    <script>
-    var cy = cytoscape({
-      container: $('#cy'),
-      boxSelectionEnabled: false,
-      autounselectify: true,
-	  layout: {
-		  name:'dagre'
-	  }, 
-      style: [
-      {
-          selector: 'node',
-          style: {
-              'content': 'data(id)',
-              'text-opacity': 0.5,
-              'text-valign': 'center',
-              'text-halign': 'right',
-              'background-color': '#11479e'
-          }
-      },
-      {
-          selector: 'edge',
-          style: {
-              'curve-style': 'bezier',
-              'width': 4,
-              'target-arrow-shape': 'triangle',
-              'line-color': '#9dbaea',
-              'target-arrow-color': '#9dbaea',
-          }
-      }
-      ],
-    });
-    $.get( "/graph", function( data ) {
-        console.log(data) 
-        cy.add(JSON.parse(data).elements)
-		console.log(cy.nodes())
-        cy.layout({
-            name:"dagre"
-        }).run();
-
-        cy.elements().qtip({
-            content: function(){
-                d = this.data().data; 
-                str = "" 
-                for (var key in d) {
-                    str += "<b>"+key+":</b></br>"
-                    cont = [].concat(d[key]);
-                    for(var i in cont){
-                        str += cont[i] + "</br>"
-                    }
-                }
-
-                return str
-            },
-            position: {
-              my: 'right center',
-              at: 'left center'
-            },
-            style: {
-              classes: 'qtip-bootstrap',
-              tip: {
-                width: 16,
-                height: 8
-              }
-            }
-        })
-    });
-    </script> 
-</body>
-`
-
-func startPipelineVisualization(p *pipeline.Pipeline, port string) error {
-	cy := &gotoscapejs.Cytoscape{}
+// The web UI. The page, scripts and stylesheets are embedded in the binary so
+// that the visualization works without network access.
+//
+//go:embed assets
+var assets embed.FS
+
+var indexTemplate = template.Must(template.ParseFS(assets, "assets/index.html"))
+
+// Serves the pipeline visualization with the live state of the run, the web
+// API of the run under /api/, the history of the runs in the output directory
+// under /history, and the Prometheus metrics of the run unless m is nil.
+func startPipelineVisualization(p *pipeline.Pipeline, srv *webServer, addr string, api *runAPI, m *metrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/assets/", http.FileServer(http.FS(assets)))
+	if m != nil {
+		mux.Handle("/metrics", m.handler())
+	}
+	mux.HandleFunc("/history", serveHistoryPage)
+	history := http.StripPrefix("/api/history", &historyAPI{outputHistory(api.hostpath)})
+	mux.Handle("/api/history", history)
+	mux.Handle("/api/history/", history)
+	mux.Handle("/", visualizationHandler(p, api))
+
+	fmt.Println("View pipeline visualization on " + srv.url(addr))
+	return srv.listenAndServe(addr, mux)
+
+}
+
+// Returns the handler for the visualization of a pipeline run. The page refers
+// to the graph, status and API of the run with relative URLs, so the handler
+// can be mounted under any path ending in a slash. The assets are served
+// separately under /assets/.
+func visualizationHandler(p *pipeline.Pipeline, api *runAPI) http.Handler {
+	cy := &cytoscapeGraph{}
 
 	for _, stage := range p.Stages {
-		cy.Add(gotoscapejs.Element{
+		cy.add(cytoscapeElement{
 			Group: "nodes",
-			Data: gotoscapejs.Data{
+			Data: cytoscapeData{
 				Id: stage.Name,
 				Data: map[string]interface{}{
 					"Image":   stage.Image,
@@ -119,9 +64,9 @@ func startPipelineVisualization(p *pipeline.Pipeline, port string) error {
 		})
 
 		for _, input := range stage.Inputs {
-			cy.Add(gotoscapejs.Element{
+			cy.add(cytoscapeElement{
 				Group: "edges",
-				Data: gotoscapejs.Data{
+				Data: cytoscapeData{
 					Id:     stage.Name + input,
 					Source: input,
 					Target: stage.Name,
@@ -132,13 +77,108 @@ func startPipelineVisualization(p *pipeline.Pipeline, port string) error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/graph", func(w http.ResponseWriter, req *http.Request) {
-		cy.Write(w)
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(cy)
+		if err != nil {
+			log.Println("Could not write pipeline graph:", err)
+		}
 	})
+	mux.Handle("/status", newStatusFeed(api.state))
+	mux.Handle("/api/", http.StripPrefix("/api", api))
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		w.Write([]byte(vis))
+		err := indexTemplate.Execute(w, p)
+		if err != nil {
+			log.Println("Could not render pipeline visualization:", err)
+		}
 	})
+	return mux
+}
+
+// The elements of a pipeline graph, in the format cytoscape.js reads.
+type cytoscapeGraph struct {
+	Elements []cytoscapeElement `json:"elements"`
+}
+
+// A node or an edge of the graph. Group is "nodes" or "edges".
+type cytoscapeElement struct {
+	Group string        `json:"group"`
+	Data  cytoscapeData `json:"data"`
+}
+
+// The data of a node, or the source and target of an edge. The stage settings
+// of a node are in Data.
+type cytoscapeData struct {
+	Id     string                 `json:"id"`
+	Source string                 `json:"source,omitempty"`
+	Target string                 `json:"target,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
 
-	fmt.Println("View pipeline visualization on http://localhost" + port)
-	return http.ListenAndServe(port, mux)
+func (g *cytoscapeGraph) add(e cytoscapeElement) {
+	g.Elements = append(g.Elements, e)
+}
+
+// Pushes the state of a pipeline run to web clients as server-sent events.
+// Every event is the complete run state, so clients that fall behind only need
+// the latest one.
+type statusFeed struct {
+	mu      sync.Mutex
+	latest  []byte
+	clients map[chan []byte]bool
+}
+
+func newStatusFeed(state *runState) *statusFeed {
+	f := &statusFeed{clients: make(map[chan []byte]bool)}
+	f.latest, _ = state.json()
+	state.listen(f.publish)
+	return f
+}
 
+// Sends the run state to all clients without blocking. A client that has not
+// received the previous state gets the new one in its place.
+func (f *statusFeed) publish(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.latest = b
+	for client := range f.clients {
+		select {
+		case <-client:
+		default:
+		}
+		client <- b
+	}
+}
+
+func (f *statusFeed) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	client := make(chan []byte, 1)
+	f.mu.Lock()
+	client <- f.latest
+	f.clients[client] = true
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.clients, client)
+		f.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case b := <-client:
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fjukstad/walrus/pipeline"
+)
+
+// The page must only refer to assets that are built into the binary, so that
+// the visualization works without network access.
+func TestVisualizationAssetsAreEmbedded(t *testing.T) {
+	api, _ := testAPI(t)
+	p := &pipeline.Pipeline{Name: "p", Stages: []*pipeline.Stage{{Name: "a"}}}
+
+	mux := http.NewServeMux()
+	mux.Handle("/assets/", http.FileServer(http.FS(assets)))
+	mux.Handle("/", visualizationHandler(p, api))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	page := fetch(t, server.URL+"/")
+	refs := regexp.MustCompile(`(?:src|href)="([^"]+\.(?:js|css))"`).FindAllStringSubmatch(page, -1)
+	if len(refs) == 0 {
+		t.Fatal("The page refers to no scripts or stylesheets")
+	}
+	for _, ref := range refs {
+		if !regexp.MustCompile(`^/assets/`).MatchString(ref[1]) {
+			t.Errorf("The page refers to %s outside the embedded assets", ref[1])
+			continue
+		}
+		fetch(t, server.URL+ref[1])
+	}
+
+	var graph cytoscapeGraph
+	err := json.Unmarshal([]byte(fetch(t, server.URL+"/graph")), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Elements) == 0 || graph.Elements[0].Group != "nodes" {
+		t.Errorf("Got graph %+v", graph)
+	}
+}
+
+// Returns the body of a successful GET request.
+func fetch(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s %s", url, resp.Status, b)
+	}
+	return string(b)
+}
+
+// Reads the next server-sent event and decodes the run state in it.
+func readStatusEvent(t *testing.T, r *bufio.Reader) *runState {
+	t.Helper()
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("Event line is %q", line)
+	}
+	blank, err := r.ReadString('\n')
+	if err != nil || blank != "\n" {
+		t.Fatalf("Event is not ended by a blank line: %q, %v", blank, err)
+	}
+
+	state := &runState{}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestStatusFeed(t *testing.T) {
+	api, _ := testAPI(t)
+	state := api.state
+	feed := newStatusFeed(state)
+	server := httptest.NewServer(feed)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content type is %s", got)
+	}
+
+	// New clients get the current state first, and then every change.
+	r := bufio.NewReader(resp.Body)
+	if got := readStatusEvent(t, r); got.ID != "run1" || got.Stages[0].Status != statusQueued {
+		t.Errorf("The first event has run %s with stage a %s", got.ID, got.Stages[0].Status)
+	}
+
+	state.updateStage("a", func(s *stageState) { s.Status = statusRunning })
+	if got := readStatusEvent(t, r); got.Stages[0].Status != statusRunning {
+		t.Errorf("Stage a is %s after it started", got.Stages[0].Status)
+	}
+
+	// Clients are forgotten once they disconnect.
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		feed.mu.Lock()
+		clients := len(feed.clients)
+		feed.mu.Unlock()
+		if clients == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients are left after disconnecting", clients)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A client that falls behind gets the latest state instead of the ones it
+// missed, and does not hold up the run.
+func TestStatusFeedSlowClient(t *testing.T) {
+	api, _ := testAPI(t)
+	feed := newStatusFeed(api.state)
+
+	client := make(chan []byte, 1)
+	feed.clients[client] = true
+
+	done := make(chan struct{})
+	go func() {
+		for _, b := range []string{"1", "2", "3"} {
+			feed.publish([]byte(b))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publishing blocked on a slow client")
+	}
+	if got := string(<-client); got != "3" {
+		t.Errorf("The slow client got state %s, not the latest", got)
+	}
+}